@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// AtomicCache is implemented by adapters with atomic read-modify-write
+// operations.
+type AtomicCache interface {
+	Cache
+	// Incr adds delta to the integer stored at key and returns the result.
+	// A missing key counts as 0. The ttl of the key is kept.
+	Incr(key string, delta int64) (int64, error)
+	// Decr subtracts delta, like Incr.
+	Decr(key string, delta int64) (int64, error)
+	// Add sets key only when it does not exist, and reports whether it did.
+	Add(key string, val interface{}, timeout time.Duration) (bool, error)
+	// CompareAndSwap replaces the value of key with new when it currently
+	// is old, and reports whether it did. A missing key never matches.
+	CompareAndSwap(key string, old, new interface{}, timeout time.Duration) (bool, error)
+	// GetWithTTL returns the value of key and its remaining ttl: 0 when it
+	// never expires, negative when the backend cannot tell. A miss is a
+	// nil value with a nil error.
+	GetWithTTL(key string) (interface{}, time.Duration, error)
+}
+
+// addInt adds delta to v, keeping the integer type of v.
+func addInt(v interface{}, delta int64) (interface{}, int64, error) {
+	switch n := v.(type) {
+	case int:
+		n += int(delta)
+		return n, int64(n), nil
+	case int8:
+		n += int8(delta)
+		return n, int64(n), nil
+	case int16:
+		n += int16(delta)
+		return n, int64(n), nil
+	case int32:
+		n += int32(delta)
+		return n, int64(n), nil
+	case int64:
+		n += delta
+		return n, n, nil
+	case uint:
+		n += uint(delta)
+		return n, int64(n), nil
+	case uint8:
+		n += uint8(delta)
+		return n, int64(n), nil
+	case uint16:
+		n += uint16(delta)
+		return n, int64(n), nil
+	case uint32:
+		n += uint32(delta)
+		return n, int64(n), nil
+	case uint64:
+		n += uint64(delta)
+		return n, int64(n), nil
+	}
+	return nil, 0, fmt.Errorf("cache: value is %T, not an integer", v)
+}
+
+// valuesEqual compares cached values, []byte by content.
+func valuesEqual(a, b interface{}) bool {
+	if ab, ok := a.([]byte); ok {
+		bb, ok := b.([]byte)
+		return ok && bytes.Equal(ab, bb)
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheIncr(t *testing.T) {
+	bc := newTestMemory(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bc.Incr("n", 2)
+		}()
+	}
+	wg.Wait()
+	if n, err := bc.Decr("n", 1); err != nil || n != 199 {
+		t.Fatalf("Decr = %d, %v", n, err)
+	}
+
+	bc.Set("typed", 5, time.Hour)
+	if n, _ := bc.Incr("typed", 1); n != 6 {
+		t.Fatalf("Incr = %d", n)
+	}
+	if _, ttl, _ := bc.GetWithTTL("typed"); ttl <= 59*time.Minute {
+		t.Fatalf("Incr lost the ttl: %v", ttl)
+	}
+	if v := bc.Get("typed"); v != 6 {
+		t.Fatalf("Incr changed the type: %#v", v)
+	}
+
+	bc.Set("str", "x", 0)
+	if _, err := bc.Incr("str", 1); err == nil {
+		t.Fatal("Incr of a string should fail")
+	}
+}
+
+func TestMemoryCacheAddAndCAS(t *testing.T) {
+	bc := newTestMemory(t)
+	if ok, _ := bc.Add("k", []byte("a"), 0); !ok {
+		t.Fatal("Add of a new key failed")
+	}
+	if ok, _ := bc.Add("k", []byte("b"), 0); ok {
+		t.Fatal("Add overwrote an existing key")
+	}
+	if ok, _ := bc.CompareAndSwap("k", []byte("x"), []byte("c"), 0); ok {
+		t.Fatal("CompareAndSwap with a wrong old value succeeded")
+	}
+	if ok, _ := bc.CompareAndSwap("k", []byte("a"), []byte("c"), time.Minute); !ok {
+		t.Fatal("CompareAndSwap failed")
+	}
+	v, ttl, err := bc.GetWithTTL("k")
+	if err != nil || string(v.([]byte)) != "c" || ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("GetWithTTL = %v, %v, %v", v, ttl, err)
+	}
+	if ok, _ := bc.CompareAndSwap("missing", nil, 1, 0); ok {
+		t.Fatal("CompareAndSwap matched a missing key")
+	}
+	if v, ttl, err := bc.GetWithTTL("missing"); v != nil || ttl != 0 || err != nil {
+		t.Fatalf("GetWithTTL of a miss = %v, %v, %v", v, ttl, err)
+	}
+}
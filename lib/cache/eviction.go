@@ -0,0 +1,342 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// EvictionPolicy decides which key a bounded MemoryCache drops when it is over
+// capacity. Policies are called with the cache lock held and need no locking
+// of their own.
+type EvictionPolicy interface {
+	// Add records a key that was just inserted.
+	Add(key string)
+	// Access records a read or an overwrite of an existing key.
+	Access(key string)
+	// Remove forgets a key that left the cache.
+	Remove(key string)
+	// Victim returns the key to evict next, ok is false when the policy
+	// tracks no keys.
+	Victim() (key string, ok bool)
+}
+
+// lruPolicy evicts the least recently used key.
+type lruPolicy struct {
+	ll    *list.List
+	elems map[string]*list.Element
+}
+
+// NewLRUPolicy returns a least-recently-used EvictionPolicy.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{ll: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) Add(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.ll.MoveToFront(e)
+		return
+	}
+	p.elems[key] = p.ll.PushFront(key)
+}
+
+func (p *lruPolicy) Access(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.ll.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.ll.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	if e := p.ll.Back(); e != nil {
+		return e.Value.(string), true
+	}
+	return "", false
+}
+
+// lfuEntry is a key in the lfu heap.
+type lfuEntry struct {
+	key   string
+	count uint64
+	seq   uint64 // last access, breaks ties in favour of recent keys
+	index int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count == h[j].count {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].count < h[j].count
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+// lfuPolicy evicts the least frequently used key, the least recently used
+// one among equals.
+type lfuPolicy struct {
+	h       lfuHeap
+	entries map[string]*lfuEntry
+	seq     uint64
+}
+
+// NewLFUPolicy returns a least-frequently-used EvictionPolicy.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{entries: make(map[string]*lfuEntry)}
+}
+
+func (p *lfuPolicy) Add(key string) {
+	if _, ok := p.entries[key]; ok {
+		p.Access(key)
+		return
+	}
+	p.seq++
+	e := &lfuEntry{key: key, count: 1, seq: p.seq}
+	p.entries[key] = e
+	heap.Push(&p.h, e)
+}
+
+func (p *lfuPolicy) Access(key string) {
+	if e, ok := p.entries[key]; ok {
+		p.seq++
+		e.count++
+		e.seq = p.seq
+		heap.Fix(&p.h, e.index)
+	}
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	if e, ok := p.entries[key]; ok {
+		heap.Remove(&p.h, e.index)
+		delete(p.entries, key)
+	}
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	if len(p.h) == 0 {
+		return "", false
+	}
+	return p.h[0].key, true
+}
+
+// tinyLFU segments
+const (
+	segWindow = iota
+	segProbation
+	segProtected
+)
+
+type tinyLFUEntry struct {
+	key string
+	seg int
+}
+
+// tinyLFUPolicy is a W-TinyLFU policy: new keys enter a small LRU window,
+// keys leaving the window compete with the main segmented LRU's victim and
+// are only admitted when the frequency sketch has seen them more often.
+type tinyLFUPolicy struct {
+	sketch       *cmSketch
+	window       *list.List
+	probation    *list.List
+	protected    *list.List
+	elems        map[string]*list.Element
+	windowCap    int
+	protectedCap int
+}
+
+// NewTinyLFUPolicy returns a W-TinyLFU EvictionPolicy sized for about
+// capacity entries.
+func NewTinyLFUPolicy(capacity int) EvictionPolicy {
+	if capacity < 1 {
+		capacity = 1
+	}
+	windowCap := capacity / 100
+	if windowCap < 1 {
+		windowCap = 1
+	}
+	return &tinyLFUPolicy{
+		sketch:       newCMSketch(capacity),
+		window:       list.New(),
+		probation:    list.New(),
+		protected:    list.New(),
+		elems:        make(map[string]*list.Element),
+		windowCap:    windowCap,
+		protectedCap: (capacity - windowCap) * 8 / 10,
+	}
+}
+
+func (p *tinyLFUPolicy) Add(key string) {
+	p.sketch.increment(key)
+	if _, ok := p.elems[key]; ok {
+		p.touch(key)
+		return
+	}
+	p.elems[key] = p.window.PushFront(&tinyLFUEntry{key: key, seg: segWindow})
+	for p.window.Len() > p.windowCap {
+		e := p.window.Back()
+		ent := p.window.Remove(e).(*tinyLFUEntry)
+		ent.seg = segProbation
+		p.elems[ent.key] = p.probation.PushFront(ent)
+	}
+}
+
+func (p *tinyLFUPolicy) Access(key string) {
+	p.sketch.increment(key)
+	p.touch(key)
+}
+
+func (p *tinyLFUPolicy) touch(key string) {
+	e, ok := p.elems[key]
+	if !ok {
+		return
+	}
+	ent := e.Value.(*tinyLFUEntry)
+	switch ent.seg {
+	case segWindow:
+		p.window.MoveToFront(e)
+	case segProtected:
+		p.protected.MoveToFront(e)
+	case segProbation:
+		p.probation.Remove(e)
+		ent.seg = segProtected
+		p.elems[key] = p.protected.PushFront(ent)
+		for p.protected.Len() > p.protectedCap && p.protected.Len() > 0 {
+			last := p.protected.Back()
+			demoted := p.protected.Remove(last).(*tinyLFUEntry)
+			demoted.seg = segProbation
+			p.elems[demoted.key] = p.probation.PushFront(demoted)
+		}
+	}
+}
+
+func (p *tinyLFUPolicy) Remove(key string) {
+	e, ok := p.elems[key]
+	if !ok {
+		return
+	}
+	switch e.Value.(*tinyLFUEntry).seg {
+	case segWindow:
+		p.window.Remove(e)
+	case segProbation:
+		p.probation.Remove(e)
+	case segProtected:
+		p.protected.Remove(e)
+	}
+	delete(p.elems, key)
+}
+
+// Victim lets the newest probation entry, the candidate that just left the
+// window, compete with the oldest one and returns the loser.
+func (p *tinyLFUPolicy) Victim() (string, bool) {
+	if p.probation.Len() == 0 {
+		if e := p.protected.Back(); e != nil {
+			return e.Value.(*tinyLFUEntry).key, true
+		}
+		if e := p.window.Back(); e != nil {
+			return e.Value.(*tinyLFUEntry).key, true
+		}
+		return "", false
+	}
+	victim := p.probation.Back().Value.(*tinyLFUEntry).key
+	candidate := p.probation.Front().Value.(*tinyLFUEntry).key
+	if candidate == victim || p.sketch.estimate(candidate) > p.sketch.estimate(victim) {
+		return victim, true
+	}
+	return candidate, true
+}
+
+// cmSketch is a count-min sketch of 4-row saturating counters that halves
+// itself after a sample period so old popularity fades out.
+type cmSketch struct {
+	rows      [4][]uint8
+	mask      uint32
+	additions int
+	sample    int
+}
+
+func newCMSketch(capacity int) *cmSketch {
+	// Eight counters per entry keep collisions rare enough for one-hit keys
+	// not to look popular.
+	width := 16
+	for width < 8*capacity {
+		width <<= 1
+	}
+	s := &cmSketch{mask: uint32(width - 1), sample: 10 * capacity}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *cmSketch) index(h uint64, i int) uint32 {
+	return (uint32(h) + uint32(i)*uint32(h>>32|1)) & s.mask
+}
+
+func (s *cmSketch) increment(key string) {
+	h := hashKey(key)
+	for i := range s.rows {
+		if idx := s.index(h, i); s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+	s.additions++
+	if s.additions >= s.sample {
+		s.reset()
+	}
+}
+
+func (s *cmSketch) estimate(key string) uint8 {
+	h := hashKey(key)
+	min := uint8(15)
+	for i := range s.rows {
+		if v := s.rows[i][s.index(h, i)]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+func (s *cmSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+// hashKey is FNV-1a over key, without the allocation of hash/fnv.
+func hashKey(key string) uint64 {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+	h := uint64(offset64)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= prime64
+	}
+	return h
+}
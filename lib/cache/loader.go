@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LoadFunc computes the value of a key on a cache miss.
+type LoadFunc[V any] func(ctx context.Context) (V, error)
+
+type LoaderOpts struct {
+	// Codec encodes entries for the remote adapters, defaults to
+	// DefaultCodec.
+	Codec Codec
+	// Beta enables probabilistic early refresh: the closer an entry is to
+	// its ttl, and the slower it was to load, the likelier a read refreshes
+	// it in the background. 1 is a good start, 0 disables it.
+	Beta float64
+	// StaleTTL keeps entries this long past their ttl. Reads in that window
+	// get the stale value while a refresh runs in the background.
+	StaleTTL time.Duration
+	// ErrorLog receives background refresh and cache write errors, defaults
+	// to the standard logger.
+	ErrorLog *log.Logger
+}
+
+// loadedEntry is what a Loader stores: the value plus the soft expiry and
+// load time the refresh decisions are based on.
+type loadedEntry[V any] struct {
+	Val    V
+	Expire int64 // unix nano, 0 means never
+	Delta  int64 // load duration in nanoseconds
+}
+
+// Loader implements cache-aside loading on top of any adapter. Concurrent
+// loads of the same key are collapsed into one call of the LoadFunc.
+type Loader[V any] struct {
+	cache TypedCache[loadedEntry[V]]
+	opts  LoaderOpts
+	group flightGroup[V]
+}
+
+// NewLoader returns a Loader storing its entries in adapter. opts may be nil.
+func NewLoader[V any](adapter Cache, opts *LoaderOpts) *Loader[V] {
+	l := &Loader[V]{}
+	if opts != nil {
+		l.opts = *opts
+	}
+	if l.opts.Codec == nil {
+		l.opts.Codec = DefaultCodec
+	}
+	l.cache = NewTypedCache[loadedEntry[V]](adapter, l.opts.Codec)
+	return l
+}
+
+// GetOrLoad returns the cached value of key, calling loader and caching its
+// result for ttl on a miss. An unreachable cache is treated as a miss, so
+// the value is still loaded.
+func (l *Loader[V]) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader LoadFunc[V]) (V, error) {
+	e, ok, err := l.cache.Get(ctx, key)
+	if err != nil {
+		if ctx.Err() != nil {
+			return e.Val, err
+		}
+		l.logf("cache: get %q: %v", key, err)
+	}
+	if ok {
+		if l.shouldRefresh(e, time.Now()) {
+			l.refresh(ctx, key, ttl, loader)
+		}
+		return e.Val, nil
+	}
+
+	c := l.group.do(key, func() (V, error) {
+		return l.load(context.WithoutCancel(ctx), key, ttl, loader)
+	})
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+// shouldRefresh reports whether e is stale, or is picked for an early
+// refresh by the XFetch rule: now - delta*beta*ln(rand) >= expire.
+func (l *Loader[V]) shouldRefresh(e loadedEntry[V], now time.Time) bool {
+	if e.Expire == 0 {
+		return false
+	}
+	if now.UnixNano() >= e.Expire {
+		return true
+	}
+	if l.opts.Beta <= 0 || e.Delta <= 0 {
+		return false
+	}
+	gap := -float64(e.Delta) * l.opts.Beta * math.Log(rand.Float64())
+	return float64(now.UnixNano())+gap >= float64(e.Expire)
+}
+
+// refresh reloads key in the background unless a load is already running.
+func (l *Loader[V]) refresh(ctx context.Context, key string, ttl time.Duration, loader LoadFunc[V]) {
+	ctx = context.WithoutCancel(ctx)
+	c := l.group.do(key, func() (V, error) {
+		return l.load(ctx, key, ttl, loader)
+	})
+	go func() {
+		<-c.done
+		if c.err != nil {
+			l.logf("cache: refresh %q: %v", key, c.err)
+		}
+	}()
+}
+
+func (l *Loader[V]) load(ctx context.Context, key string, ttl time.Duration, loader LoadFunc[V]) (val V, err error) {
+	start := time.Now()
+	if val, err = loader(ctx); err != nil {
+		return
+	}
+	e := loadedEntry[V]{Val: val, Delta: int64(time.Since(start))}
+	hard := ttl
+	if ttl > 0 {
+		e.Expire = start.Add(ttl).UnixNano()
+		hard += l.opts.StaleTTL
+	}
+	if err := l.cache.Set(ctx, key, e, hard); err != nil {
+		l.logf("cache: set %q: %v", key, err)
+	}
+	return val, nil
+}
+
+func (l *Loader[V]) logf(format string, args ...interface{}) {
+	if l.opts.ErrorLog != nil {
+		l.opts.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// flightCall is a load in progress, val and err are set before done is
+// closed.
+type flightCall[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+}
+
+// flightGroup runs at most one function per key at a time.
+type flightGroup[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall[V]
+}
+
+// do starts fn for key in its own goroutine, or returns the call already
+// running for key.
+func (g *flightGroup[V]) do(key string, fn func() (V, error)) *flightCall[V] {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		return c
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[V])
+	}
+	c := &flightCall[V]{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				c.err = fmt.Errorf("cache: loader panic: %v", r)
+			}
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+		c.val, c.err = fn()
+	}()
+	return c
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoaderCollapsesConcurrentLoads(t *testing.T) {
+	l := NewLoader[int](newTestMemory(t), nil)
+	var calls int32
+	release := make(chan struct{})
+	loader := func(ctx context.Context) (int, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := l.GetOrLoad(context.Background(), "k", time.Minute, loader)
+			if err != nil || v != 42 {
+				t.Errorf("GetOrLoad = %v, %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("loader called %d times, want 1", n)
+	}
+	if v, _ := l.GetOrLoad(context.Background(), "k", time.Minute, loader); v != 42 || calls != 1 {
+		t.Fatalf("cached GetOrLoad = %v after %d calls", v, calls)
+	}
+}
+
+func TestLoaderError(t *testing.T) {
+	l := NewLoader[string](newTestMemory(t), nil)
+	boom := errors.New("boom")
+	if _, err := l.GetOrLoad(context.Background(), "k", time.Minute, func(context.Context) (string, error) {
+		return "", boom
+	}); err != boom {
+		t.Fatalf("err = %v, want boom", err)
+	}
+	if _, err := l.GetOrLoad(context.Background(), "k", time.Minute, func(context.Context) (string, error) {
+		panic("bad loader")
+	}); err == nil {
+		t.Fatal("a panicking loader must return an error")
+	}
+}
+
+func TestLoaderTiered(t *testing.T) {
+	s := newFakeRedis(t)
+	newLoader := func() *Loader[[]string] {
+		tc := NewTieredCache().(*TieredCache)
+		if err := tc.Init(&TieredOpts{L2: newTestRedis(t, s)}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { tc.Close() })
+		return NewLoader[[]string](tc, nil)
+	}
+	ctx := context.Background()
+	want := []string{"a", "b"}
+	if v, err := newLoader().GetOrLoad(ctx, "k", time.Minute, func(context.Context) ([]string, error) {
+		return want, nil
+	}); err != nil || len(v) != 2 {
+		t.Fatalf("GetOrLoad = %v, %v", v, err)
+	}
+
+	// another replica reads the entry back from L2
+	v, err := newLoader().GetOrLoad(ctx, "k", time.Minute, func(context.Context) ([]string, error) {
+		return nil, errors.New("loaded again")
+	})
+	if err != nil || len(v) != 2 || v[0] != "a" || v[1] != "b" {
+		t.Fatalf("GetOrLoad through L2 = %v, %v", v, err)
+	}
+}
+
+func TestLoaderServesStaleWhileRefreshing(t *testing.T) {
+	l := NewLoader[int](newTestMemory(t), &LoaderOpts{StaleTTL: time.Minute})
+	var calls int32
+	refreshed := make(chan struct{}, 1)
+	loader := func(ctx context.Context) (int, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if n > 1 {
+			refreshed <- struct{}{}
+		}
+		return int(n), nil
+	}
+	ctx := context.Background()
+	if v, _ := l.GetOrLoad(ctx, "k", 10*time.Millisecond, loader); v != 1 {
+		t.Fatalf("first load = %d", v)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if v, _ := l.GetOrLoad(ctx, "k", 10*time.Millisecond, loader); v != 1 {
+		t.Fatalf("stale read = %d, want 1", v)
+	}
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("no background refresh")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if v, _ := l.GetOrLoad(ctx, "k", time.Minute, loader); v != 2 {
+		t.Fatalf("read after refresh = %d, want 2", v)
+	}
+}
+
+func TestLoaderCanceledWaiter(t *testing.T) {
+	l := NewLoader[int](newTestMemory(t), nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	_, err := l.GetOrLoad(ctx, "k", time.Minute, func(context.Context) (int, error) {
+		time.Sleep(50 * time.Millisecond)
+		return 1, nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v", err)
+	}
+}
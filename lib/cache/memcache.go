@@ -1,7 +1,10 @@
 package cache
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"strconv"
 	"strings"
 	"time"
 
@@ -33,6 +36,23 @@ func (rc *MemCache) Get(key string) interface{} {
 	return nil
 }
 
+// GetWithError is Get reporting failures, a miss is nil with a nil error.
+func (rc *MemCache) GetWithError(key string) (interface{}, error) {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return nil, err
+		}
+	}
+	item, err := rc.conn.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.Value, nil
+}
+
 func (rc *MemCache) Set(key string, val interface{}, timeout time.Duration) error {
 	if rc.conn == nil {
 		if err := rc.connectInit(); err != nil {
@@ -40,13 +60,11 @@ func (rc *MemCache) Set(key string, val interface{}, timeout time.Duration) erro
 		}
 	}
 	item := memcache.Item{Key: key, Expiration: int32(timeout / time.Second)}
-	if v, ok := val.([]byte); ok {
-		item.Value = v
-	} else if str, ok := val.(string); ok {
-		item.Value = []byte(str)
-	} else {
-		return errors.New("val only support string and []byte")
+	v, err := memValue(val)
+	if err != nil {
+		return err
 	}
+	item.Value = v
 	return rc.conn.Set(&item)
 }
 
@@ -69,6 +87,104 @@ func (rc *MemCache) IsExist(key string) bool {
 	return !(err != nil)
 }
 
+// Incr uses the memcache counters, which are unsigned: the key must hold a
+// decimal number and a result below 0 is stored as 0.
+func (rc *MemCache) Incr(key string, delta int64) (int64, error) {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return 0, err
+		}
+	}
+	for {
+		var (
+			n   uint64
+			err error
+		)
+		if delta < 0 {
+			n, err = rc.conn.Decrement(key, uint64(-delta))
+		} else {
+			n, err = rc.conn.Increment(key, uint64(delta))
+		}
+		if err != memcache.ErrCacheMiss {
+			return int64(n), err
+		}
+		// Create the counter, unless another client just did.
+		start := delta
+		if start < 0 {
+			start = 0
+		}
+		err = rc.conn.Add(&memcache.Item{Key: key, Value: []byte(strconv.FormatInt(start, 10))})
+		if err != memcache.ErrNotStored {
+			return start, err
+		}
+	}
+}
+
+func (rc *MemCache) Decr(key string, delta int64) (int64, error) {
+	return rc.Incr(key, -delta)
+}
+
+func (rc *MemCache) Add(key string, val interface{}, timeout time.Duration) (bool, error) {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return false, err
+		}
+	}
+	v, err := memValue(val)
+	if err != nil {
+		return false, err
+	}
+	err = rc.conn.Add(&memcache.Item{Key: key, Value: v, Expiration: expiration(timeout)})
+	if err == memcache.ErrNotStored {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CompareAndSwap uses the gets/cas pair, so a concurrent write between the
+// two makes it report false.
+func (rc *MemCache) CompareAndSwap(key string, old, new interface{}, timeout time.Duration) (bool, error) {
+	if rc.conn == nil {
+		if err := rc.connectInit(); err != nil {
+			return false, err
+		}
+	}
+	ov, err := memValue(old)
+	if err != nil {
+		return false, err
+	}
+	nv, err := memValue(new)
+	if err != nil {
+		return false, err
+	}
+	item, err := rc.conn.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(item.Value, ov) {
+		return false, nil
+	}
+	item.Value = nv
+	item.Expiration = expiration(timeout)
+	err = rc.conn.CompareAndSwap(item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored || err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetWithTTL always reports a ttl of -1, memcache does not expose it.
+func (rc *MemCache) GetWithTTL(key string) (interface{}, time.Duration, error) {
+	v, err := rc.GetWithError(key)
+	if v == nil || err != nil {
+		return v, 0, err
+	}
+	return v, -1, nil
+}
+
 func (rc *MemCache) Init(cfg interface{}) error {
 	var opts *MemOpts
 	if val, ok := cfg.(*MemOpts); !ok {
@@ -88,11 +204,137 @@ func (rc *MemCache) Init(cfg interface{}) error {
 	return nil
 }
 
+// memValue converts val to the bytes memcache stores.
+func memValue(val interface{}) ([]byte, error) {
+	if v, ok := val.([]byte); ok {
+		return v, nil
+	} else if str, ok := val.(string); ok {
+		return []byte(str), nil
+	}
+	return nil, errors.New("val only support string and []byte")
+}
+
 func (rc *MemCache) connectInit() error {
 	rc.conn = memcache.New(rc.conninfo...)
 	return nil
 }
 
+// typedMemCache implements TypedCache on top of the memcache adapter, storing
+// values encoded with codec. The memcache client has no context support, so
+// ctx is only checked before each call.
+type typedMemCache[V any] struct {
+	rc    *MemCache
+	codec Codec
+}
+
+// NewTypedMemCache returns a TypedCache sharing the client of rc. A nil codec
+// means DefaultCodec.
+func NewTypedMemCache[V any](rc *MemCache, codec Codec) TypedCache[V] {
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	return &typedMemCache[V]{rc: rc, codec: codec}
+}
+
+func (tm *typedMemCache[V]) client(ctx context.Context) (*memcache.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if tm.rc.conn == nil {
+		if err := tm.rc.connectInit(); err != nil {
+			return nil, err
+		}
+	}
+	return tm.rc.conn, nil
+}
+
+func (tm *typedMemCache[V]) Get(ctx context.Context, key string) (val V, ok bool, err error) {
+	conn, err := tm.client(ctx)
+	if err != nil {
+		return
+	}
+	item, err := conn.Get(key)
+	if err == memcache.ErrCacheMiss {
+		return val, false, nil
+	}
+	if err != nil {
+		return
+	}
+	return decodeValue[V](tm.codec, key, item.Value)
+}
+
+func (tm *typedMemCache[V]) Set(ctx context.Context, key string, val V, ttl time.Duration) error {
+	conn, err := tm.client(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := tm.codec.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return conn.Set(&memcache.Item{Key: key, Value: data, Expiration: expiration(ttl)})
+}
+
+func (tm *typedMemCache[V]) Delete(ctx context.Context, key string) error {
+	conn, err := tm.client(ctx)
+	if err != nil {
+		return err
+	}
+	if err = conn.Delete(key); err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+func (tm *typedMemCache[V]) GetMulti(ctx context.Context, keys []string) (map[string]V, error) {
+	conn, err := tm.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	items, err := conn.GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]V, len(items))
+	for key, item := range items {
+		val, _, err := decodeValue[V](tm.codec, key, item.Value)
+		if err != nil {
+			return nil, err
+		}
+		res[key] = val
+	}
+	return res, nil
+}
+
+func (tm *typedMemCache[V]) SetMulti(ctx context.Context, items map[string]V, ttl time.Duration) error {
+	for key, val := range items {
+		if err := tm.Set(ctx, key, val, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxRelativeExpiration is the longest ttl memcache takes in seconds, it
+// reads larger expirations as unix times.
+const maxRelativeExpiration = 30 * 24 * time.Hour
+
+// expiration converts ttl to memcache seconds, rounding sub-second ttls up so
+// they do not turn into "never expires". A ttl over 30 days is sent as the
+// unix time it ends at.
+func expiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > maxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+	if sec := int32(ttl / time.Second); sec > 0 {
+		return sec
+	}
+	return 1
+}
+
 func init() {
 	Register("memcache", NewMemCache())
 }
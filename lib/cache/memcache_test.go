@@ -0,0 +1,199 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMemcache is an in-process memcached speaking the text protocol, with
+// the commands the memcache client sends for get, set and delete. Keys in
+// fail get a SERVER_ERROR.
+type fakeMemcache struct {
+	ln net.Listener
+
+	mu   sync.Mutex
+	data map[string][]byte
+	fail map[string]bool
+}
+
+func newFakeMemcache(t testing.TB) *fakeMemcache {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeMemcache{ln: ln, data: make(map[string][]byte), fail: make(map[string]bool)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeMemcache) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) < 2 {
+			return
+		}
+		s.mu.Lock()
+		switch f[0] {
+		case "gets":
+			for _, k := range f[1:] {
+				if s.fail[k] {
+					fmt.Fprintf(rw, "SERVER_ERROR out of memory\r\n")
+					break
+				}
+				if v, ok := s.data[k]; ok {
+					fmt.Fprintf(rw, "VALUE %s 0 %d 1\r\n%s\r\n", k, len(v), v)
+				}
+			}
+			fmt.Fprintf(rw, "END\r\n")
+		case "set":
+			n, _ := strconv.Atoi(f[4])
+			buf := make([]byte, n+2)
+			if _, err := io.ReadFull(rw, buf); err != nil {
+				s.mu.Unlock()
+				return
+			}
+			if s.fail[f[1]] {
+				fmt.Fprintf(rw, "SERVER_ERROR out of memory\r\n")
+			} else {
+				s.data[f[1]] = buf[:n]
+				fmt.Fprintf(rw, "STORED\r\n")
+			}
+		case "delete":
+			if _, ok := s.data[f[1]]; ok {
+				delete(s.data, f[1])
+				fmt.Fprintf(rw, "DELETED\r\n")
+			} else {
+				fmt.Fprintf(rw, "NOT_FOUND\r\n")
+			}
+		default:
+			fmt.Fprintf(rw, "ERROR\r\n")
+		}
+		s.mu.Unlock()
+		if rw.Flush() != nil {
+			return
+		}
+	}
+}
+
+func newTestMemCache(t testing.TB, s *fakeMemcache) *MemCache {
+	mc := NewMemCache().(*MemCache)
+	if err := mc.Init(&MemOpts{Conn: s.ln.Addr().String()}); err != nil {
+		t.Fatal(err)
+	}
+	return mc
+}
+
+func TestTypedMemCacheCodec(t *testing.T) {
+	ctx := context.Background()
+	for name, codec := range map[string]Codec{
+		"json":    JSONCodec{},
+		"gob":     GobCodec{},
+		"msgpack": MsgpackCodec{},
+	} {
+		tc := NewTypedMemCache[typedUser](newTestMemCache(t, newFakeMemcache(t)), codec)
+
+		if _, ok, err := tc.Get(ctx, "u1"); ok || err != nil {
+			t.Fatalf("%s: Get on empty cache = %v, %v", name, ok, err)
+		}
+		if err := tc.Set(ctx, "u1", typedUser{1, "a"}, time.Minute); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if u, ok, err := tc.Get(ctx, "u1"); err != nil || !ok || u != (typedUser{1, "a"}) {
+			t.Fatalf("%s: Get = %v, %v, %v", name, u, ok, err)
+		}
+
+		if err := tc.SetMulti(ctx, map[string]typedUser{"u2": {2, "b"}, "u3": {3, "c"}}, 0); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		res, err := tc.GetMulti(ctx, []string{"u1", "u2", "u4"})
+		if err != nil || len(res) != 2 || res["u2"] != (typedUser{2, "b"}) {
+			t.Fatalf("%s: GetMulti = %v, %v", name, res, err)
+		}
+
+		if err := tc.Delete(ctx, "u1"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := tc.Delete(ctx, "u1"); err != nil {
+			t.Fatalf("%s: Delete of a missing key = %v", name, err)
+		}
+		if _, ok, err := tc.Get(ctx, "u1"); ok || err != nil {
+			t.Fatalf("%s: Get after Delete = %v, %v", name, ok, err)
+		}
+	}
+}
+
+func TestTypedMemCacheErrors(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeMemcache(t)
+	tc := NewTypedMemCache[typedUser](newTestMemCache(t, s), JSONCodec{})
+
+	s.data["bad"] = []byte("not json")
+	if _, ok, err := tc.Get(ctx, "bad"); ok || err == nil {
+		t.Fatalf("Get of an undecodable value = %v, %v", ok, err)
+	}
+	if _, err := tc.GetMulti(ctx, []string{"bad"}); err == nil {
+		t.Fatal("GetMulti of an undecodable value succeeded")
+	}
+
+	s.fail["down"] = true
+	if _, ok, err := tc.Get(ctx, "down"); ok || err == nil {
+		t.Fatalf("Get on a failing server = %v, %v", ok, err)
+	}
+	if err := tc.Set(ctx, "down", typedUser{}, 0); err == nil {
+		t.Fatal("Set on a failing server succeeded")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := tc.Get(ctx, "u1"); err != context.Canceled {
+		t.Fatalf("Get with a canceled context = %v", err)
+	}
+}
+
+func TestMemcacheExpiration(t *testing.T) {
+	for _, tc := range []struct {
+		ttl  time.Duration
+		want int32
+	}{
+		{0, 0},
+		{-time.Second, 0},
+		{time.Millisecond, 1},
+		{90 * time.Second, 90},
+		{30 * 24 * time.Hour, 2592000},
+	} {
+		if got := expiration(tc.ttl); got != tc.want {
+			t.Errorf("expiration(%v) = %d, want %d", tc.ttl, got, tc.want)
+		}
+	}
+
+	// past 30 days memcache takes a unix time
+	ttl := 31 * 24 * time.Hour
+	before := time.Now().Add(ttl).Unix()
+	got := int64(expiration(ttl))
+	if after := time.Now().Add(ttl).Unix(); got < before || got > after {
+		t.Fatalf("expiration(%v) = %d, want about %d", ttl, got, before)
+	}
+}
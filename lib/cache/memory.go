@@ -1,7 +1,11 @@
 package cache
 
 import (
+	"context"
 	"errors"
+	"log"
+	"os"
+	"reflect"
 	"sync"
 	"time"
 )
@@ -12,19 +16,50 @@ var (
 
 type MemoryOpts struct {
 	Interval int
+
+	// MaxEntries and MaxBytes bound the cache, 0 means unbounded. Once a
+	// Set goes over either limit, keys picked by Policy are evicted inline.
+	MaxEntries int
+	MaxBytes   int64
+	// Policy picks the keys to evict, defaults to NewLRUPolicy().
+	Policy EvictionPolicy
+	// Cost returns the size of an item counted against MaxBytes, defaults
+	// to DefaultCost.
+	Cost func(key string, val interface{}) int64
+
+	// SnapshotPath is loaded by Init and saved by Close, and every
+	// SnapshotInterval seconds when that is set. A missing or corrupt
+	// snapshot is logged to ErrorLog and the cache starts empty.
+	SnapshotPath     string
+	SnapshotInterval int
+	ErrorLog         *log.Logger
 }
 
 type MemoryItem struct {
 	val         interface{}
 	createdTime time.Time
 	lifespan    time.Duration
+	cost        int64
+	tags        []string
 }
 
 type MemoryCache struct {
 	sync.RWMutex
-	dur   time.Duration
-	items map[string]*MemoryItem
-	Every int
+	dur        time.Duration
+	items      map[string]*MemoryItem
+	Every      int
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	policy     EvictionPolicy
+	cost       func(key string, val interface{}) int64
+	tags       map[string]map[string]struct{}
+	onEvent    func(Event)
+
+	snapshotPath string
+	snapshotStop chan struct{}
+	vacuumStop   chan struct{}
+	log          *log.Logger
 }
 
 func NewMemoryCache() Cache {
@@ -32,13 +67,39 @@ func NewMemoryCache() Cache {
 	return &cache
 }
 
+// DefaultCost estimates the memory held by an item: the key plus the length
+// of string and []byte values, or the shallow size of any other value.
+func DefaultCost(key string, val interface{}) int64 {
+	n := int64(len(key))
+	switch v := val.(type) {
+	case nil:
+	case []byte:
+		n += int64(len(v))
+	case string:
+		n += int64(len(v))
+	default:
+		n += int64(reflect.TypeOf(v).Size())
+	}
+	return n
+}
+
 func (bc *MemoryCache) Get(name string) interface{} {
-	bc.RLock()
-	defer bc.RUnlock()
+	// A bounded cache records the access in its policy, which needs the
+	// write lock.
+	if bc.policy != nil {
+		bc.Lock()
+		defer bc.Unlock()
+	} else {
+		bc.RLock()
+		defer bc.RUnlock()
+	}
 	if itm, ok := bc.items[name]; ok {
 		if itm.isExpire() {
 			return nil
 		}
+		if bc.policy != nil {
+			bc.policy.Access(name)
+		}
 		return itm.val
 	}
 	return nil
@@ -47,11 +108,11 @@ func (bc *MemoryCache) Get(name string) interface{} {
 func (bc *MemoryCache) Set(name string, value interface{}, lifespan time.Duration) error {
 	bc.Lock()
 	defer bc.Unlock()
-	bc.items[name] = &MemoryItem{
+	bc.setItem(name, &MemoryItem{
 		val:         value,
 		createdTime: time.Now(),
 		lifespan:    lifespan,
-	}
+	})
 	return nil
 }
 
@@ -61,7 +122,7 @@ func (bc *MemoryCache) Delete(name string) error {
 	if _, ok := bc.items[name]; !ok {
 		return errors.New("key not exist")
 	}
-	delete(bc.items, name)
+	bc.removeItem(name)
 	if _, ok := bc.items[name]; ok {
 		return errors.New("delete key error")
 	}
@@ -77,6 +138,117 @@ func (bc *MemoryCache) IsExist(name string) bool {
 	return false
 }
 
+// SetNegative records that name does not exist, Get returns Negative for it
+// until lifespan.
+func (bc *MemoryCache) SetNegative(name string, lifespan time.Duration) error {
+	return bc.Set(name, Negative, lifespan)
+}
+
+func (bc *MemoryCache) SetWithTags(name string, value interface{}, lifespan time.Duration, tags ...string) error {
+	bc.Lock()
+	defer bc.Unlock()
+	bc.setItem(name, &MemoryItem{
+		val:         value,
+		createdTime: time.Now(),
+		lifespan:    lifespan,
+		tags:        tags,
+	})
+	return nil
+}
+
+func (bc *MemoryCache) InvalidateTag(tag string) error {
+	bc.Lock()
+	defer bc.Unlock()
+	for name := range bc.tags[tag] {
+		bc.removeItem(name)
+	}
+	return nil
+}
+
+func (bc *MemoryCache) Incr(name string, delta int64) (int64, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	itm, ok := bc.items[name]
+	if !ok || itm.isExpire() {
+		bc.setItem(name, &MemoryItem{val: delta, createdTime: time.Now()})
+		return delta, nil
+	}
+	val, n, err := addInt(itm.val, delta)
+	if err != nil {
+		return 0, err
+	}
+	bc.setItem(name, &MemoryItem{
+		val:         val,
+		createdTime: itm.createdTime,
+		lifespan:    itm.lifespan,
+		tags:        itm.tags,
+	})
+	return n, nil
+}
+
+func (bc *MemoryCache) Decr(name string, delta int64) (int64, error) {
+	return bc.Incr(name, -delta)
+}
+
+func (bc *MemoryCache) Add(name string, value interface{}, lifespan time.Duration) (bool, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	if itm, ok := bc.items[name]; ok && !itm.isExpire() {
+		return false, nil
+	}
+	bc.setItem(name, &MemoryItem{
+		val:         value,
+		createdTime: time.Now(),
+		lifespan:    lifespan,
+	})
+	return true, nil
+}
+
+func (bc *MemoryCache) CompareAndSwap(name string, old, new interface{}, lifespan time.Duration) (bool, error) {
+	bc.Lock()
+	defer bc.Unlock()
+	itm, ok := bc.items[name]
+	if !ok || itm.isExpire() || !valuesEqual(itm.val, old) {
+		return false, nil
+	}
+	bc.setItem(name, &MemoryItem{
+		val:         new,
+		createdTime: time.Now(),
+		lifespan:    lifespan,
+		tags:        itm.tags,
+	})
+	return true, nil
+}
+
+func (bc *MemoryCache) GetWithTTL(name string) (interface{}, time.Duration, error) {
+	bc.RLock()
+	defer bc.RUnlock()
+	itm, ok := bc.items[name]
+	if !ok || itm.isExpire() {
+		return nil, 0, nil
+	}
+	if itm.lifespan == 0 {
+		return itm.val, 0, nil
+	}
+	return itm.val, time.Until(itm.createdTime.Add(itm.lifespan)), nil
+}
+
+// Len returns the number of items held, expired ones included until they
+// are vacuumed.
+func (bc *MemoryCache) Len() int {
+	bc.RLock()
+	defer bc.RUnlock()
+	return len(bc.items)
+}
+
+// Bytes returns the summed cost of the items held. It is only tracked when
+// MaxBytes is set.
+func (bc *MemoryCache) Bytes() int64 {
+	bc.RLock()
+	defer bc.RUnlock()
+	return bc.bytes
+}
+
 func (bc *MemoryCache) Init(cfg interface{}) error {
 	var opts *MemoryOpts
 	if val, ok := cfg.(*MemoryOpts); !ok {
@@ -88,24 +260,196 @@ func (bc *MemoryCache) Init(cfg interface{}) error {
 	if opts.Interval == 0 {
 		opts.Interval = DefaultEvery
 	}
+	if opts.MaxEntries < 0 || opts.MaxBytes < 0 {
+		return errors.New("memory cache limits must not be negative")
+	}
 
 	dur := time.Duration(opts.Interval) * time.Second
+	bc.Lock()
 	bc.Every = opts.Interval
 	bc.dur = dur
-	go bc.vacuum()
+	bc.maxEntries = opts.MaxEntries
+	bc.maxBytes = opts.MaxBytes
+	bc.policy = nil
+	bc.cost = nil
+	if opts.MaxEntries > 0 || opts.MaxBytes > 0 {
+		bc.policy = opts.Policy
+		if bc.policy == nil {
+			bc.policy = NewLRUPolicy()
+		}
+		for key := range bc.items {
+			bc.policy.Add(key)
+		}
+	}
+	if opts.MaxBytes > 0 {
+		bc.cost = opts.Cost
+		if bc.cost == nil {
+			bc.cost = DefaultCost
+		}
+	}
+	bc.bytes = 0
+	for key, itm := range bc.items {
+		itm.cost = bc.itemCost(key, itm.val)
+		bc.bytes += itm.cost
+	}
+	bc.evict(0, 0)
+	bc.log = opts.ErrorLog
+	bc.snapshotPath = opts.SnapshotPath
+	if bc.snapshotStop != nil {
+		close(bc.snapshotStop)
+		bc.snapshotStop = nil
+	}
+	if bc.vacuumStop != nil {
+		close(bc.vacuumStop)
+	}
+	vacuumStop := make(chan struct{})
+	bc.vacuumStop = vacuumStop
+	bc.Unlock()
+
+	if opts.SnapshotPath != "" {
+		if n, err := bc.LoadSnapshot(opts.SnapshotPath); err != nil && !os.IsNotExist(err) {
+			bc.logf("cache: load snapshot %s: %v", opts.SnapshotPath, err)
+		} else if err == nil {
+			bc.logf("cache: loaded %d items from snapshot %s", n, opts.SnapshotPath)
+		}
+		if opts.SnapshotInterval > 0 {
+			stop := make(chan struct{})
+			bc.Lock()
+			bc.snapshotStop = stop
+			bc.Unlock()
+			go bc.snapshotLoop(opts.SnapshotPath, time.Duration(opts.SnapshotInterval)*time.Second, stop)
+		}
+	}
+	go bc.vacuum(vacuumStop)
 	return nil
 }
 
-func (bc *MemoryCache) vacuum() {
+func (bc *MemoryCache) logf(format string, args ...interface{}) {
+	if bc.log != nil {
+		bc.log.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// setItem stores itm under name, evicting other keys to make room for it. The
+// caller must hold the write lock.
+func (bc *MemoryCache) setItem(name string, itm *MemoryItem) {
+	itm.cost = bc.itemCost(name, itm.val)
+	if old, ok := bc.items[name]; ok {
+		bc.untag(name, old)
+		bc.items[name] = itm
+		bc.tag(name, itm)
+		bc.bytes += itm.cost - old.cost
+		if bc.policy != nil {
+			bc.policy.Access(name)
+		}
+		bc.evict(0, 0)
+		return
+	}
+	// Evicting before the insert keeps a frequency based policy from
+	// picking the new key, which has not been used yet.
+	bc.evict(1, itm.cost)
+	bc.items[name] = itm
+	bc.tag(name, itm)
+	bc.bytes += itm.cost
+	if bc.policy != nil {
+		bc.policy.Add(name)
+		bc.evict(0, 0)
+	}
+}
+
+// removeItem drops name from the items and the policy. The caller must hold
+// the write lock.
+func (bc *MemoryCache) removeItem(name string) {
+	itm, ok := bc.items[name]
+	if !ok {
+		return
+	}
+	delete(bc.items, name)
+	bc.untag(name, itm)
+	bc.bytes -= itm.cost
+	if bc.policy != nil {
+		bc.policy.Remove(name)
+	}
+}
+
+// tag indexes name under the tags of itm.
+func (bc *MemoryCache) tag(name string, itm *MemoryItem) {
+	if len(itm.tags) == 0 {
+		return
+	}
+	if bc.tags == nil {
+		bc.tags = make(map[string]map[string]struct{})
+	}
+	for _, t := range itm.tags {
+		keys, ok := bc.tags[t]
+		if !ok {
+			keys = make(map[string]struct{})
+			bc.tags[t] = keys
+		}
+		keys[name] = struct{}{}
+	}
+}
+
+// untag removes name from the index of the tags of itm.
+func (bc *MemoryCache) untag(name string, itm *MemoryItem) {
+	for _, t := range itm.tags {
+		if keys, ok := bc.tags[t]; ok {
+			delete(keys, name)
+			if len(keys) == 0 {
+				delete(bc.tags, t)
+			}
+		}
+	}
+}
+
+func (bc *MemoryCache) itemCost(name string, val interface{}) int64 {
+	if bc.cost == nil {
+		return 0
+	}
+	return bc.cost(name, val)
+}
+
+// evict removes policy victims until the cache plus entries more items of
+// bytes cost fits its limits. The caller must hold the write lock.
+func (bc *MemoryCache) evict(entries int, bytes int64) {
+	if bc.policy == nil {
+		return
+	}
+	for len(bc.items) > 0 &&
+		((bc.maxEntries > 0 && len(bc.items)+entries > bc.maxEntries) ||
+			(bc.maxBytes > 0 && bc.bytes+bytes > bc.maxBytes)) {
+		key, ok := bc.policy.Victim()
+		if !ok {
+			return
+		}
+		itm, ok := bc.items[key]
+		if !ok {
+			// The policy is out of sync, forget the key and move on.
+			bc.policy.Remove(key)
+			continue
+		}
+		bc.removeItem(key)
+		bc.notify(EventEvict, key, itm.val)
+	}
+}
+
+// vacuum drops expired items every bc.dur until stop is closed.
+func (bc *MemoryCache) vacuum(stop chan struct{}) {
 	bc.RLock()
-	every := bc.Every
+	every, dur := bc.Every, bc.dur
 	bc.RUnlock()
 
 	if every < 1 {
 		return
 	}
 	for {
-		<-time.After(bc.dur)
+		select {
+		case <-time.After(dur):
+		case <-stop:
+			return
+		}
 		if bc.items == nil {
 			return
 		}
@@ -130,7 +474,35 @@ func (bc *MemoryCache) clearItems(keys []string) {
 	bc.Lock()
 	defer bc.Unlock()
 	for _, key := range keys {
-		delete(bc.items, key)
+		// The key may have been set again since it was found expired.
+		if itm, ok := bc.items[key]; ok && itm.isExpire() {
+			bc.removeItem(key)
+			bc.notify(EventExpire, key, itm.val)
+		}
+	}
+}
+
+// SetEventHandler installs h to be told about evicted and expired items. h
+// runs with the cache locked and must not call back into the cache. Items
+// that expire are reported when the vacuum removes them.
+func (bc *MemoryCache) SetEventHandler(h func(Event)) {
+	bc.Lock()
+	defer bc.Unlock()
+	bc.onEvent = h
+}
+
+func (bc *MemoryCache) notify(kind EventKind, key string, val interface{}) {
+	if bc.onEvent != nil {
+		bc.onEvent(Event{Kind: kind, Key: key, Val: val})
+	}
+}
+
+// flush drops every item.
+func (bc *MemoryCache) flush() {
+	bc.Lock()
+	defer bc.Unlock()
+	for key := range bc.items {
+		bc.removeItem(key)
 	}
 }
 
@@ -141,6 +513,89 @@ func (mi *MemoryItem) isExpire() bool {
 	return time.Now().Sub(mi.createdTime) > mi.lifespan
 }
 
+// typedMemory implements TypedCache on top of MemoryCache. Values are stored
+// as they are, no codec is involved.
+type typedMemory[V any] struct {
+	bc *MemoryCache
+}
+
+// NewTypedMemoryCache returns a TypedCache sharing the items of bc.
+func NewTypedMemoryCache[V any](bc *MemoryCache) TypedCache[V] {
+	return &typedMemory[V]{bc: bc}
+}
+
+func (tm *typedMemory[V]) Get(ctx context.Context, key string) (val V, ok bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	v := tm.bc.Get(key)
+	if v == nil || IsNegative(v) {
+		return
+	}
+	if val, ok = v.(V); !ok {
+		err = typeError[V](key, v)
+	}
+	return
+}
+
+func (tm *typedMemory[V]) Set(ctx context.Context, key string, val V, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return tm.bc.Set(key, val, ttl)
+}
+
+func (tm *typedMemory[V]) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tm.bc.Lock()
+	tm.bc.removeItem(key)
+	tm.bc.Unlock()
+	return nil
+}
+
+func (tm *typedMemory[V]) GetMulti(ctx context.Context, keys []string) (map[string]V, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res := make(map[string]V, len(keys))
+	tm.bc.Lock()
+	defer tm.bc.Unlock()
+	for _, key := range keys {
+		itm, ok := tm.bc.items[key]
+		if !ok || itm.isExpire() || IsNegative(itm.val) {
+			continue
+		}
+		val, ok := itm.val.(V)
+		if !ok {
+			return nil, typeError[V](key, itm.val)
+		}
+		if tm.bc.policy != nil {
+			tm.bc.policy.Access(key)
+		}
+		res[key] = val
+	}
+	return res, nil
+}
+
+func (tm *typedMemory[V]) SetMulti(ctx context.Context, items map[string]V, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+	tm.bc.Lock()
+	defer tm.bc.Unlock()
+	for key, val := range items {
+		tm.bc.setItem(key, &MemoryItem{
+			val:         val,
+			createdTime: now,
+			lifespan:    ttl,
+		})
+	}
+	return nil
+}
+
 func init() {
 	Register("memory", NewMemoryCache())
 }
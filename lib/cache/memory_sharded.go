@@ -0,0 +1,277 @@
+package cache
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	DefaultShards      = 32
+	DefaultExpireBatch = 1000
+)
+
+type ShardedMemoryOpts struct {
+	// Interval is the expiry tick in seconds, defaults to DefaultEvery.
+	Interval int
+	// Shards is rounded up to a power of two, defaults to DefaultShards.
+	Shards int
+	// ExpireBatch caps the expired keys one shard drops per tick, defaults
+	// to DefaultExpireBatch.
+	ExpireBatch int
+}
+
+// ShardedMemoryCache is an in-memory cache split into hash partitioned
+// shards. Each shard has its own lock and expiry queue, so neither requests
+// nor the expiry pass ever lock the whole cache.
+type ShardedMemoryCache struct {
+	// the shards are built once, by Init or the first use
+	once   sync.Once
+	shards []*memoryShard
+	mask   uint64
+
+	mu      sync.RWMutex
+	inited  bool
+	stop    chan struct{}
+	onEvent func(Event)
+}
+
+type memoryShard struct {
+	sync.RWMutex
+	items   map[string]*shardItem
+	expires expiryHeap
+}
+
+// shardItem is a MemoryItem that knows its place in the shard's expiry
+// queue, index is -1 for items that never expire.
+type shardItem struct {
+	MemoryItem
+	key      string
+	deadline time.Time
+	index    int
+}
+
+type expiryHeap []*shardItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *expiryHeap) Push(x interface{}) {
+	itm := x.(*shardItem)
+	itm.index = len(*h)
+	*h = append(*h, itm)
+}
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	itm := old[len(old)-1]
+	old[len(old)-1] = nil
+	itm.index = -1
+	*h = old[:len(old)-1]
+	return itm
+}
+
+// NewShardedMemoryCache returns a cache usable before Init, with
+// DefaultShards shards then. Expired items are only dropped by the vacuum
+// Init starts.
+func NewShardedMemoryCache() Cache {
+	return &ShardedMemoryCache{}
+}
+
+// build makes the shards on the first call, n of them or DefaultShards
+// when n <= 0.
+func (sc *ShardedMemoryCache) build(n int) {
+	sc.once.Do(func() {
+		if n <= 0 {
+			n = DefaultShards
+		}
+		sc.shards, sc.mask = newShards(n)
+	})
+}
+
+// newShards returns n shards rounded up to a power of two, and their mask.
+func newShards(n int) ([]*memoryShard, uint64) {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	shards := make([]*memoryShard, size)
+	for i := range shards {
+		shards[i] = &memoryShard{items: make(map[string]*shardItem)}
+	}
+	return shards, uint64(size - 1)
+}
+
+func (sc *ShardedMemoryCache) shard(key string) *memoryShard {
+	sc.build(0)
+	return sc.shards[hashKey(key)&sc.mask]
+}
+
+func (sc *ShardedMemoryCache) Get(name string) interface{} {
+	s := sc.shard(name)
+	s.RLock()
+	defer s.RUnlock()
+	if itm, ok := s.items[name]; ok && !itm.isExpire() {
+		return itm.val
+	}
+	return nil
+}
+
+func (sc *ShardedMemoryCache) Set(name string, value interface{}, lifespan time.Duration) error {
+	now := time.Now()
+	s := sc.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	itm, ok := s.items[name]
+	if !ok {
+		itm = &shardItem{key: name, index: -1}
+		s.items[name] = itm
+	}
+	itm.MemoryItem = MemoryItem{
+		val:         value,
+		createdTime: now,
+		lifespan:    lifespan,
+	}
+	itm.deadline = now.Add(lifespan)
+	switch {
+	case lifespan == 0 && itm.index >= 0:
+		heap.Remove(&s.expires, itm.index)
+	case lifespan != 0 && itm.index >= 0:
+		heap.Fix(&s.expires, itm.index)
+	case lifespan != 0:
+		heap.Push(&s.expires, itm)
+	}
+	return nil
+}
+
+func (sc *ShardedMemoryCache) Delete(name string) error {
+	s := sc.shard(name)
+	s.Lock()
+	defer s.Unlock()
+	itm, ok := s.items[name]
+	if !ok {
+		return errors.New("key not exist")
+	}
+	if itm.index >= 0 {
+		heap.Remove(&s.expires, itm.index)
+	}
+	delete(s.items, name)
+	return nil
+}
+
+func (sc *ShardedMemoryCache) IsExist(name string) bool {
+	s := sc.shard(name)
+	s.RLock()
+	defer s.RUnlock()
+	if itm, ok := s.items[name]; ok {
+		return !itm.isExpire()
+	}
+	return false
+}
+
+// Len returns the number of items held across all shards.
+func (sc *ShardedMemoryCache) Len() int {
+	sc.build(0)
+	n := 0
+	for _, s := range sc.shards {
+		s.RLock()
+		n += len(s.items)
+		s.RUnlock()
+	}
+	return n
+}
+
+func (sc *ShardedMemoryCache) Init(cfg interface{}) error {
+	var opts *ShardedMemoryOpts
+	if val, ok := cfg.(*ShardedMemoryOpts); !ok {
+		return errors.New("interface not type ShardedMemoryOpts")
+	} else {
+		opts = val
+	}
+
+	if opts.Interval == 0 {
+		opts.Interval = DefaultEvery
+	}
+	if opts.Shards <= 0 {
+		opts.Shards = DefaultShards
+	}
+	if opts.ExpireBatch <= 0 {
+		opts.ExpireBatch = DefaultExpireBatch
+	}
+	// Get and Set run on the shards without a cache wide lock, so they
+	// are never replaced: the shard count of a cache used before Init stays
+	// DefaultShards and a second Init fails.
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.inited {
+		return errors.New("cache: sharded memory cache already initialised")
+	}
+	sc.inited = true
+	sc.build(opts.Shards)
+	if opts.Interval > 0 {
+		sc.stop = make(chan struct{})
+		go sc.vacuum(time.Duration(opts.Interval)*time.Second, opts.ExpireBatch, sc.stop)
+	}
+	return nil
+}
+
+// Close stops the vacuum.
+func (sc *ShardedMemoryCache) Close() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.stop != nil {
+		close(sc.stop)
+		sc.stop = nil
+	}
+	return nil
+}
+
+// vacuum expires the shards one after another, holding one shard lock at a
+// time and for at most one batch of keys.
+func (sc *ShardedMemoryCache) vacuum(dur time.Duration, batch int, stop chan struct{}) {
+	ticker := time.NewTicker(dur)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sc.mu.RLock()
+			h := sc.onEvent
+			sc.mu.RUnlock()
+			for _, s := range sc.shards {
+				s.expire(time.Now(), batch, h)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// SetEventHandler installs h to be told about expired items. h runs with a
+// shard locked and must not call back into the cache.
+func (sc *ShardedMemoryCache) SetEventHandler(h func(Event)) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.onEvent = h
+}
+
+// expire drops up to batch items whose deadline has passed, reporting them
+// to h when it is not nil.
+func (s *memoryShard) expire(now time.Time, batch int, h func(Event)) {
+	s.Lock()
+	defer s.Unlock()
+	for i := 0; i < batch && len(s.expires) > 0 && !s.expires[0].deadline.After(now); i++ {
+		itm := heap.Pop(&s.expires).(*shardItem)
+		delete(s.items, itm.key)
+		if h != nil {
+			h(Event{Kind: EventExpire, Key: itm.key, Val: itm.val})
+		}
+	}
+}
+
+func init() {
+	Register("memory-sharded", NewShardedMemoryCache())
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestSharded(t testing.TB, opts *ShardedMemoryOpts) *ShardedMemoryCache {
+	sc := NewShardedMemoryCache().(*ShardedMemoryCache)
+	if err := sc.Init(opts); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sc.Close() })
+	return sc
+}
+
+func TestShardedMemoryCache(t *testing.T) {
+	sc := newTestSharded(t, &ShardedMemoryOpts{Shards: 5})
+	if len(sc.shards) != 8 {
+		t.Fatalf("shards = %d, want 8", len(sc.shards))
+	}
+	for i := 0; i < 100; i++ {
+		sc.Set(strconv.Itoa(i), i, 0)
+	}
+	if sc.Len() != 100 {
+		t.Fatalf("Len = %d", sc.Len())
+	}
+	if v := sc.Get("42"); v != 42 {
+		t.Fatalf("Get = %v", v)
+	}
+	if err := sc.Delete("42"); err != nil || sc.IsExist("42") {
+		t.Fatalf("Delete = %v, exist = %v", err, sc.IsExist("42"))
+	}
+	if sc.Delete("42") == nil {
+		t.Fatal("Delete of a missing key should fail")
+	}
+}
+
+func TestShardedMemoryCacheBeforeInit(t *testing.T) {
+	sc := NewShardedMemoryCache().(*ShardedMemoryCache)
+	sc.Set("k", 1, time.Minute)
+	if v := sc.Get("k"); v != 1 || sc.Len() != 1 {
+		t.Fatalf("Get before Init = %v, Len = %d", v, sc.Len())
+	}
+	// Init keeps the shards, and what they hold, of a cache in use
+	if err := sc.Init(&ShardedMemoryOpts{Shards: 4}); err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	if v := sc.Get("k"); v != 1 || len(sc.shards) != DefaultShards {
+		t.Fatalf("Get after Init = %v, %d shards", v, len(sc.shards))
+	}
+	if err := sc.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardedMemoryCacheInitOnce(t *testing.T) {
+	sc := NewShardedMemoryCache().(*ShardedMemoryCache)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			sc.Set(strconv.Itoa(i), i, 0)
+			sc.Get(strconv.Itoa(i))
+		}
+	}()
+	if err := sc.Init(&ShardedMemoryOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	if err := sc.Init(&ShardedMemoryOpts{}); err == nil {
+		t.Fatal("second Init succeeded")
+	}
+	<-done
+	if n := sc.Len(); n != 1000 {
+		t.Fatalf("Len = %d, want 1000", n)
+	}
+}
+
+func TestShardedMemoryCacheExpire(t *testing.T) {
+	sc := newTestSharded(t, &ShardedMemoryOpts{Interval: -1, Shards: 1, ExpireBatch: 2})
+	for i := 0; i < 4; i++ {
+		sc.Set(strconv.Itoa(i), i, time.Millisecond)
+	}
+	sc.Set("0", 0, 0) // reset without ttl, leaves the expiry queue
+	time.Sleep(5 * time.Millisecond)
+
+	if sc.Get("1") != nil {
+		t.Fatal("expired key still readable")
+	}
+	s := sc.shards[0]
+	s.expire(time.Now(), 2, nil)
+	if n := sc.Len(); n != 2 {
+		t.Fatalf("Len after one batch = %d, want 2", n)
+	}
+	s.expire(time.Now(), 2, nil)
+	if n := sc.Len(); n != 1 || !sc.IsExist("0") {
+		t.Fatalf("Len = %d, exist(0) = %v", n, sc.IsExist("0"))
+	}
+}
+
+func benchmarkCache(b *testing.B, c Cache) {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+		c.Set(keys[i], i, time.Minute)
+	}
+	var n uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(atomic.AddUint64(&n, 1)) * 7919
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%10 == 0 {
+				c.Set(key, i, time.Minute)
+			} else {
+				c.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMemoryCache(b *testing.B) {
+	benchmarkCache(b, newTestMemory(b))
+}
+
+func BenchmarkShardedMemoryCache(b *testing.B) {
+	benchmarkCache(b, newTestSharded(b, &ShardedMemoryOpts{}))
+}
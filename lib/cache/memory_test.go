@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func newBoundedMemory(t testing.TB, opts *MemoryOpts) *MemoryCache {
+	bc := NewMemoryCache().(*MemoryCache)
+	if err := bc.Init(opts); err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+func TestMemoryCacheMaxEntriesLRU(t *testing.T) {
+	bc := newBoundedMemory(t, &MemoryOpts{MaxEntries: 3})
+	for _, k := range []string{"a", "b", "c"} {
+		bc.Set(k, k, 0)
+	}
+	bc.Get("a")
+	bc.Set("d", "d", 0)
+
+	if bc.Len() != 3 {
+		t.Fatalf("Len = %d, want 3", bc.Len())
+	}
+	if bc.IsExist("b") {
+		t.Fatal("b should have been evicted as least recently used")
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if !bc.IsExist(k) {
+			t.Fatalf("%s was evicted", k)
+		}
+	}
+}
+
+func TestMemoryCacheMaxEntriesLFU(t *testing.T) {
+	bc := newBoundedMemory(t, &MemoryOpts{MaxEntries: 2, Policy: NewLFUPolicy()})
+	bc.Set("a", 1, 0)
+	bc.Set("b", 2, 0)
+	bc.Get("a")
+	bc.Get("a")
+	bc.Get("b")
+	bc.Set("c", 3, 0)
+
+	if bc.IsExist("b") || !bc.IsExist("a") || !bc.IsExist("c") {
+		t.Fatal("LFU should have evicted b")
+	}
+}
+
+func TestMemoryCacheMaxBytes(t *testing.T) {
+	bc := newBoundedMemory(t, &MemoryOpts{MaxBytes: 10})
+	bc.Set("a", "1234", 0) // cost 5
+	bc.Set("b", "1234", 0) // cost 5
+	if bc.Bytes() != 10 {
+		t.Fatalf("Bytes = %d, want 10", bc.Bytes())
+	}
+	bc.Set("a", "12345678", 0) // cost 9, b has to go
+	if bc.IsExist("b") || !bc.IsExist("a") || bc.Bytes() != 9 {
+		t.Fatalf("after overwrite: b=%v a=%v bytes=%d", bc.IsExist("b"), bc.IsExist("a"), bc.Bytes())
+	}
+	bc.Delete("a")
+	if bc.Bytes() != 0 {
+		t.Fatalf("Bytes after Delete = %d", bc.Bytes())
+	}
+}
+
+func TestMemoryCacheCustomCost(t *testing.T) {
+	cost := func(key string, val interface{}) int64 { return int64(val.(int)) }
+	bc := newBoundedMemory(t, &MemoryOpts{MaxBytes: 100, Cost: cost})
+	bc.Set("small", 10, 0)
+	bc.Set("big", 95, 0)
+	if bc.IsExist("small") || bc.Bytes() != 95 {
+		t.Fatalf("small=%v bytes=%d", bc.IsExist("small"), bc.Bytes())
+	}
+}
+
+func TestMemoryCacheTinyLFUKeepsHotKeys(t *testing.T) {
+	const size = 100
+	bc := newBoundedMemory(t, &MemoryOpts{MaxEntries: size, Policy: NewTinyLFUPolicy(size)})
+	for i := 0; i < size; i++ {
+		key := fmt.Sprintf("hot%d", i)
+		bc.Set(key, i, 0)
+		for j := 0; j < 5; j++ {
+			bc.Get(key)
+		}
+	}
+	// A scan of one-hit keys must not flush the hot set.
+	for i := 0; i < 10*size; i++ {
+		bc.Set(fmt.Sprintf("scan%d", i), i, 0)
+	}
+	if bc.Len() != size {
+		t.Fatalf("Len = %d, want %d", bc.Len(), size)
+	}
+	hot := 0
+	for i := 0; i < size; i++ {
+		if bc.IsExist(fmt.Sprintf("hot%d", i)) {
+			hot++
+		}
+	}
+	if hot < size*8/10 {
+		t.Fatalf("only %d of %d hot keys survived the scan", hot, size)
+	}
+}
+
+func TestMemoryCacheTags(t *testing.T) {
+	bc := newTestMemory(t)
+	bc.SetWithTags("user:1", 1, 0, "user", "org:1")
+	bc.SetWithTags("user:2", 2, 0, "user", "org:2")
+	bc.SetWithTags("org:1", "o", 0, "org:1")
+	bc.Set("plain", 0, 0)
+
+	bc.InvalidateTag("org:1")
+	if bc.IsExist("user:1") || bc.IsExist("org:1") {
+		t.Fatal("keys tagged org:1 survived InvalidateTag")
+	}
+	if !bc.IsExist("user:2") || !bc.IsExist("plain") {
+		t.Fatal("InvalidateTag removed untagged keys")
+	}
+
+	// Overwriting without tags drops the key from its old tags.
+	bc.Set("user:2", 2, 0)
+	bc.InvalidateTag("user")
+	if !bc.IsExist("user:2") {
+		t.Fatal("user:2 was invalidated through a tag it no longer has")
+	}
+	if len(bc.tags) != 0 {
+		t.Fatalf("tag index not cleaned up: %v", bc.tags)
+	}
+}
+
+func TestMemoryCacheNegative(t *testing.T) {
+	bc := newTestMemory(t)
+	bc.SetNegative("missing", DefaultNegativeTTL)
+	if v := bc.Get("missing"); !IsNegative(v) {
+		t.Fatalf("Get = %v, want Negative", v)
+	}
+	if _, ok, err := NewTypedMemoryCache[int](bc).Get(context.Background(), "missing"); ok || err != nil {
+		t.Fatalf("typed Get of a negative entry = %v, %v", ok, err)
+	}
+}
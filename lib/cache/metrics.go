@@ -0,0 +1,319 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind tells why an adapter dropped a key on its own.
+type EventKind int
+
+const (
+	EventEvict EventKind = iota
+	EventExpire
+)
+
+// Event reports a key an adapter dropped on its own.
+type Event struct {
+	Kind EventKind
+	Key  string
+	Val  interface{}
+}
+
+// EventNotifier is implemented by adapters that evict or expire keys by
+// themselves, like the memory adapters.
+type EventNotifier interface {
+	SetEventHandler(h func(Event))
+}
+
+// ErrorGetter is implemented by adapters whose Get can tell a miss, reported
+// as nil with a nil error, apart from a failing backend.
+type ErrorGetter interface {
+	GetWithError(key string) (interface{}, error)
+}
+
+// LatencyBuckets are the upper bounds, in seconds, of the latency
+// histograms.
+var LatencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// Histogram is a latency histogram snapshot. Counts are cumulative: Counts[i]
+// is the number of calls that took at most Buckets[i] seconds.
+type Histogram struct {
+	Buckets []float64
+	Counts  []uint64
+	Count   uint64
+	Sum     float64 // seconds
+}
+
+// Stats is a snapshot of the counters of one adapter name.
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Sets        uint64
+	Deletes     uint64
+	Errors      uint64
+	Evictions   uint64
+	Expirations uint64
+	// Latency is keyed by operation: "get", "set", "delete" and "exist".
+	Latency map[string]Histogram
+}
+
+// HitRatio returns hits / (hits + misses), 0 before the first Get.
+func (s Stats) HitRatio() float64 {
+	if total := s.Hits + s.Misses; total > 0 {
+		return float64(s.Hits) / float64(total)
+	}
+	return 0
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, plus one for +Inf
+	sum    uint64   // nanoseconds
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(LatencyBuckets)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.SearchFloat64s(LatencyBuckets, d.Seconds())
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Buckets: append([]float64(nil), LatencyBuckets...),
+		Counts:  make([]uint64, len(LatencyBuckets)),
+		Sum:     time.Duration(atomic.LoadUint64(&h.sum)).Seconds(),
+	}
+	for i := range h.counts {
+		s.Count += atomic.LoadUint64(&h.counts[i])
+		if i < len(s.Counts) {
+			s.Counts[i] = s.Count
+		}
+	}
+	return s
+}
+
+var latencyOps = []string{"get", "set", "delete", "exist"}
+
+type cacheStats struct {
+	hits, misses, sets, deletes, errors, evictions, expirations uint64
+	latency                                                     map[string]*histogram
+}
+
+func (cs *cacheStats) snapshot() Stats {
+	s := Stats{
+		Hits:        atomic.LoadUint64(&cs.hits),
+		Misses:      atomic.LoadUint64(&cs.misses),
+		Sets:        atomic.LoadUint64(&cs.sets),
+		Deletes:     atomic.LoadUint64(&cs.deletes),
+		Errors:      atomic.LoadUint64(&cs.errors),
+		Evictions:   atomic.LoadUint64(&cs.evictions),
+		Expirations: atomic.LoadUint64(&cs.expirations),
+		Latency:     make(map[string]Histogram, len(cs.latency)),
+	}
+	for op, h := range cs.latency {
+		s.Latency[op] = h.snapshot()
+	}
+	return s
+}
+
+func (cs *cacheStats) reset() {
+	for _, c := range []*uint64{&cs.hits, &cs.misses, &cs.sets, &cs.deletes, &cs.errors, &cs.evictions, &cs.expirations} {
+		atomic.StoreUint64(c, 0)
+	}
+	for _, h := range cs.latency {
+		for i := range h.counts {
+			atomic.StoreUint64(&h.counts[i], 0)
+		}
+		atomic.StoreUint64(&h.sum, 0)
+	}
+}
+
+var (
+	statsMu sync.Mutex
+	stats   = make(map[string]*cacheStats)
+)
+
+// statsFor returns the counters of name, creating them on first use.
+func statsFor(name string) *cacheStats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if cs, ok := stats[name]; ok {
+		return cs
+	}
+	cs := &cacheStats{latency: make(map[string]*histogram, len(latencyOps))}
+	for _, op := range latencyOps {
+		cs.latency[op] = newHistogram()
+	}
+	stats[name] = cs
+	return cs
+}
+
+// AllStats returns a snapshot of every instrumented adapter name.
+func AllStats() map[string]Stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	res := make(map[string]Stats, len(stats))
+	for name, cs := range stats {
+		res[name] = cs.snapshot()
+	}
+	return res
+}
+
+// ResetStats zeroes the counters of name, those of the caches wrapped
+// under it included.
+func ResetStats(name string) {
+	statsMu.Lock()
+	cs, ok := stats[name]
+	statsMu.Unlock()
+	if ok {
+		cs.reset()
+	}
+}
+
+// InstrumentedCache wraps a Cache and counts its operations under a name.
+// Wrappers sharing a name share their counters.
+type InstrumentedCache struct {
+	c     Cache
+	name  string
+	stats *cacheStats
+
+	mu       sync.RWMutex
+	onEvict  func(key string, val interface{})
+	onExpire func(key string, val interface{})
+}
+
+// NewInstrumentedCache wraps c, counting under name. When c is an
+// EventNotifier its evictions and expirations are counted too, replacing
+// any event handler installed on it before.
+func NewInstrumentedCache(name string, c Cache) *InstrumentedCache {
+	ic := &InstrumentedCache{c: c, name: name, stats: statsFor(name)}
+	if n, ok := c.(EventNotifier); ok {
+		n.SetEventHandler(ic.handleEvent)
+	}
+	return ic
+}
+
+// Unwrap returns the wrapped Cache.
+func (ic *InstrumentedCache) Unwrap() Cache {
+	return ic.c
+}
+
+// Stats returns a snapshot of the counters of the name of ic.
+func (ic *InstrumentedCache) Stats() Stats {
+	return ic.stats.snapshot()
+}
+
+// OnEvict installs fn to be called for every evicted key. It runs with the
+// wrapped adapter locked and must not call back into the cache.
+func (ic *InstrumentedCache) OnEvict(fn func(key string, val interface{})) {
+	ic.mu.Lock()
+	ic.onEvict = fn
+	ic.mu.Unlock()
+}
+
+// OnExpire installs fn to be called for every key removed on expiry. It
+// runs with the wrapped adapter locked and must not call back into the cache.
+func (ic *InstrumentedCache) OnExpire(fn func(key string, val interface{})) {
+	ic.mu.Lock()
+	ic.onExpire = fn
+	ic.mu.Unlock()
+}
+
+func (ic *InstrumentedCache) handleEvent(ev Event) {
+	ic.mu.RLock()
+	onEvict, onExpire := ic.onEvict, ic.onExpire
+	ic.mu.RUnlock()
+	switch ev.Kind {
+	case EventEvict:
+		atomic.AddUint64(&ic.stats.evictions, 1)
+		if onEvict != nil {
+			onEvict(ev.Key, ev.Val)
+		}
+	case EventExpire:
+		atomic.AddUint64(&ic.stats.expirations, 1)
+		if onExpire != nil {
+			onExpire(ev.Key, ev.Val)
+		}
+	}
+}
+
+func (ic *InstrumentedCache) observe(op string, start time.Time) {
+	ic.stats.latency[op].observe(time.Since(start))
+}
+
+func (ic *InstrumentedCache) countErr(err error) {
+	if err != nil {
+		atomic.AddUint64(&ic.stats.errors, 1)
+	}
+}
+
+// Get counts a hit or a miss. Errors are counted when the adapter is an
+// ErrorGetter, or returns them in place of the value.
+func (ic *InstrumentedCache) Get(key string) interface{} {
+	v, _ := ic.GetWithError(key)
+	return v
+}
+
+// GetWithError is Get reporting failures, when the wrapped adapter can.
+func (ic *InstrumentedCache) GetWithError(key string) (interface{}, error) {
+	start := time.Now()
+	var (
+		v   interface{}
+		err error
+	)
+	if eg, ok := ic.c.(ErrorGetter); ok {
+		v, err = eg.GetWithError(key)
+	} else {
+		v = ic.c.Get(key)
+		if e, isErr := v.(error); isErr {
+			v, err = nil, e
+		}
+	}
+	ic.observe("get", start)
+	switch {
+	case err != nil:
+		ic.countErr(err)
+	case v == nil:
+		atomic.AddUint64(&ic.stats.misses, 1)
+	default:
+		atomic.AddUint64(&ic.stats.hits, 1)
+	}
+	return v, err
+}
+
+func (ic *InstrumentedCache) Set(key string, val interface{}, timeout time.Duration) error {
+	start := time.Now()
+	err := ic.c.Set(key, val, timeout)
+	ic.observe("set", start)
+	atomic.AddUint64(&ic.stats.sets, 1)
+	ic.countErr(err)
+	return err
+}
+
+func (ic *InstrumentedCache) Delete(key string) error {
+	start := time.Now()
+	err := ic.c.Delete(key)
+	ic.observe("delete", start)
+	atomic.AddUint64(&ic.stats.deletes, 1)
+	ic.countErr(err)
+	return err
+}
+
+func (ic *InstrumentedCache) IsExist(key string) bool {
+	start := time.Now()
+	ok := ic.c.IsExist(key)
+	ic.observe("exist", start)
+	return ok
+}
+
+func (ic *InstrumentedCache) Init(cfg interface{}) error {
+	err := ic.c.Init(cfg)
+	ic.countErr(err)
+	return err
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInstrumentedCache(t *testing.T) {
+	bc := NewMemoryCache().(*MemoryCache)
+	if err := bc.Init(&MemoryOpts{MaxEntries: 1}); err != nil {
+		t.Fatal(err)
+	}
+	ResetStats("test-memory")
+	ic := NewInstrumentedCache("test-memory", bc)
+	var evicted []string
+	ic.OnEvict(func(key string, val interface{}) {
+		evicted = append(evicted, key)
+	})
+
+	ic.Set("a", 1, time.Minute)
+	ic.Get("a")
+	ic.Get("missing")
+	ic.Set("b", 2, time.Minute)
+	ic.Delete("b")
+
+	s := ic.Stats()
+	if s.Hits != 1 || s.Misses != 1 || s.Sets != 2 || s.Deletes != 1 || s.Evictions != 1 {
+		t.Fatalf("stats = %+v", s)
+	}
+	if s.HitRatio() != 0.5 {
+		t.Fatalf("HitRatio = %v", s.HitRatio())
+	}
+	if len(evicted) != 1 || evicted[0] != "a" {
+		t.Fatalf("OnEvict saw %v", evicted)
+	}
+	if h := s.Latency["get"]; h.Count != 2 || h.Counts[len(h.Counts)-1] > h.Count {
+		t.Fatalf("get latency = %+v", h)
+	}
+	if _, ok := AllStats()["test-memory"]; !ok {
+		t.Fatal("AllStats misses test-memory")
+	}
+}
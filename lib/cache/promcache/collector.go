@@ -0,0 +1,75 @@
+// Package promcache exports the lib/cache instrumentation counters to
+// Prometheus.
+package promcache
+
+import (
+	"github.com/fromiuan/goutils/lib/cache"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector reports cache.AllStats on every scrape.
+type Collector struct {
+	hits        *prometheus.Desc
+	misses      *prometheus.Desc
+	sets        *prometheus.Desc
+	deletes     *prometheus.Desc
+	errors      *prometheus.Desc
+	evictions   *prometheus.Desc
+	expirations *prometheus.Desc
+	latency     *prometheus.Desc
+}
+
+// NewCollector returns a Collector whose metric names start with namespace,
+// "cache" when empty.
+func NewCollector(namespace string) *Collector {
+	if namespace == "" {
+		namespace = "cache"
+	}
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+	}
+	return &Collector{
+		hits:        desc("hits_total", "Cache reads that found the key.", "adapter"),
+		misses:      desc("misses_total", "Cache reads that did not find the key.", "adapter"),
+		sets:        desc("sets_total", "Cache writes.", "adapter"),
+		deletes:     desc("deletes_total", "Cache deletes.", "adapter"),
+		errors:      desc("errors_total", "Cache operations that failed.", "adapter"),
+		evictions:   desc("evictions_total", "Keys evicted to stay within the cache limits.", "adapter"),
+		expirations: desc("expirations_total", "Keys removed on expiry.", "adapter"),
+		latency:     desc("operation_duration_seconds", "Cache operation latency.", "adapter", "op"),
+	}
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.sets
+	ch <- c.deletes
+	ch <- c.errors
+	ch <- c.evictions
+	ch <- c.expirations
+	ch <- c.latency
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for name, s := range cache.AllStats() {
+		counter := func(desc *prometheus.Desc, v uint64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), name)
+		}
+		counter(c.hits, s.Hits)
+		counter(c.misses, s.Misses)
+		counter(c.sets, s.Sets)
+		counter(c.deletes, s.Deletes)
+		counter(c.errors, s.Errors)
+		counter(c.evictions, s.Evictions)
+		counter(c.expirations, s.Expirations)
+
+		for op, h := range s.Latency {
+			buckets := make(map[float64]uint64, len(h.Buckets))
+			for i, le := range h.Buckets {
+				buckets[le] = h.Counts[i]
+			}
+			ch <- prometheus.MustNewConstHistogram(c.latency, h.Count, h.Sum, buckets, name, op)
+		}
+	}
+}
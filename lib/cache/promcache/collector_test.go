@@ -0,0 +1,143 @@
+package promcache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fromiuan/goutils/lib/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// failingCache fails every operation.
+type failingCache struct{}
+
+var errDown = errors.New("backend down")
+
+func (failingCache) Get(key string) interface{} { return errDown }
+func (failingCache) Set(key string, val interface{}, timeout time.Duration) error {
+	return errDown
+}
+func (failingCache) Delete(key string) error    { return errDown }
+func (failingCache) IsExist(key string) bool    { return false }
+func (failingCache) Init(cfg interface{}) error { return nil }
+
+// gather scrapes a registry holding only a Collector and returns the
+// metrics of adapter by name.
+func gather(t *testing.T, adapter string) map[string]*dto.Metric {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(NewCollector("test")); err != nil {
+		t.Fatal(err)
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]*dto.Metric)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["adapter"] != adapter {
+				continue
+			}
+			name := f.GetName()
+			if op := labels["op"]; op != "" {
+				name += ":" + op
+			}
+			res[name] = m
+		}
+	}
+	return res
+}
+
+// delta returns how much the counter or histogram count name grew from
+// before to after.
+func delta(before, after map[string]*dto.Metric, name string) float64 {
+	value := func(m *dto.Metric) float64 {
+		if h := m.GetHistogram(); h != nil {
+			return float64(h.GetSampleCount())
+		}
+		return m.GetCounter().GetValue()
+	}
+	return value(after[name]) - value(before[name])
+}
+
+func TestCollectorGather(t *testing.T) {
+	bc := cache.NewMemoryCache().(*cache.MemoryCache)
+	if err := bc.Init(&cache.MemoryOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	ic := cache.NewInstrumentedCache("promcache-gather", bc)
+	before := gather(t, "promcache-gather")
+	ic.Set("a", 1, time.Minute)
+	ic.Get("a")
+	ic.Get("b")
+	ic.Delete("a")
+
+	m := gather(t, "promcache-gather")
+	for name, want := range map[string]float64{
+		"test_hits_total":    1,
+		"test_misses_total":  1,
+		"test_sets_total":    1,
+		"test_deletes_total": 1,
+		"test_errors_total":  0,
+	} {
+		if got := delta(before, m, name); got != want {
+			t.Errorf("%s grew by %v, want %v", name, got, want)
+		}
+	}
+	h := m["test_operation_duration_seconds:get"].GetHistogram()
+	if delta(before, m, "test_operation_duration_seconds:get") != 2 || len(h.GetBucket()) != len(cache.LatencyBuckets) {
+		t.Fatalf("get latency = %v", h)
+	}
+}
+
+func TestCollectorErrors(t *testing.T) {
+	ic := cache.NewInstrumentedCache("promcache-errors", failingCache{})
+	before := gather(t, "promcache-errors")
+	if _, err := ic.GetWithError("k"); err != errDown {
+		t.Fatalf("GetWithError = %v", err)
+	}
+	ic.Set("k", 1, 0)
+	ic.Delete("k")
+
+	m := gather(t, "promcache-errors")
+	if got := delta(before, m, "test_errors_total"); got != 3 {
+		t.Fatalf("errors_total grew by %v, want 3", got)
+	}
+	// a failed Get is neither a hit nor a miss
+	if delta(before, m, "test_hits_total") != 0 || delta(before, m, "test_misses_total") != 0 {
+		t.Fatalf("hits %v, misses %v", m["test_hits_total"], m["test_misses_total"])
+	}
+}
+
+func TestCollectorExpirations(t *testing.T) {
+	bc := cache.NewMemoryCache().(*cache.MemoryCache)
+	if err := bc.Init(&cache.MemoryOpts{Interval: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	ic := cache.NewInstrumentedCache("promcache-expire", bc)
+	before := gather(t, "promcache-expire")
+	expired := make(chan string, 1)
+	ic.OnExpire(func(key string, val interface{}) { expired <- key })
+
+	ic.Set("k", 1, 10*time.Millisecond)
+	select {
+	case key := <-expired:
+		if key != "k" {
+			t.Fatalf("OnExpire saw %q", key)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnExpire not called")
+	}
+	if got := delta(before, gather(t, "promcache-expire"), "test_expirations_total"); got != 1 {
+		t.Fatalf("expirations_total grew by %v", got)
+	}
+}
@@ -1,7 +1,11 @@
 package cache
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -9,7 +13,7 @@ import (
 
 //Redis redis cache
 type Redis struct {
-	conn *redis.Pool
+	conn redisPool
 }
 
 type RedisOpts struct {
@@ -19,6 +23,33 @@ type RedisOpts struct {
 	MaxIdle     int
 	MaxActive   int
 	IdleTimeout int32
+
+	// Username enables redis 6 ACL authentication.
+	Username string
+	// TLSConfig enables TLS when not nil.
+	TLSConfig *tls.Config
+	// ConnectTimeout bounds dialing, 0 means no limit.
+	ConnectTimeout time.Duration
+
+	// SentinelAddrs and MasterName make the adapter ask the sentinels for
+	// the current master of MasterName instead of dialing Host, and follow
+	// it across failovers. SentinelPassword authenticates to the sentinels.
+	SentinelAddrs    []string
+	MasterName       string
+	SentinelPassword string
+
+	// ClusterAddrs are seed nodes of a redis cluster. Commands are routed
+	// by key slot and follow MOVED and ASK redirects. Database is ignored,
+	// a cluster only has database 0.
+	ClusterAddrs []string
+}
+
+// redisPool hands out the adapter's connections. It is a *redis.Pool, or
+// the sentinel or cluster pool.
+type redisPool interface {
+	Get() redis.Conn
+	GetContext(ctx context.Context) (redis.Conn, error)
+	Close() error
 }
 
 func NewRedisCache() Cache {
@@ -30,13 +61,26 @@ func (r *Redis) SetConn(conn *redis.Pool) {
 }
 
 func (r *Redis) Get(key string) interface{} {
+	v, _ := r.GetWithError(key)
+	return v
+}
+
+// GetWithError is Get reporting failures, a miss is nil with a nil error.
+func (r *Redis) GetWithError(key string) (interface{}, error) {
 	conn := r.conn.Get()
 	defer conn.Close()
 
-	if v, err := redis.Bytes(conn.Do("GET", key)); err == nil {
-		return v
+	v, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
 	}
-	return nil
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(v, negativeMarker) {
+		return Negative, nil
+	}
+	return v, nil
 }
 
 func (r *Redis) Set(key string, val interface{}, timeout time.Duration) (err error) {
@@ -70,6 +114,203 @@ func (r *Redis) IsExist(key string) bool {
 	return false
 }
 
+// negativeMarker is the value stored for negative entries.
+var negativeMarker = []byte("\x00cache:negative")
+
+// SetNegative records that key does not exist, Get returns Negative for it
+// until timeout.
+func (r *Redis) SetNegative(key string, timeout time.Duration) error {
+	conn := r.conn.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", setArgs(key, negativeMarker, timeout)...)
+	return err
+}
+
+// SetWithTags sets key and adds it to the set of each tag in one MULTI.
+// The tag sets do not expire, they are dropped by InvalidateTag. On a
+// cluster the key and its tag sets live in different slots, so they are
+// written one after the other instead.
+func (r *Redis) SetWithTags(key string, val interface{}, timeout time.Duration, tags ...string) error {
+	conn := r.conn.Get()
+	defer conn.Close()
+
+	args := redis.Args{key, val}
+	if timeout > 0 {
+		args = args.Add("PX", ttlMillis(timeout))
+	}
+	if r.isCluster() {
+		if _, err := conn.Do("SET", args...); err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if _, err := conn.Do("SADD", r.tagKey(tag), key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	conn.Send("MULTI")
+	conn.Send("SET", args...)
+	for _, tag := range tags {
+		conn.Send("SADD", r.tagKey(tag), key)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// InvalidateTag deletes the keys of tag. The tag set is renamed first, so
+// keys tagged while the invalidation runs start a new set instead of being
+// lost.
+func (r *Redis) InvalidateTag(tag string) error {
+	conn := r.conn.Get()
+	defer conn.Close()
+
+	tmp := r.tagKey(tag) + ":invalidating:" + newNodeID()
+	if _, err := conn.Do("RENAME", r.tagKey(tag), tmp); err != nil {
+		if e, ok := err.(redis.Error); ok && strings.Contains(e.Error(), "no such key") {
+			return nil
+		}
+		return err
+	}
+	// SPOP removes the members it returns, so the set drains to nothing and
+	// redis drops it.
+	for {
+		keys, err := redis.Strings(conn.Do("SPOP", tmp, 500))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		for _, group := range r.keyGroups(keys) {
+			if _, err := conn.Do("DEL", redis.Args{}.AddFlat(group)...); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *Redis) isCluster() bool {
+	_, ok := r.conn.(*clusterPool)
+	return ok
+}
+
+// tagKey returns the set of tag. On a cluster the tag is a hash tag, so the
+// set and its renamed copy in InvalidateTag share a slot.
+func (r *Redis) tagKey(tag string) string {
+	if r.isCluster() {
+		return DefaultTagPrefix + "{" + tag + "}"
+	}
+	return DefaultTagPrefix + tag
+}
+
+// keyGroups splits keys for multi-key commands: on a cluster every group
+// is in one slot, otherwise keys is the only group.
+func (r *Redis) keyGroups(keys []string) [][]string {
+	if !r.isCluster() {
+		return [][]string{keys}
+	}
+	slots := make(map[int]int)
+	var groups [][]string
+	for _, key := range keys {
+		slot := keySlot(key)
+		i, ok := slots[slot]
+		if !ok {
+			i = len(groups)
+			slots[slot] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], key)
+	}
+	return groups
+}
+
+func (r *Redis) Incr(key string, delta int64) (int64, error) {
+	conn := r.conn.Get()
+	defer conn.Close()
+
+	return redis.Int64(conn.Do("INCRBY", key, delta))
+}
+
+func (r *Redis) Decr(key string, delta int64) (int64, error) {
+	conn := r.conn.Get()
+	defer conn.Close()
+
+	return redis.Int64(conn.Do("DECRBY", key, delta))
+}
+
+func (r *Redis) Add(key string, val interface{}, timeout time.Duration) (bool, error) {
+	conn := r.conn.Get()
+	defer conn.Close()
+
+	args := redis.Args{key, val}
+	if timeout > 0 {
+		args = args.Add("PX", ttlMillis(timeout))
+	}
+	_, err := redis.String(conn.Do("SET", args.Add("NX")...))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// casScript sets KEYS[1] to ARGV[2] with a ttl of ARGV[3] milliseconds, 0
+// for none, when it currently holds ARGV[1].
+var casScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+func (r *Redis) CompareAndSwap(key string, old, new interface{}, timeout time.Duration) (bool, error) {
+	conn := r.conn.Get()
+	defer conn.Close()
+
+	var ms int64
+	if timeout > 0 {
+		ms = ttlMillis(timeout)
+	}
+	return redis.Bool(casScript.Do(conn, key, old, new, ms))
+}
+
+func (r *Redis) GetWithTTL(key string) (interface{}, time.Duration, error) {
+	conn := r.conn.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("GET", key)
+	conn.Send("PTTL", key)
+	reply, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, 0, err
+	}
+	var (
+		val []byte
+		ms  int64
+	)
+	if _, err := redis.Scan(reply, &val, &ms); err != nil {
+		return nil, 0, err
+	}
+	if val == nil {
+		return nil, 0, nil
+	}
+	var ttl time.Duration
+	if ms > 0 {
+		ttl = time.Duration(ms) * time.Millisecond
+	}
+	if bytes.Equal(val, negativeMarker) {
+		return Negative, ttl, nil
+	}
+	return val, ttl, nil
+}
+
 func (r *Redis) Init(cfg interface{}) error {
 	var opts *RedisOpts
 	if val, ok := cfg.(*RedisOpts); !ok {
@@ -77,15 +318,48 @@ func (r *Redis) Init(cfg interface{}) error {
 	} else {
 		opts = val
 	}
-	pool := &redis.Pool{
+	switch {
+	case len(opts.ClusterAddrs) > 0:
+		r.conn = newClusterPool(opts)
+	case len(opts.SentinelAddrs) > 0:
+		if opts.MasterName == "" {
+			return errors.New("config has no master name")
+		}
+		r.conn = newSentinelPool(opts)
+	default:
+		r.conn = newRedisPool(opts, func() (string, error) { return opts.Host, nil }, opts.Database)
+	}
+	return nil
+}
+
+// dialOptions returns the options shared by every connection of opts.
+func (opts *RedisOpts) dialOptions() []redis.DialOption {
+	do := []redis.DialOption{
+		redis.DialPassword(opts.Password),
+		redis.DialUsername(opts.Username),
+	}
+	if opts.TLSConfig != nil {
+		do = append(do, redis.DialUseTLS(true), redis.DialTLSConfig(opts.TLSConfig))
+	}
+	if opts.ConnectTimeout > 0 {
+		do = append(do, redis.DialConnectTimeout(opts.ConnectTimeout))
+	}
+	return do
+}
+
+// newRedisPool returns a pool dialing the address addr returns at dial time.
+func newRedisPool(opts *RedisOpts, addr func() (string, error), db int) *redis.Pool {
+	dialOpts := append(opts.dialOptions(), redis.DialDatabase(db))
+	return &redis.Pool{
 		MaxActive:   opts.MaxActive,
 		MaxIdle:     opts.MaxIdle,
 		IdleTimeout: time.Second * time.Duration(opts.IdleTimeout),
 		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", opts.Host,
-				redis.DialDatabase(opts.Database),
-				redis.DialPassword(opts.Password),
-			)
+			host, err := addr()
+			if err != nil {
+				return nil, err
+			}
+			return redis.Dial("tcp", host, dialOpts...)
 		},
 		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
 			if time.Since(t) < time.Minute {
@@ -95,10 +369,145 @@ func (r *Redis) Init(cfg interface{}) error {
 			return err
 		},
 	}
-	r.conn = pool
+}
+
+// typedRedis implements TypedCache on top of the redis adapter, storing values
+// encoded with codec.
+type typedRedis[V any] struct {
+	r     *Redis
+	codec Codec
+}
+
+// NewTypedRedisCache returns a TypedCache sharing the pool of r. A nil codec
+// means DefaultCodec.
+func NewTypedRedisCache[V any](r *Redis, codec Codec) TypedCache[V] {
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	return &typedRedis[V]{r: r, codec: codec}
+}
+
+func (tr *typedRedis[V]) Get(ctx context.Context, key string) (val V, ok bool, err error) {
+	conn, err := tr.r.conn.GetContext(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	data, err := redis.Bytes(redis.DoContext(conn, ctx, "GET", key))
+	if err == redis.ErrNil || bytes.Equal(data, negativeMarker) {
+		return val, false, nil
+	}
+	if err != nil {
+		return
+	}
+	return decodeValue[V](tr.codec, key, data)
+}
+
+func (tr *typedRedis[V]) Set(ctx context.Context, key string, val V, ttl time.Duration) error {
+	data, err := tr.codec.Marshal(val)
+	if err != nil {
+		return err
+	}
+	conn, err := tr.r.conn.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = redis.DoContext(conn, ctx, "SET", setArgs(key, data, ttl)...)
+	return err
+}
+
+func (tr *typedRedis[V]) Delete(ctx context.Context, key string) error {
+	conn, err := tr.r.conn.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = redis.DoContext(conn, ctx, "DEL", key)
+	return err
+}
+
+func (tr *typedRedis[V]) GetMulti(ctx context.Context, keys []string) (map[string]V, error) {
+	res := make(map[string]V, len(keys))
+	if len(keys) == 0 {
+		return res, nil
+	}
+	conn, err := tr.r.conn.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	for _, group := range tr.r.keyGroups(keys) {
+		values, err := redis.ByteSlices(redis.DoContext(conn, ctx, "MGET", redis.Args{}.AddFlat(group)...))
+		if err != nil {
+			return nil, err
+		}
+		for i, data := range values {
+			if data == nil || bytes.Equal(data, negativeMarker) {
+				continue
+			}
+			val, _, err := decodeValue[V](tr.codec, group[i], data)
+			if err != nil {
+				return nil, err
+			}
+			res[group[i]] = val
+		}
+	}
+	return res, nil
+}
+
+func (tr *typedRedis[V]) SetMulti(ctx context.Context, items map[string]V, ttl time.Duration) error {
+	if len(items) == 0 {
+		return nil
+	}
+	conn, err := tr.r.conn.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for key, val := range items {
+		data, err := tr.codec.Marshal(val)
+		if err != nil {
+			return err
+		}
+		if err := conn.Send("SET", setArgs(key, data, ttl)...); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for range items {
+		if _, err := redis.ReceiveContext(conn, ctx); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// setArgs builds the arguments of a SET command, a ttl of zero or less means
+// the key never expires.
+func setArgs(key string, data []byte, ttl time.Duration) redis.Args {
+	args := redis.Args{key, data}
+	if ttl > 0 {
+		args = args.Add("PX", ttlMillis(ttl))
+	}
+	return args
+}
+
+// ttlMillis rounds ttl to milliseconds, keeping at least one.
+func ttlMillis(ttl time.Duration) int64 {
+	if ms := int64(ttl / time.Millisecond); ms > 0 {
+		return ms
+	}
+	return 1
+}
+
 func init() {
 	Register("redis", NewRedisCache())
 }
@@ -0,0 +1,715 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	clusterSlots        = 16384
+	clusterMaxRedirects = 5
+)
+
+var errPoolClosed = errors.New("cache: redis pool closed")
+
+// clusterPool routes the commands of a redis cluster by key slot. The slot
+// table is loaded with CLUSTER SLOTS from the seed nodes, or any node known
+// since, and reloaded when a MOVED redirect or a failing node shows it is
+// out of date.
+type clusterPool struct {
+	opts  *RedisOpts
+	seeds []string
+
+	mu      sync.RWMutex
+	slots   [clusterSlots]string
+	masters []string
+	nodes   map[string]*redis.Pool
+	closed  bool
+
+	refreshMu  sync.Mutex
+	refreshing int32
+}
+
+func newClusterPool(opts *RedisOpts) *clusterPool {
+	return &clusterPool{
+		opts:  opts,
+		seeds: append([]string(nil), opts.ClusterAddrs...),
+		nodes: make(map[string]*redis.Pool),
+	}
+}
+
+func (cp *clusterPool) Get() redis.Conn {
+	conn, err := cp.GetContext(context.Background())
+	if err != nil {
+		return &clusterConn{err: err}
+	}
+	return conn
+}
+
+// GetContext returns a connection to the whole cluster. Node connections
+// are taken from their pools as commands need them.
+func (cp *clusterPool) GetContext(ctx context.Context) (redis.Conn, error) {
+	cp.mu.RLock()
+	closed := cp.closed
+	cp.mu.RUnlock()
+	if closed {
+		return nil, errPoolClosed
+	}
+	return &clusterConn{pool: cp, ctx: ctx, conns: make(map[string]redis.Conn)}, nil
+}
+
+func (cp *clusterPool) Close() error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.closed = true
+	var err error
+	for addr, p := range cp.nodes {
+		if e := p.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(cp.nodes, addr)
+	}
+	return err
+}
+
+// node returns the pool of the node at addr, creating it on first use.
+func (cp *clusterPool) node(addr string) (*redis.Pool, error) {
+	cp.mu.RLock()
+	p, ok := cp.nodes[addr]
+	closed := cp.closed
+	cp.mu.RUnlock()
+	if closed {
+		return nil, errPoolClosed
+	}
+	if ok {
+		return p, nil
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if p, ok = cp.nodes[addr]; !ok {
+		p = newRedisPool(cp.opts, func() (string, error) { return addr, nil }, 0)
+		cp.nodes[addr] = p
+	}
+	return p, nil
+}
+
+// addrFor returns the node serving key, any node for an empty key.
+func (cp *clusterPool) addrFor(key string) (string, error) {
+	if key == "" {
+		return cp.anyAddr(), nil
+	}
+	slot := keySlot(key)
+	cp.mu.RLock()
+	addr := cp.slots[slot]
+	cp.mu.RUnlock()
+	if addr != "" {
+		return addr, nil
+	}
+	if err := cp.refresh(); err != nil {
+		return "", err
+	}
+	cp.mu.RLock()
+	addr = cp.slots[slot]
+	cp.mu.RUnlock()
+	if addr == "" {
+		return "", fmt.Errorf("cache: no cluster node serves slot %d", slot)
+	}
+	return addr, nil
+}
+
+func (cp *clusterPool) anyAddr() string {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	if len(cp.masters) > 0 {
+		return cp.masters[rand.Intn(len(cp.masters))]
+	}
+	if len(cp.seeds) > 0 {
+		return cp.seeds[0]
+	}
+	return ""
+}
+
+// moved records that slot is now served by addr and reloads the whole table
+// in the background, since a MOVED rarely comes alone.
+func (cp *clusterPool) moved(slot int, addr string) {
+	cp.mu.Lock()
+	cp.slots[slot] = addr
+	cp.mu.Unlock()
+	cp.refreshAsync()
+}
+
+func (cp *clusterPool) refreshAsync() {
+	if !atomic.CompareAndSwapInt32(&cp.refreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&cp.refreshing, 0)
+		cp.refresh()
+	}()
+}
+
+// refresh reloads the slot table from the first node that answers.
+func (cp *clusterPool) refresh() error {
+	cp.refreshMu.Lock()
+	defer cp.refreshMu.Unlock()
+
+	cp.mu.RLock()
+	candidates := append(append([]string(nil), cp.masters...), cp.seeds...)
+	cp.mu.RUnlock()
+
+	var errs []string
+	seen := make(map[string]bool, len(candidates))
+	for _, addr := range candidates {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		slots, masters, err := cp.loadSlots(addr)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+			continue
+		}
+		cp.mu.Lock()
+		cp.slots = *slots
+		cp.masters = masters
+		cp.mu.Unlock()
+		return nil
+	}
+	return errors.New("cache: cannot load cluster slots: " + strings.Join(errs, "; "))
+}
+
+func (cp *clusterPool) loadSlots(addr string) (*[clusterSlots]string, []string, error) {
+	p, err := cp.node(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn := p.Get()
+	reply, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	conn.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		slots   [clusterSlots]string
+		masters []string
+		seen    = make(map[string]bool)
+	)
+	for _, r := range reply {
+		rng, err := redis.Values(r, nil)
+		if err != nil || len(rng) < 3 {
+			return nil, nil, fmt.Errorf("bad CLUSTER SLOTS entry %v", r)
+		}
+		start, err1 := redis.Int(rng[0], nil)
+		end, err2 := redis.Int(rng[1], nil)
+		node, err3 := redis.Values(rng[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(node) < 2 || start < 0 || end >= clusterSlots {
+			return nil, nil, fmt.Errorf("bad CLUSTER SLOTS entry %v", r)
+		}
+		host, _ := redis.String(node[0], nil)
+		port, err := redis.Int(node[1], nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad CLUSTER SLOTS entry %v", r)
+		}
+		if host == "" {
+			// An empty host means the node we asked.
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		master := net.JoinHostPort(host, strconv.Itoa(port))
+		for s := start; s <= end; s++ {
+			slots[s] = master
+		}
+		if !seen[master] {
+			seen[master] = true
+			masters = append(masters, master)
+		}
+	}
+	return &slots, masters, nil
+}
+
+// keySlot returns the cluster slot of key, hashing only its hash tag, the
+// part between the first { and the next }, when it is not empty.
+func keySlot(key string) int {
+	if i := strings.IndexByte(key, '{'); i >= 0 {
+		if j := strings.IndexByte(key[i+1:], '}'); j > 0 {
+			key = key[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(key)) % clusterSlots
+}
+
+// crc16 is the CRC16-XMODEM checksum redis cluster hashes keys with.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keylessCommands do not take a key as first argument.
+var keylessCommands = map[string]bool{
+	"ASKING": true, "AUTH": true, "CLUSTER": true, "DISCARD": true,
+	"ECHO": true, "EXEC": true, "INFO": true, "MULTI": true, "PING": true,
+	"PSUBSCRIBE": true, "PUBLISH": true, "PUNSUBSCRIBE": true, "QUIT": true,
+	"SCRIPT": true, "SELECT": true, "SUBSCRIBE": true, "TIME": true,
+	"UNSUBSCRIBE": true, "UNWATCH": true,
+}
+
+// commandKey returns the key a command is routed by, "" when it has none.
+func commandKey(name string, args []interface{}) string {
+	switch {
+	case keylessCommands[name]:
+		return ""
+	case name == "EVAL" || name == "EVALSHA":
+		if len(args) > 2 {
+			if n, err := strconv.Atoi(argString(args[1])); err == nil && n > 0 {
+				return argString(args[2])
+			}
+		}
+		return ""
+	case name == "XREAD" || name == "XREADGROUP":
+		for i, a := range args {
+			if strings.EqualFold(argString(a), "STREAMS") && i+1 < len(args) {
+				return argString(args[i+1])
+			}
+		}
+		return ""
+	case len(args) > 0:
+		return argString(args[0])
+	}
+	return ""
+}
+
+func argString(a interface{}) string {
+	switch a := a.(type) {
+	case string:
+		return a
+	case []byte:
+		return string(a)
+	case redis.Argument:
+		return argString(a.RedisArg())
+	}
+	return fmt.Sprint(a)
+}
+
+// parseRedirect splits a "MOVED 3999 127.0.0.1:6381" or ASK error.
+func parseRedirect(err redis.Error) (kind string, slot int, addr string, ok bool) {
+	f := strings.Fields(string(err))
+	if len(f) != 3 || (f[0] != "MOVED" && f[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, e := strconv.Atoi(f[1])
+	if e != nil || slot < 0 || slot >= clusterSlots {
+		return "", 0, "", false
+	}
+	return f[0], slot, f[2], true
+}
+
+// connIO performs the reads of a clusterConn, plainly, with a context or
+// with a timeout.
+type connIO struct {
+	ctx  context.Context
+	do   func(c redis.Conn, cmd string, args ...interface{}) (interface{}, error)
+	recv func(c redis.Conn) (interface{}, error)
+}
+
+var plainIO = connIO{
+	do:   func(c redis.Conn, cmd string, args ...interface{}) (interface{}, error) { return c.Do(cmd, args...) },
+	recv: func(c redis.Conn) (interface{}, error) { return c.Receive() },
+}
+
+func contextIO(ctx context.Context) connIO {
+	return connIO{
+		ctx: ctx,
+		do: func(c redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+			return redis.DoContext(c, ctx, cmd, args...)
+		},
+		recv: func(c redis.Conn) (interface{}, error) { return redis.ReceiveContext(c, ctx) },
+	}
+}
+
+func timeoutIO(d time.Duration) connIO {
+	return connIO{
+		do: func(c redis.Conn, cmd string, args ...interface{}) (interface{}, error) {
+			return redis.DoWithTimeout(c, d, cmd, args...)
+		},
+		recv: func(c redis.Conn) (interface{}, error) { return redis.ReceiveWithTimeout(c, d) },
+	}
+}
+
+type clusterCommand struct {
+	name    string
+	args    []interface{}
+	discard bool // the reply was already given to the caller
+}
+
+type clusterReply struct {
+	conn    redis.Conn
+	discard bool
+}
+
+// clusterConn is a redis.Conn over a whole cluster.
+//
+// Do routes each command to the node serving its key and follows MOVED and
+// ASK redirects. Pipelined commands, sent with Send, go to the node of their
+// own key and their replies are received in order, but they are not
+// retried on redirects. A transaction, from MULTI or WATCH to EXEC, runs on
+// the node of its first key, so all its keys must be in one slot; use hash
+// tags like {user:1}.name and {user:1}.mail for that.
+type clusterConn struct {
+	pool *clusterPool
+	ctx  context.Context
+	err  error
+
+	conns    map[string]redis.Conn
+	last     redis.Conn
+	lastAddr string
+
+	queue []clusterReply   // replies still to receive, in order
+	held  []clusterCommand // keyless commands waiting for a node
+
+	inTx      bool
+	txAddr    string
+	watchAddr string
+}
+
+func (c *clusterConn) Close() error {
+	if c.err == nil {
+		c.err = errPoolClosed
+	}
+	var err error
+	for addr, conn := range c.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+		delete(c.conns, addr)
+	}
+	return err
+}
+
+func (c *clusterConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+	for _, conn := range c.conns {
+		if err := conn.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(plainIO, cmd, args)
+}
+
+func (c *clusterConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(contextIO(ctx), cmd, args)
+}
+
+func (c *clusterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.do(timeoutIO(timeout), cmd, args)
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	return c.send(clusterCommand{name: cmd, args: args})
+}
+
+func (c *clusterConn) Flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	if err := c.sendHeld(); err != nil {
+		return err
+	}
+	for _, conn := range c.conns {
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	return c.receive(plainIO)
+}
+
+func (c *clusterConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return c.receive(contextIO(ctx))
+}
+
+func (c *clusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return c.receive(timeoutIO(timeout))
+}
+
+// conn returns the connection to the node at addr.
+func (c *clusterConn) conn(ctx context.Context, addr string) (redis.Conn, error) {
+	if conn, ok := c.conns[addr]; ok {
+		if conn.Err() == nil {
+			return conn, nil
+		}
+		conn.Close()
+		delete(c.conns, addr)
+	}
+	p, err := c.pool.node(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ctx == nil {
+		ctx = c.ctx
+	}
+	conn, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+func (c *clusterConn) do(io connIO, cmd string, args []interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	name := strings.ToUpper(cmd)
+	if len(c.queue) > 0 || len(c.held) > 0 || c.inTx || name == "MULTI" {
+		return c.doPipelined(io, cmd, args)
+	}
+	if cmd == "" {
+		return nil, nil
+	}
+
+	key := commandKey(name, args)
+	addr, err := c.pool.addrFor(key)
+	if err != nil {
+		return nil, err
+	}
+	asking := false
+	for redirects := 0; ; redirects++ {
+		conn, err := c.conn(io.ctx, addr)
+		if err != nil {
+			// The node may be gone, retry where a fresh table says.
+			if redirects >= clusterMaxRedirects || key == "" || c.pool.refresh() != nil {
+				return nil, err
+			}
+			if addr, err = c.pool.addrFor(key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if asking {
+			if _, err := conn.Do("ASKING"); err != nil {
+				return nil, err
+			}
+			asking = false
+		}
+		reply, err := io.do(conn, cmd, args...)
+		if err == nil {
+			c.last, c.lastAddr = conn, addr
+			switch name {
+			case "WATCH":
+				c.watchAddr = addr
+			case "UNWATCH":
+				c.watchAddr = ""
+			}
+			return reply, nil
+		}
+
+		rerr, ok := err.(redis.Error)
+		if !ok {
+			// Not retried, the command may have run.
+			c.pool.refreshAsync()
+			return reply, err
+		}
+		if redirects >= clusterMaxRedirects {
+			return reply, err
+		}
+		kind, slot, to, isRedirect := parseRedirect(rerr)
+		switch {
+		case isRedirect && kind == "MOVED":
+			c.pool.moved(slot, to)
+			addr = to
+		case isRedirect && kind == "ASK":
+			addr, asking = to, true
+		case strings.HasPrefix(string(rerr), "TRYAGAIN"), strings.HasPrefix(string(rerr), "CLUSTERDOWN"):
+			time.Sleep(time.Duration(redirects+1) * 10 * time.Millisecond)
+		default:
+			return reply, err
+		}
+	}
+}
+
+// doPipelined sends cmd after the pending commands and receives every
+// reply. Like redigo, it returns the last reply and the first error reply,
+// or all the replies when cmd is "".
+func (c *clusterConn) doPipelined(io connIO, cmd string, args []interface{}) (interface{}, error) {
+	if cmd != "" {
+		if err := c.send(clusterCommand{name: cmd, args: args}); err != nil {
+			return nil, err
+		}
+		// A MULTI stays held until the first key of the transaction picks
+		// its node, answer it now and drop the real reply later.
+		if n := len(c.held); n > 0 && strings.EqualFold(cmd, "MULTI") {
+			c.held[n-1].discard = true
+			return "OK", nil
+		}
+	}
+	if err := c.Flush(); err != nil {
+		return nil, err
+	}
+
+	var (
+		replies []interface{}
+		first   error
+	)
+	for len(c.queue) > 0 {
+		r := c.queue[0]
+		c.queue = c.queue[1:]
+		reply, err := io.recv(r.conn)
+		if err != nil {
+			rerr, ok := err.(redis.Error)
+			if !ok {
+				return nil, err
+			}
+			reply = rerr
+			if first == nil && !r.discard {
+				first = rerr
+			}
+		}
+		if !r.discard {
+			replies = append(replies, reply)
+		}
+	}
+	if cmd == "" {
+		return replies, nil
+	}
+	if len(replies) == 0 {
+		return nil, first
+	}
+	return replies[len(replies)-1], first
+}
+
+func (c *clusterConn) send(cmd clusterCommand) error {
+	name := strings.ToUpper(cmd.name)
+	key := commandKey(name, cmd.args)
+	switch name {
+	case "MULTI":
+		c.inTx, c.txAddr = true, c.watchAddr
+	case "UNWATCH":
+		c.watchAddr = ""
+	}
+
+	var (
+		addr string
+		err  error
+	)
+	switch {
+	case c.inTx && c.txAddr != "":
+		addr = c.txAddr
+	case key != "":
+		if addr, err = c.pool.addrFor(key); err != nil {
+			return err
+		}
+	case !c.inTx:
+		addr = c.lastAddr
+	}
+
+	if addr == "" {
+		c.held = append(c.held, cmd)
+	} else {
+		if c.inTx {
+			c.txAddr = addr
+		}
+		if err := c.sendTo(addr, cmd); err != nil {
+			return err
+		}
+	}
+
+	switch name {
+	case "WATCH":
+		c.watchAddr = addr
+	case "EXEC", "DISCARD":
+		c.inTx, c.txAddr, c.watchAddr = false, "", ""
+	}
+	return nil
+}
+
+// sendTo sends the held commands, then cmd, to the node at addr.
+func (c *clusterConn) sendTo(addr string, cmd clusterCommand) error {
+	conn, err := c.conn(nil, addr)
+	if err != nil {
+		return err
+	}
+	for _, h := range append(c.held, cmd) {
+		if err := conn.Send(h.name, h.args...); err != nil {
+			return err
+		}
+		c.queue = append(c.queue, clusterReply{conn: conn, discard: h.discard})
+	}
+	c.held = nil
+	c.last, c.lastAddr = conn, addr
+	return nil
+}
+
+// sendHeld sends the held commands to the last node used, or any node.
+func (c *clusterConn) sendHeld() error {
+	if len(c.held) == 0 {
+		return nil
+	}
+	addr := c.txAddr
+	if addr == "" {
+		addr = c.lastAddr
+	}
+	if addr == "" {
+		addr = c.pool.anyAddr()
+	}
+	held := c.held
+	c.held = held[:len(held)-1]
+	return c.sendTo(addr, held[len(held)-1])
+}
+
+func (c *clusterConn) receive(io connIO) (interface{}, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if err := c.sendHeld(); err != nil {
+		return nil, err
+	}
+	for len(c.queue) > 0 {
+		r := c.queue[0]
+		c.queue = c.queue[1:]
+		reply, err := io.recv(r.conn)
+		if r.discard {
+			if _, ok := err.(redis.Error); err == nil || ok {
+				continue
+			}
+		}
+		return reply, err
+	}
+	// Past the queued replies come pushed messages, like pub/sub ones.
+	if c.last == nil {
+		return nil, errors.New("cache: receive before any command was sent")
+	}
+	return io.recv(c.last)
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// sentinelPool is a pool whose connections go to the master the sentinels
+// currently report. Every dial asks the sentinels, and a borrowed connection
+// that has been idle is checked with ROLE, so connections to a demoted
+// master are dropped after a failover.
+type sentinelPool struct {
+	*redis.Pool
+	opts *RedisOpts
+
+	mu        sync.Mutex
+	sentinels []string // the one that answered last goes first
+}
+
+func newSentinelPool(opts *RedisOpts) *sentinelPool {
+	sp := &sentinelPool{opts: opts, sentinels: append([]string(nil), opts.SentinelAddrs...)}
+	sp.Pool = newRedisPool(opts, sp.masterAddr, opts.Database)
+	sp.Pool.TestOnBorrow = func(conn redis.Conn, t time.Time) error {
+		if time.Since(t) < time.Second {
+			return nil
+		}
+		return checkRole(conn, "master")
+	}
+	return sp
+}
+
+// masterAddr asks the sentinels in turn for the address of the master.
+func (sp *sentinelPool) masterAddr() (string, error) {
+	sp.mu.Lock()
+	sentinels := append([]string(nil), sp.sentinels...)
+	sp.mu.Unlock()
+
+	var errs []string
+	dialOpts := []redis.DialOption{
+		redis.DialPassword(sp.opts.SentinelPassword),
+		redis.DialConnectTimeout(time.Second),
+		redis.DialReadTimeout(time.Second),
+	}
+	if sp.opts.TLSConfig != nil {
+		dialOpts = append(dialOpts, redis.DialUseTLS(true), redis.DialTLSConfig(sp.opts.TLSConfig))
+	}
+	for i, addr := range sentinels {
+		conn, err := redis.Dial("tcp", addr, dialOpts...)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		parts, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", sp.opts.MasterName))
+		conn.Close()
+		if err != nil || len(parts) != 2 {
+			errs = append(errs, fmt.Sprintf("%s: no master %q: %v", addr, sp.opts.MasterName, err))
+			continue
+		}
+		if i > 0 {
+			sp.mu.Lock()
+			sp.sentinels[0], sp.sentinels[i] = sp.sentinels[i], sp.sentinels[0]
+			sp.mu.Unlock()
+		}
+		return net.JoinHostPort(parts[0], parts[1]), nil
+	}
+	return "", errors.New("cache: no sentinel answered: " + strings.Join(errs, "; "))
+}
+
+// checkRole fails unless conn is a server in the given role.
+func checkRole(conn redis.Conn, want string) error {
+	reply, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return errors.New("cache: empty ROLE reply")
+	}
+	role, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != want {
+		return fmt.Errorf("cache: server is a %s, not a %s", role, want)
+	}
+	return nil
+}
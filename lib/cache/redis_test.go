@@ -0,0 +1,723 @@
+package cache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConn is the state of one client connection to a fakeRedis.
+type fakeConn struct {
+	asking bool
+	tx     [][]string // queued commands, nil outside MULTI
+
+	wmu sync.Mutex // guards w, messages are pushed by other connections
+	w   *bufio.Writer
+}
+
+// push writes reply to c outside of a request.
+func (c *fakeConn) push(reply interface{}) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	writeReply(c.w, reply)
+	c.w.Flush()
+}
+
+// fakeRedis is an in-process RESP server. Commands go to the function set
+// with Handle first, which returns nil to let the built in key value
+// commands run.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu     sync.Mutex
+	handle func(c *fakeConn, args []string) interface{}
+	data   map[string]string
+	sets   map[string]map[string]bool
+	conns  map[net.Conn]bool
+	subs   map[string]map[*fakeConn]bool
+}
+
+func newFakeRedis(t testing.TB) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		ln:    ln,
+		data:  make(map[string]string),
+		sets:  make(map[string]map[string]bool),
+		conns: make(map[net.Conn]bool),
+		subs:  make(map[string]map[*fakeConn]bool),
+	}
+	t.Cleanup(s.Close)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = true
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *fakeRedis) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *fakeRedis) Handle(h func(c *fakeConn, args []string) interface{}) {
+	s.mu.Lock()
+	s.handle = h
+	s.mu.Unlock()
+}
+
+func (s *fakeRedis) value(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[key]
+	return v, ok
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	c := &fakeConn{w: bufio.NewWriter(conn)}
+	defer s.unsubscribe(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		reply := s.exec(c, args)
+		c.wmu.Lock()
+		writeReply(c.w, reply)
+		err = c.w.Flush()
+		c.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// unsubscribe drops every subscription of c.
+func (s *fakeRedis) unsubscribe(c *fakeConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conns := range s.subs {
+		delete(conns, c)
+	}
+}
+
+func (s *fakeRedis) exec(c *fakeConn, args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	if c.tx != nil && name != "EXEC" {
+		c.tx = append(c.tx, args)
+		return "QUEUED"
+	}
+	if name != "ASKING" {
+		defer func() { c.asking = false }()
+	}
+	s.mu.Lock()
+	handle := s.handle
+	s.mu.Unlock()
+	if handle != nil {
+		if reply := handle(c, args); reply != nil {
+			return reply
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch name {
+	case "PING":
+		return "PONG"
+	case "AUTH", "SELECT":
+		return "OK"
+	case "MULTI":
+		c.tx = [][]string{}
+		return "OK"
+	case "EXEC":
+		tx := c.tx
+		c.tx = nil
+		replies := make([]interface{}, len(tx))
+		s.mu.Unlock()
+		for i, cmd := range tx {
+			replies[i] = s.exec(c, cmd)
+		}
+		s.mu.Lock()
+		return replies
+	case "GET":
+		if v, ok := s.data[args[1]]; ok {
+			return []byte(v)
+		}
+		return []byte(nil)
+	case "MGET":
+		values := make([]interface{}, len(args)-1)
+		for i, k := range args[1:] {
+			values[i] = []byte(nil)
+			if v, ok := s.data[k]; ok {
+				values[i] = []byte(v)
+			}
+		}
+		return values
+	case "SET":
+		s.data[args[1]] = args[2]
+		return "OK"
+	case "SETEX":
+		s.data[args[1]] = args[3]
+		return "OK"
+	case "DEL", "EXISTS":
+		var n int64
+		for _, k := range args[1:] {
+			_, ok := s.data[k]
+			if ok || s.sets[k] != nil {
+				n++
+				if name == "DEL" {
+					delete(s.data, k)
+					delete(s.sets, k)
+				}
+			}
+		}
+		return n
+	case "RENAME":
+		if v, ok := s.data[args[1]]; ok {
+			delete(s.data, args[1])
+			s.data[args[2]] = v
+		} else if set := s.sets[args[1]]; set != nil {
+			delete(s.sets, args[1])
+			s.sets[args[2]] = set
+		} else {
+			return fmt.Errorf("ERR no such key")
+		}
+		return "OK"
+	case "SADD":
+		if s.sets[args[1]] == nil {
+			s.sets[args[1]] = make(map[string]bool)
+		}
+		var n int64
+		for _, m := range args[2:] {
+			if !s.sets[args[1]][m] {
+				s.sets[args[1]][m] = true
+				n++
+			}
+		}
+		return n
+	case "SPOP":
+		count, _ := strconv.Atoi(args[2])
+		members := []interface{}{}
+		for m := range s.sets[args[1]] {
+			if len(members) == count {
+				break
+			}
+			delete(s.sets[args[1]], m)
+			members = append(members, []byte(m))
+		}
+		if len(s.sets[args[1]]) == 0 {
+			delete(s.sets, args[1])
+		}
+		return members
+	case "PTTL":
+		if _, ok := s.data[args[1]]; ok {
+			return int64(-1)
+		}
+		return int64(-2)
+	case "ECHO":
+		return []byte(args[1])
+	case "SUBSCRIBE":
+		// one reply per channel, the last is written by serve
+		for i, ch := range args[1:] {
+			if s.subs[ch] == nil {
+				s.subs[ch] = make(map[*fakeConn]bool)
+			}
+			s.subs[ch][c] = true
+			reply := []interface{}{[]byte("subscribe"), []byte(ch), int64(i + 1)}
+			if i == len(args)-2 {
+				return reply
+			}
+			c.push(reply)
+		}
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		if name == "UNSUBSCRIBE" {
+			for _, conns := range s.subs {
+				delete(conns, c)
+			}
+		}
+		return []interface{}{[]byte(strings.ToLower(name)), []byte(nil), int64(0)}
+	case "PUBLISH":
+		var n int64
+		for c := range s.subs[args[1]] {
+			c.push([]interface{}{[]byte("message"), []byte(args[1]), []byte(args[2])})
+			n++
+		}
+		return n
+	}
+	return fmt.Errorf("ERR unknown command '%s'", args[0])
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[0] != '*' {
+		return nil, fmt.Errorf("bad request %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// writeReply writes strings as status replies and []byte as bulk strings,
+// nil ones as a nil bulk.
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", v.Error())
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		if v == nil {
+			w.WriteString("$-1\r\n")
+			return
+		}
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	}
+}
+
+// clusterSlotsReply serves every slot from addr.
+func clusterSlotsReply(addr string) interface{} {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.ParseInt(port, 10, 64)
+	return []interface{}{
+		[]interface{}{int64(0), int64(clusterSlots - 1), []interface{}{[]byte(host), p}},
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 0x31C3},
+		{"{user1000}.following", keySlot("user1000")},
+		{"foo{}{bar}", keySlot("foo{}{bar}")},
+		{"foo{{bar}}", keySlot("{bar")},
+	}
+	for _, tt := range tests {
+		if got := keySlot(tt.key); got != tt.slot {
+			t.Errorf("keySlot(%q) = %d, want %d", tt.key, got, tt.slot)
+		}
+	}
+	if keySlot("{a}x") != keySlot("{a}y") {
+		t.Error("keys sharing a hash tag are in different slots")
+	}
+}
+
+func TestRedisClusterRedirects(t *testing.T) {
+	a, b := newFakeRedis(t), newFakeRedis(t)
+	// a claims every slot but has handed over "moved", and is migrating
+	// "asked", to b.
+	a.Handle(func(c *fakeConn, args []string) interface{} {
+		if strings.ToUpper(args[0]) == "CLUSTER" {
+			return clusterSlotsReply(a.Addr())
+		}
+		if len(args) > 1 {
+			switch args[1] {
+			case "moved":
+				return fmt.Errorf("MOVED %d %s", keySlot("moved"), b.Addr())
+			case "asked":
+				return fmt.Errorf("ASK %d %s", keySlot("asked"), b.Addr())
+			}
+		}
+		return nil
+	})
+	b.Handle(func(c *fakeConn, args []string) interface{} {
+		switch strings.ToUpper(args[0]) {
+		case "CLUSTER":
+			return clusterSlotsReply(a.Addr())
+		case "ASKING":
+			c.asking = true
+			return "OK"
+		}
+		if len(args) > 1 && args[1] == "asked" && !c.asking {
+			return fmt.Errorf("MOVED %d %s", keySlot("asked"), a.Addr())
+		}
+		return nil
+	})
+
+	r := NewRedisCache().(*Redis)
+	if err := r.Init(&RedisOpts{ClusterAddrs: []string{a.Addr()}, MaxIdle: 4}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.conn.Close()
+
+	if err := r.Set("plain", "1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := a.value("plain"); v != "1" {
+		t.Fatalf("plain on a = %q", v)
+	}
+
+	if err := r.Set("moved", "2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.value("moved"); v != "2" {
+		t.Fatalf("moved on b = %q", v)
+	}
+	if v, err := r.GetWithError("moved"); err != nil || string(v.([]byte)) != "2" {
+		t.Fatalf("Get moved = %v, %v", v, err)
+	}
+
+	if err := r.Set("asked", "3", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.value("asked"); v != "3" {
+		t.Fatalf("asked on b = %q", v)
+	}
+	if _, ok := a.value("asked"); ok {
+		t.Fatal("asked was set on a")
+	}
+
+	// The transaction is held until its key picks the node.
+	v, ttl, err := r.GetWithTTL("plain")
+	if err != nil || string(v.([]byte)) != "1" || ttl != 0 {
+		t.Fatalf("GetWithTTL = %v, %v, %v", v, ttl, err)
+	}
+}
+
+func TestRedisSentinelFailover(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		master string
+	)
+	roleOf := func(addr string) func(c *fakeConn, args []string) interface{} {
+		return func(c *fakeConn, args []string) interface{} {
+			if strings.ToUpper(args[0]) != "ROLE" {
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if master == addr {
+				return []interface{}{"master", int64(0), []interface{}{}}
+			}
+			return []interface{}{"slave", []byte("127.0.0.1"), int64(0), "connected", int64(0)}
+		}
+	}
+
+	m1, m2, sentinel := newFakeRedis(t), newFakeRedis(t), newFakeRedis(t)
+	m1.Handle(roleOf(m1.Addr()))
+	m2.Handle(roleOf(m2.Addr()))
+	master = m1.Addr()
+	sentinel.Handle(func(c *fakeConn, args []string) interface{} {
+		if strings.ToUpper(args[0]) != "SENTINEL" || len(args) != 3 || args[2] != "mymaster" {
+			return fmt.Errorf("ERR unexpected %v", args)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		host, port, _ := net.SplitHostPort(master)
+		return []interface{}{[]byte(host), []byte(port)}
+	})
+
+	r := NewRedisCache().(*Redis)
+	if err := r.Init(&RedisOpts{SentinelAddrs: []string{"127.0.0.1:1", sentinel.Addr()}, MasterName: "mymaster", MaxIdle: 4}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.conn.Close()
+
+	if err := r.Set("k", "1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m1.value("k"); v != "1" {
+		t.Fatalf("k on m1 = %q", v)
+	}
+
+	mu.Lock()
+	master = m2.Addr()
+	mu.Unlock()
+	// Idle connections are checked with ROLE after a second.
+	time.Sleep(1100 * time.Millisecond)
+
+	if err := r.Set("k", "2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m2.value("k"); v != "2" {
+		t.Fatalf("k on m2 = %q", v)
+	}
+	if v, _ := m1.value("k"); v != "1" {
+		t.Fatalf("k on demoted m1 = %q", v)
+	}
+}
+
+func TestRedisSentinelNeedsMasterName(t *testing.T) {
+	r := NewRedisCache().(*Redis)
+	if err := r.Init(&RedisOpts{SentinelAddrs: []string{"127.0.0.1:26379"}}); err == nil {
+		t.Fatal("Init without MasterName succeeded")
+	}
+}
+
+func newTestRedis(t testing.TB, s *fakeRedis) *Redis {
+	r := NewRedisCache().(*Redis)
+	if err := r.Init(&RedisOpts{Host: s.Addr(), MaxIdle: 4}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.conn.Close() })
+	return r
+}
+
+func TestTypedRedisCodec(t *testing.T) {
+	ctx := context.Background()
+	for name, codec := range map[string]Codec{
+		"json":    JSONCodec{},
+		"gob":     GobCodec{},
+		"msgpack": MsgpackCodec{},
+	} {
+		r := newTestRedis(t, newFakeRedis(t))
+		tc := NewTypedRedisCache[typedUser](r, codec)
+
+		if _, ok, err := tc.Get(ctx, "u1"); ok || err != nil {
+			t.Fatalf("%s: Get on empty cache = %v, %v", name, ok, err)
+		}
+		if err := tc.Set(ctx, "u1", typedUser{1, "a"}, time.Minute); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if u, ok, err := tc.Get(ctx, "u1"); err != nil || !ok || u != (typedUser{1, "a"}) {
+			t.Fatalf("%s: Get = %v, %v, %v", name, u, ok, err)
+		}
+
+		if err := tc.SetMulti(ctx, map[string]typedUser{"u2": {2, "b"}, "u3": {3, "c"}}, 0); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		r.SetNegative("u4", time.Minute)
+		res, err := tc.GetMulti(ctx, []string{"u1", "u2", "u4", "u5"})
+		if err != nil || len(res) != 2 || res["u2"] != (typedUser{2, "b"}) {
+			t.Fatalf("%s: GetMulti = %v, %v", name, res, err)
+		}
+
+		if err := tc.Delete(ctx, "u1"); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, ok, err := tc.Get(ctx, "u1"); ok || err != nil {
+			t.Fatalf("%s: Get after Delete = %v, %v", name, ok, err)
+		}
+	}
+}
+
+func TestTypedRedisErrors(t *testing.T) {
+	ctx := context.Background()
+	s := newFakeRedis(t)
+	tc := NewTypedRedisCache[typedUser](newTestRedis(t, s), JSONCodec{})
+
+	// a negative entry is a miss, a value of another shape is an error
+	s.data["neg"] = string(negativeMarker)
+	if _, ok, err := tc.Get(ctx, "neg"); ok || err != nil {
+		t.Fatalf("Get of a negative entry = %v, %v", ok, err)
+	}
+	s.data["bad"] = "not json"
+	if _, ok, err := tc.Get(ctx, "bad"); ok || err == nil {
+		t.Fatalf("Get of an undecodable value = %v, %v", ok, err)
+	}
+	if _, err := tc.GetMulti(ctx, []string{"bad"}); err == nil {
+		t.Fatal("GetMulti of an undecodable value succeeded")
+	}
+
+	s.Handle(func(c *fakeConn, args []string) interface{} {
+		return errors.New("LOADING redis is loading the dataset in memory")
+	})
+	if _, ok, err := tc.Get(ctx, "u1"); ok || err == nil {
+		t.Fatalf("Get on a failing server = %v, %v", ok, err)
+	}
+	if _, err := tc.GetMulti(ctx, []string{"u1"}); err == nil {
+		t.Fatal("GetMulti on a failing server succeeded")
+	}
+	if err := tc.Set(ctx, "u1", typedUser{}, 0); err == nil {
+		t.Fatal("Set on a failing server succeeded")
+	}
+}
+
+func TestRedisInvalidateTag(t *testing.T) {
+	s := newFakeRedis(t)
+	r := newTestRedis(t, s)
+
+	// more keys than one SPOP batch
+	for i := 0; i < 1200; i++ {
+		if err := r.SetWithTags(fmt.Sprintf("user:%d", i), "u", time.Minute, "user"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.SetWithTags("org:1", "o", time.Minute, "org")
+
+	if err := r.InvalidateTag("user"); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	left, sets := len(s.data), len(s.sets)
+	s.mu.Unlock()
+	if left != 1 || sets != 1 {
+		t.Fatalf("%d keys and %d tag sets left, want only org:1 and its tag", left, sets)
+	}
+	if err := r.InvalidateTag("user"); err != nil {
+		t.Fatalf("InvalidateTag of an empty tag = %v", err)
+	}
+}
+
+// newFakeCluster returns two nodes splitting the slots in halves. They
+// redirect keys of the other half and refuse commands, or transactions,
+// whose keys are in several slots.
+func newFakeCluster(t *testing.T) (a, b *fakeRedis) {
+	a, b = newFakeRedis(t), newFakeRedis(t)
+	slots := func() interface{} {
+		node := func(addr string) []interface{} {
+			host, port, _ := net.SplitHostPort(addr)
+			p, _ := strconv.ParseInt(port, 10, 64)
+			return []interface{}{[]byte(host), p}
+		}
+		return []interface{}{
+			[]interface{}{int64(0), int64(clusterSlots/2 - 1), node(a.Addr())},
+			[]interface{}{int64(clusterSlots / 2), int64(clusterSlots - 1), node(b.Addr())},
+		}
+	}
+	keys := func(args []string) []string {
+		switch strings.ToUpper(args[0]) {
+		case "DEL", "MGET", "EXISTS", "RENAME":
+			return args[1:]
+		case "GET", "SET", "SADD", "SPOP", "PTTL":
+			return args[1:2]
+		}
+		return nil
+	}
+	handle := func(low bool) func(c *fakeConn, args []string) interface{} {
+		return func(c *fakeConn, args []string) interface{} {
+			cmds := [][]string{args}
+			switch strings.ToUpper(args[0]) {
+			case "CLUSTER":
+				return slots()
+			case "EXEC":
+				cmds = c.tx
+			}
+			slot := -1
+			for _, cmd := range cmds {
+				for _, key := range keys(cmd) {
+					if s := keySlot(key); slot == -1 {
+						slot = s
+					} else if s != slot {
+						c.tx = nil
+						return fmt.Errorf("CROSSSLOT Keys in request don't hash to the same slot")
+					}
+				}
+			}
+			if slot != -1 && (slot < clusterSlots/2) != low {
+				other := a
+				if low {
+					other = b
+				}
+				c.tx = nil
+				return fmt.Errorf("MOVED %d %s", slot, other.Addr())
+			}
+			return nil
+		}
+	}
+	a.Handle(handle(true))
+	b.Handle(handle(false))
+	return a, b
+}
+
+func TestRedisClusterTags(t *testing.T) {
+	a, b := newFakeCluster(t)
+	r := NewRedisCache().(*Redis)
+	if err := r.Init(&RedisOpts{ClusterAddrs: []string{a.Addr()}, MaxIdle: 4}); err != nil {
+		t.Fatal(err)
+	}
+	defer r.conn.Close()
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("user:%d", i)
+		keys = append(keys, key)
+		if err := r.SetWithTags(key, fmt.Sprintf(`{"ID":%d}`, i), time.Minute, "user", "all"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.SetWithTags("org:1", `{"ID":100}`, time.Minute, "all"); err != nil {
+		t.Fatal(err)
+	}
+	a.mu.Lock()
+	onA := len(a.data)
+	a.mu.Unlock()
+	if onA == 0 || onA == 21 {
+		t.Fatalf("%d of 21 keys on a, the test needs both nodes", onA)
+	}
+
+	tc := NewTypedRedisCache[typedUser](r, JSONCodec{})
+	res, err := tc.GetMulti(context.Background(), append(keys, "org:1", "missing"))
+	if err != nil || len(res) != 21 || res["user:7"].ID != 7 || res["org:1"].ID != 100 {
+		t.Fatalf("GetMulti = %v, %v", res, err)
+	}
+
+	if err := r.InvalidateTag("user"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if r.IsExist(key) {
+			t.Fatalf("%s survived InvalidateTag", key)
+		}
+	}
+	if !r.IsExist("org:1") {
+		t.Fatal("InvalidateTag removed an untagged key")
+	}
+	if err := r.InvalidateTag("all"); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*fakeRedis{a, b} {
+		s.mu.Lock()
+		n := len(s.data) + len(s.sets)
+		s.mu.Unlock()
+		if n != 0 {
+			t.Fatalf("%d keys left on %s", n, s.Addr())
+		}
+	}
+}
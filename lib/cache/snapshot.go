@@ -0,0 +1,289 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot file layout, all integers are varints:
+//
+//	magic "GMCS" | version byte | saved at (unix nano) | item count
+//	item: key | remaining ttl (ns, 0 never expires) | flags byte
+//	      | tag count | tags | value length | gob encoded value
+//	crc32 (IEEE, 4 bytes big endian) of everything before it
+const (
+	snapshotMagic   = "GMCS"
+	snapshotVersion = 1
+
+	snapshotNegative = 1 << 0
+)
+
+// ErrCorruptSnapshot is returned when a snapshot file cannot be trusted.
+var ErrCorruptSnapshot = errors.New("cache: corrupt snapshot")
+
+// SaveSnapshot writes the live items to path, replacing it atomically.
+// Values are gob encoded, so types other than the basic ones must be
+// registered with gob.Register. Items whose value cannot be encoded are
+// skipped and reported in the returned error once the file is written.
+func (bc *MemoryCache) SaveSnapshot(path string) error {
+	var (
+		body    bytes.Buffer
+		val     bytes.Buffer
+		skipped int
+		skipErr error
+		count   int
+	)
+	now := time.Now()
+
+	bc.RLock()
+	for key, itm := range bc.items {
+		if itm.isExpire() {
+			continue
+		}
+		var ttl time.Duration
+		if itm.lifespan > 0 {
+			ttl = itm.createdTime.Add(itm.lifespan).Sub(now)
+		}
+		var flags byte
+		val.Reset()
+		if IsNegative(itm.val) {
+			flags |= snapshotNegative
+		} else if err := gob.NewEncoder(&val).Encode(&itm.val); err != nil {
+			skipped++
+			if skipErr == nil {
+				skipErr = fmt.Errorf("key %q: %v", key, err)
+			}
+			continue
+		}
+		writeString(&body, key)
+		writeVarint(&body, int64(ttl))
+		body.WriteByte(flags)
+		writeUvarint(&body, uint64(len(itm.tags)))
+		for _, t := range itm.tags {
+			writeString(&body, t)
+		}
+		writeUvarint(&body, uint64(val.Len()))
+		body.Write(val.Bytes())
+		count++
+	}
+	bc.RUnlock()
+
+	var out bytes.Buffer
+	out.WriteString(snapshotMagic)
+	out.WriteByte(snapshotVersion)
+	writeVarint(&out, now.UnixNano())
+	writeUvarint(&out, uint64(count))
+	out.Write(body.Bytes())
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(out.Bytes()))
+	out.Write(sum[:])
+
+	if err := writeFileAtomic(path, out.Bytes()); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		return fmt.Errorf("cache: snapshot skipped %d items, first: %v", skipped, skipErr)
+	}
+	return nil
+}
+
+// LoadSnapshot adds the items saved in path, dropping those that expired
+// since, and returns how many were loaded. A damaged file loads nothing and
+// returns an error wrapping ErrCorruptSnapshot.
+func (bc *MemoryCache) LoadSnapshot(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < len(snapshotMagic)+1+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, fmt.Errorf("%w: bad header", ErrCorruptSnapshot)
+	}
+	if v := data[len(snapshotMagic)]; v != snapshotVersion {
+		return 0, fmt.Errorf("%w: unsupported version %d", ErrCorruptSnapshot, v)
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrCorruptSnapshot)
+	}
+
+	items, err := decodeSnapshot(bytes.NewReader(body[len(snapshotMagic)+1:]), time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrCorruptSnapshot, err)
+	}
+
+	bc.Lock()
+	defer bc.Unlock()
+	for key, itm := range items {
+		bc.setItem(key, itm)
+	}
+	return len(items), nil
+}
+
+func decodeSnapshot(r *bytes.Reader, now time.Time) (map[string]*MemoryItem, error) {
+	savedAt, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	elapsed := now.Sub(time.Unix(0, savedAt))
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(r.Len()) {
+		return nil, fmt.Errorf("item count %d exceeds file size", count)
+	}
+
+	items := make(map[string]*MemoryItem, count)
+	for i := uint64(0); i < count; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		ttl, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		flags, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		ntags, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if ntags > uint64(r.Len()) {
+			return nil, fmt.Errorf("tag count %d exceeds file size", ntags)
+		}
+		var tags []string
+		for j := uint64(0); j < ntags; j++ {
+			t, err := readString(r)
+			if err != nil {
+				return nil, err
+			}
+			tags = append(tags, t)
+		}
+		raw, err := readBytes(r)
+		if err != nil {
+			return nil, err
+		}
+
+		lifespan := time.Duration(ttl)
+		if lifespan > 0 {
+			if lifespan -= elapsed; lifespan <= 0 {
+				continue
+			}
+		}
+		itm := &MemoryItem{createdTime: now, lifespan: lifespan, tags: tags}
+		if flags&snapshotNegative != 0 {
+			itm.val = Negative
+		} else if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&itm.val); err != nil {
+			return nil, fmt.Errorf("key %q: %v", key, err)
+		}
+		items[key] = itm
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", r.Len())
+	}
+	return items, nil
+}
+
+// snapshotLoop saves a snapshot every interval until stop is closed.
+func (bc *MemoryCache) snapshotLoop(path string, interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := bc.SaveSnapshot(path); err != nil {
+				bc.logf("cache: save snapshot %s: %v", path, err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close stops the vacuum and the periodic snapshots and, when MemoryOpts
+// named a snapshot path, saves a last one.
+func (bc *MemoryCache) Close() error {
+	bc.Lock()
+	path := bc.snapshotPath
+	if bc.snapshotStop != nil {
+		close(bc.snapshotStop)
+		bc.snapshotStop = nil
+	}
+	if bc.vacuumStop != nil {
+		close(bc.vacuumStop)
+		bc.vacuumStop = nil
+	}
+	bc.Unlock()
+	if path == "" {
+		return nil
+	}
+	return bc.SaveSnapshot(path)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if _, err = w.Write(data); err == nil {
+		if err = w.Flush(); err == nil {
+			err = f.Sync()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func writeVarint(b *bytes.Buffer, v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func writeUvarint(b *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	writeUvarint(b, uint64(len(s)))
+	b.WriteString(s)
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	b, err := readBytes(r)
+	return string(b), err
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	bc := newBoundedMemory(t, &MemoryOpts{SnapshotPath: path})
+	bc.Set("str", "v", 0)
+	bc.Set("bytes", []byte("b"), time.Hour)
+	bc.Set("short", 1, 20*time.Millisecond)
+	bc.SetNegative("neg", time.Hour)
+	bc.SetWithTags("tagged", 2, 0, "t")
+	if err := bc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	restored := newBoundedMemory(t, &MemoryOpts{SnapshotPath: path})
+	if v := restored.Get("str"); v != "v" {
+		t.Fatalf("str = %v", v)
+	}
+	if v, ok := restored.Get("bytes").([]byte); !ok || string(v) != "b" {
+		t.Fatalf("bytes = %v", restored.Get("bytes"))
+	}
+	if restored.IsExist("short") {
+		t.Fatal("expired item was restored")
+	}
+	if !IsNegative(restored.Get("neg")) {
+		t.Fatal("negative entry lost")
+	}
+	restored.InvalidateTag("t")
+	if restored.IsExist("tagged") {
+		t.Fatal("tags lost")
+	}
+
+	restored.Lock()
+	itm := restored.items["bytes"]
+	restored.Unlock()
+	if itm.lifespan > time.Hour || itm.lifespan < 59*time.Minute {
+		t.Fatalf("remaining ttl = %v", itm.lifespan)
+	}
+}
+
+func TestMemoryCacheCorruptSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snap")
+	bc := newTestMemory(t)
+	bc.Set("k", "v", 0)
+	if err := bc.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(path, data, 0644)
+
+	if _, err := newTestMemory(t).LoadSnapshot(path); !errors.Is(err, ErrCorruptSnapshot) {
+		t.Fatalf("LoadSnapshot err = %v", err)
+	}
+	// Init reports the damage but still starts.
+	if restored := newBoundedMemory(t, &MemoryOpts{SnapshotPath: path}); restored.Len() != 0 {
+		t.Fatalf("Len = %d after a corrupt snapshot", restored.Len())
+	}
+}
@@ -0,0 +1,36 @@
+package cache
+
+import "time"
+
+var (
+	// DefaultNegativeTTL is a suggested ttl for SetNegative, short enough
+	// for a key created later to show up quickly.
+	DefaultNegativeTTL = 30 * time.Second
+	// DefaultTagPrefix prefixes the redis sets that track the keys of a tag.
+	DefaultTagPrefix = "cache:tag:"
+)
+
+// TagCache is implemented by adapters that can remember missing keys and
+// invalidate groups of keys sharing a tag.
+type TagCache interface {
+	Cache
+	// SetNegative records that key does not exist. Get returns Negative for
+	// it until timeout.
+	SetNegative(key string, timeout time.Duration) error
+	// SetWithTags is Set, also adding key to each tag.
+	SetWithTags(key string, val interface{}, timeout time.Duration, tags ...string) error
+	// InvalidateTag deletes every key set with tag.
+	InvalidateTag(tag string) error
+}
+
+type negativeEntry struct{}
+
+// Negative is returned by Get for a key stored with SetNegative. The typed
+// adapters report such keys as a miss.
+var Negative interface{} = negativeEntry{}
+
+// IsNegative reports whether v, as returned by Get, is a negative entry.
+func IsNegative(v interface{}) bool {
+	_, ok := v.(negativeEntry)
+	return ok
+}
@@ -0,0 +1,269 @@
+package cache
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	DefaultL1TTL             = time.Minute
+	DefaultInvalidateChannel = "cache:invalidate"
+)
+
+type TieredOpts struct {
+	// L1 configures the local MemoryCache, nil means &MemoryOpts{}.
+	L1 *MemoryOpts
+	// L1TTL caps how long a local copy lives, defaults to DefaultL1TTL.
+	// Copies are never kept longer than the ttl given to Set.
+	L1TTL time.Duration
+	// L2 is the shared cache, an initialised redis or memcache adapter.
+	L2 Cache
+	// PubSub carries invalidations between replicas. It defaults to the
+	// pool of L2 when L2 is the redis adapter; without one, invalidations
+	// stay local.
+	PubSub *redis.Pool
+	// Channel is the invalidation channel, defaults to
+	// DefaultInvalidateChannel.
+	Channel  string
+	ErrorLog *log.Logger
+}
+
+// TieredCache reads through a local MemoryCache into a shared L2 cache.
+// Set and Delete publish an invalidation so the other replicas drop their
+// local copy of the key.
+type TieredCache struct {
+	l1      *MemoryCache
+	l2      Cache
+	l1TTL   time.Duration
+	pool    redisPool
+	channel string
+	id      string
+	log     *log.Logger
+
+	mu   sync.Mutex
+	psc  *redis.PubSubConn
+	stop chan struct{}
+}
+
+func NewTieredCache() Cache {
+	return &TieredCache{}
+}
+
+func (tc *TieredCache) Get(key string) interface{} {
+	if v := tc.l1.Get(key); v != nil {
+		return v
+	}
+	v := tc.l2.Get(key)
+	if v == nil {
+		return nil
+	}
+	if _, isErr := v.(error); !isErr {
+		tc.l1.Set(key, v, tc.l1TTL)
+	}
+	return v
+}
+
+func (tc *TieredCache) Set(key string, val interface{}, timeout time.Duration) error {
+	if err := tc.l2.Set(key, val, timeout); err != nil {
+		return err
+	}
+	ttl := tc.l1TTL
+	if timeout > 0 && timeout < ttl {
+		ttl = timeout
+	}
+	tc.l1.Set(key, val, ttl)
+	return tc.publish(key)
+}
+
+func (tc *TieredCache) Delete(key string) error {
+	tc.l1.Delete(key)
+	if err := tc.l2.Delete(key); err != nil {
+		return err
+	}
+	return tc.publish(key)
+}
+
+func (tc *TieredCache) IsExist(key string) bool {
+	return tc.l1.IsExist(key) || tc.l2.IsExist(key)
+}
+
+func (tc *TieredCache) Init(cfg interface{}) error {
+	var opts *TieredOpts
+	if val, ok := cfg.(*TieredOpts); !ok {
+		return errors.New("interface not type TieredOpts")
+	} else {
+		opts = val
+	}
+	if opts.L2 == nil {
+		return errors.New("config has no L2 cache")
+	}
+
+	l1Opts := opts.L1
+	if l1Opts == nil {
+		l1Opts = &MemoryOpts{}
+	}
+	l1 := NewMemoryCache().(*MemoryCache)
+	if err := l1.Init(l1Opts); err != nil {
+		return err
+	}
+
+	tc.Close()
+	tc.l1 = l1
+	tc.l2 = opts.L2
+	tc.l1TTL = opts.L1TTL
+	if tc.l1TTL <= 0 {
+		tc.l1TTL = DefaultL1TTL
+	}
+	tc.pool = nil
+	if opts.PubSub != nil {
+		tc.pool = opts.PubSub
+	} else if r, ok := opts.L2.(*Redis); ok {
+		tc.pool = r.conn
+	}
+	tc.channel = opts.Channel
+	if tc.channel == "" {
+		tc.channel = DefaultInvalidateChannel
+	}
+	tc.log = opts.ErrorLog
+	tc.id = newNodeID()
+
+	if tc.pool != nil {
+		stop := make(chan struct{})
+		tc.mu.Lock()
+		tc.stop = stop
+		tc.mu.Unlock()
+		go tc.listen(stop)
+	}
+	return nil
+}
+
+// Close stops listening for invalidations and closes the local cache.
+func (tc *TieredCache) Close() error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.stop != nil {
+		close(tc.stop)
+		tc.stop = nil
+	}
+	var err error
+	if tc.l1 != nil {
+		err = tc.l1.Close()
+	}
+	// The listener is blocked in Receive, which must not run alongside a
+	// Close of the same connection. Unsubscribing ends its Receive loop and
+	// it closes the connection itself.
+	if tc.psc != nil {
+		tc.psc.Unsubscribe()
+		tc.psc = nil
+	}
+	return err
+}
+
+// publish tells the other replicas to drop key. Messages are "id key", the
+// id lets a replica skip its own messages.
+func (tc *TieredCache) publish(key string) error {
+	if tc.pool == nil {
+		return nil
+	}
+	conn := tc.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PUBLISH", tc.channel, tc.id+" "+key)
+	return err
+}
+
+// listen applies invalidations until stop is closed, reconnecting with a
+// growing delay. The local cache is flushed after a reconnect since messages
+// may have been missed while the connection was down.
+func (tc *TieredCache) listen(stop chan struct{}) {
+	backoff := 100 * time.Millisecond
+	for reconnect := false; ; reconnect = true {
+		tc.mu.Lock()
+		select {
+		case <-stop:
+			tc.mu.Unlock()
+			return
+		default:
+		}
+		// Writes to psc happen under tc.mu, so they do not interleave with
+		// the Unsubscribe of Close.
+		psc := &redis.PubSubConn{Conn: tc.pool.Get()}
+		tc.psc = psc
+		err := psc.Subscribe(tc.channel)
+		tc.mu.Unlock()
+
+		if err != nil {
+			tc.logf("cache: subscribe %s: %v", tc.channel, err)
+		} else {
+			if reconnect {
+				tc.l1.flush()
+			}
+			backoff = 100 * time.Millisecond
+			tc.receive(psc, stop)
+		}
+		tc.mu.Lock()
+		if tc.psc == psc {
+			tc.psc = nil
+		}
+		psc.Close()
+		tc.mu.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (tc *TieredCache) receive(psc *redis.PubSubConn, stop chan struct{}) {
+	for {
+		switch msg := psc.Receive().(type) {
+		case redis.Message:
+			parts := strings.SplitN(string(msg.Data), " ", 2)
+			if len(parts) != 2 || parts[0] == tc.id {
+				continue
+			}
+			tc.l1.Delete(parts[1])
+		case redis.Subscription:
+			if msg.Count == 0 {
+				return
+			}
+		case error:
+			select {
+			case <-stop:
+			default:
+				tc.logf("cache: invalidation channel: %v", msg)
+			}
+			return
+		}
+	}
+}
+
+func (tc *TieredCache) logf(format string, args ...interface{}) {
+	if tc.log != nil {
+		tc.log.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func newNodeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func init() {
+	Register("tiered", NewTieredCache())
+}
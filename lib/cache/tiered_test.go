@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTieredCacheReadThrough(t *testing.T) {
+	l2 := newTestMemory(t)
+	tc := NewTieredCache().(*TieredCache)
+	if err := tc.Init(&TieredOpts{L2: l2, L1TTL: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	l2.Set("k", "v1", 0)
+	if v := tc.Get("k"); v != "v1" {
+		t.Fatalf("Get = %v", v)
+	}
+	// The local copy hides L2 changes made behind its back until L1TTL.
+	l2.Set("k", "v2", 0)
+	if v := tc.Get("k"); v != "v1" {
+		t.Fatalf("Get from L1 = %v", v)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if v := tc.Get("k"); v != "v2" {
+		t.Fatalf("Get after L1TTL = %v", v)
+	}
+
+	if err := tc.Set("k", "v3", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v := l2.Get("k"); v != "v3" {
+		t.Fatalf("L2 after Set = %v", v)
+	}
+	if err := tc.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	if tc.IsExist("k") {
+		t.Fatal("k still exists after Delete")
+	}
+}
+
+func TestTieredCacheInvalidation(t *testing.T) {
+	s := newFakeRedis(t)
+	newTiered := func() *TieredCache {
+		tc := NewTieredCache().(*TieredCache)
+		if err := tc.Init(&TieredOpts{L2: newTestRedis(t, s), Channel: "inv"}); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { tc.Close() })
+		return tc
+	}
+	a, b := newTiered(), newTiered()
+
+	// wait for both replicas to listen
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		s.mu.Lock()
+		n := len(s.subs["inv"])
+		s.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d replicas subscribed", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := a.Set("k", "v1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := b.Get("k").([]byte); string(v) != "v1" {
+		t.Fatalf("b Get = %q", v)
+	}
+	if err := a.Set("k", "v2", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	// b drops its local v1 once the invalidation arrives
+	for {
+		if v, _ := b.Get("k").([]byte); string(v) == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("b kept its stale copy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// a does not drop its own copy
+	if v := a.Get("k"); v != "v2" {
+		t.Fatalf("a Get = %v", v)
+	}
+
+	if err := b.Delete("k"); err != nil {
+		t.Fatal(err)
+	}
+	for a.l1.IsExist("k") {
+		if time.Now().After(deadline) {
+			t.Fatal("a kept its copy of a deleted key")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTieredCacheCloseStopsL1(t *testing.T) {
+	tc := NewTieredCache().(*TieredCache)
+	if err := tc.Init(&TieredOpts{L2: newTestMemory(t)}); err != nil {
+		t.Fatal(err)
+	}
+	tc.Close()
+	tc.l1.RLock()
+	defer tc.l1.RUnlock()
+	if tc.l1.vacuumStop != nil {
+		t.Fatal("L1 vacuum still running after Close")
+	}
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// TypedCache is the context-aware, typed counterpart of Cache. Get reports a
+// miss with ok == false and a nil error, so callers can tell a missing key
+// apart from a failing backend.
+type TypedCache[V any] interface {
+	Get(ctx context.Context, key string) (val V, ok bool, err error)
+	Set(ctx context.Context, key string, val V, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	GetMulti(ctx context.Context, keys []string) (map[string]V, error)
+	SetMulti(ctx context.Context, items map[string]V, ttl time.Duration) error
+}
+
+// NewTypedCache returns a TypedCache backed by adapter. The memory, redis and
+// memcache adapters are used natively; any other Cache is wrapped through its
+// legacy methods. codec is ignored by the memory adapter and defaults to
+// DefaultCodec for the others.
+func NewTypedCache[V any](adapter Cache, codec Codec) TypedCache[V] {
+	switch c := adapter.(type) {
+	case *MemoryCache:
+		return NewTypedMemoryCache[V](c)
+	case *Redis:
+		return NewTypedRedisCache[V](c, codec)
+	case *MemCache:
+		return NewTypedMemCache[V](c, codec)
+	}
+	return NewTypedLegacyCache[V](adapter, codec)
+}
+
+// legacyCache adapts a Cache to TypedCache.
+type legacyCache[V any] struct {
+	c     Cache
+	codec Codec
+}
+
+// NewTypedLegacyCache wraps a legacy Cache. When codec is nil values are
+// stored as they are; otherwise they are encoded before Set and []byte or
+// string values are decoded on Get.
+func NewTypedLegacyCache[V any](c Cache, codec Codec) TypedCache[V] {
+	return &legacyCache[V]{c: c, codec: codec}
+}
+
+func (lc *legacyCache[V]) Get(ctx context.Context, key string) (val V, ok bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	v := lc.c.Get(key)
+	if v == nil || IsNegative(v) {
+		return
+	}
+	if e, isErr := v.(error); isErr {
+		err = e
+		return
+	}
+	if val, ok = v.(V); ok {
+		return
+	}
+	if lc.codec != nil {
+		switch data := v.(type) {
+		case []byte:
+			return decodeValue[V](lc.codec, key, data)
+		case string:
+			return decodeValue[V](lc.codec, key, []byte(data))
+		}
+	}
+	return val, false, typeError[V](key, v)
+}
+
+func (lc *legacyCache[V]) Set(ctx context.Context, key string, val V, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if lc.codec == nil {
+		return lc.c.Set(key, val, ttl)
+	}
+	data, err := lc.codec.Marshal(val)
+	if err != nil {
+		return err
+	}
+	return lc.c.Set(key, data, ttl)
+}
+
+func (lc *legacyCache[V]) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return lc.c.Delete(key)
+}
+
+func (lc *legacyCache[V]) GetMulti(ctx context.Context, keys []string) (map[string]V, error) {
+	res := make(map[string]V, len(keys))
+	for _, key := range keys {
+		val, ok, err := lc.Get(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			res[key] = val
+		}
+	}
+	return res, nil
+}
+
+func (lc *legacyCache[V]) SetMulti(ctx context.Context, items map[string]V, ttl time.Duration) error {
+	for key, val := range items {
+		if err := lc.Set(ctx, key, val, ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeValue[V any](codec Codec, key string, data []byte) (val V, ok bool, err error) {
+	if err = codec.Unmarshal(data, &val); err != nil {
+		return val, false, fmt.Errorf("cache: decode key %q: %v", key, err)
+	}
+	return val, true, nil
+}
+
+func typeError[V any](key string, v interface{}) error {
+	want := reflect.TypeOf((*V)(nil)).Elem()
+	return fmt.Errorf("cache: value of key %q is %T, not %v", key, v, want)
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type typedUser struct {
+	ID   int
+	Name string
+}
+
+func newTestMemory(t testing.TB) *MemoryCache {
+	bc := NewMemoryCache().(*MemoryCache)
+	if err := bc.Init(&MemoryOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	return bc
+}
+
+func TestTypedMemoryCache(t *testing.T) {
+	ctx := context.Background()
+	tc := NewTypedCache[typedUser](newTestMemory(t), nil)
+
+	if _, ok, err := tc.Get(ctx, "u1"); ok || err != nil {
+		t.Fatalf("Get on empty cache = %v, %v", ok, err)
+	}
+	if err := tc.Set(ctx, "u1", typedUser{1, "a"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	u, ok, err := tc.Get(ctx, "u1")
+	if err != nil || !ok || u.Name != "a" {
+		t.Fatalf("Get = %v, %v, %v", u, ok, err)
+	}
+
+	if err := tc.SetMulti(ctx, map[string]typedUser{"u2": {2, "b"}, "u3": {3, "c"}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	res, err := tc.GetMulti(ctx, []string{"u1", "u2", "u4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || res["u2"].ID != 2 {
+		t.Fatalf("GetMulti = %v", res)
+	}
+
+	if err := tc.Delete(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := tc.Get(ctx, "u1"); ok {
+		t.Fatal("u1 still present after Delete")
+	}
+}
+
+func TestTypedMemoryCacheWrongType(t *testing.T) {
+	bc := newTestMemory(t)
+	bc.Set("k", "string value", 0)
+
+	if _, _, err := NewTypedMemoryCache[int](bc).Get(context.Background(), "k"); err == nil {
+		t.Fatal("expected a type error")
+	}
+}
+
+func TestTypedLegacyCacheCodec(t *testing.T) {
+	ctx := context.Background()
+	for name, codec := range map[string]Codec{
+		"json":    JSONCodec{},
+		"gob":     GobCodec{},
+		"msgpack": MsgpackCodec{},
+	} {
+		tc := NewTypedLegacyCache[typedUser](newTestMemory(t), codec)
+		if err := tc.Set(ctx, "u", typedUser{7, "g"}, 0); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		u, ok, err := tc.Get(ctx, "u")
+		if err != nil || !ok || u != (typedUser{7, "g"}) {
+			t.Fatalf("%s: Get = %v, %v, %v", name, u, ok, err)
+		}
+	}
+}
+
+func TestTypedCacheCanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tc := NewTypedCache[int](newTestMemory(t), nil)
+	if err := tc.Set(ctx, "k", 1, 0); err != context.Canceled {
+		t.Fatalf("Set err = %v", err)
+	}
+}
@@ -1,95 +1,671 @@
 package cron
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	// ErrDispatcherClosed is returned for jobs submitted after Shutdown, and
+	// for queued jobs of a dispatcher shut down before Run.
+	ErrDispatcherClosed = errors.New("cron: dispatcher closed")
+	// ErrQueueFull is returned by TrySubmit and SubmitWithTimeout when the
+	// lane of the job has no room.
+	ErrQueueFull = errors.New("cron: job queue is full")
+)
+
+// DefaultIdleTimeout is how long a worker above the minimum count waits for
+// a job before it exits.
+var DefaultIdleTimeout = 30 * time.Second
+
+// Priority is the lane of a job. Workers take jobs from the highest lane
+// that has one.
+type Priority int
+
+// The lanes, from the last served to the first.
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities = 3
+)
+
+// Task is a job run by the workers of a Dispatcher.
 type Task interface {
 	Run() error
 }
 
+// ContextTask is a Task taking the context it was submitted with. Workers
+// call RunContext instead of Run when a task has it.
+type ContextTask interface {
+	RunContext(ctx context.Context) error
+}
+
+// TaskFunc adapts a func to a ContextTask.
+type TaskFunc func(ctx context.Context) error
+
+// Run calls f with a background context.
+func (f TaskFunc) Run() error { return f(context.Background()) }
+
+// RunContext calls f(ctx).
+func (f TaskFunc) RunContext(ctx context.Context) error { return f(ctx) }
+
+// TaskJob is a Task in the queue of a Dispatcher.
 type TaskJob struct {
 	Task Task
+
+	ctx    context.Context
+	future *Future
+	stats  *dispatcherStats
 }
 
+// run runs the task, recovering a panic into an error, and reports the
+// result to the future of the job.
+func (j TaskJob) run(logf func(string, ...interface{})) (err error) {
+	ctx := j.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if j.stats != nil {
+		atomic.AddInt64(&j.stats.inFlight, 1)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			logf("cron: panic running job: %v\n%s", r, buf)
+			err = fmt.Errorf("cron: panic running job: %v", r)
+		}
+		if j.stats != nil {
+			atomic.AddInt64(&j.stats.inFlight, -1)
+			atomic.AddUint64(&j.stats.completed, 1)
+			if err != nil {
+				atomic.AddUint64(&j.stats.failed, 1)
+			}
+		}
+		j.finish(err)
+	}()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t, ok := j.Task.(ContextTask); ok {
+		return t.RunContext(ctx)
+	}
+	return j.Task.Run()
+}
+
+func (j TaskJob) finish(err error) {
+	if j.future != nil {
+		j.future.err = err
+		close(j.future.done)
+	}
+}
+
+// Future is the result of a submitted job.
+type Future struct {
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the job returned, or was dropped.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the error of the job once Done is closed, nil before.
+func (f *Future) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Wait waits for the job and returns its error, or ctx.Err() when ctx is
+// done first.
+func (f *Future) Wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return f.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Worker runs the jobs it receives on TaskJobChannel, one at a time. The
+// workers of a dispatcher share that channel.
 type Worker struct {
+	// WorkerPool is where a worker of NewWorker offers its TaskJobChannel
+	// before each job.
+	//
+	// Deprecated: the workers of a dispatcher share their TaskJobChannel
+	// and leave WorkerPool nil.
 	WorkerPool     chan chan TaskJob
 	TaskJobChannel chan TaskJob
-	quit           chan bool
-}
+	ErrorLog       *log.Logger
+	// IdleTimeout is how long the worker waits for a job before asking its
+	// dispatcher whether it may exit, 0 means it never asks.
+	IdleTimeout time.Duration
 
-type Dispatcher struct {
-	WorkerPool   chan chan TaskJob
-	TaskJobQueue chan TaskJob
-	maxWorkers   int
+	retire func(*Worker) bool
+	quit   chan bool
+	done   chan struct{}
 }
 
+// NewWorker returns a worker offering its own TaskJobChannel to
+// workerPool before each job, like the workers of Dispatcher.WorkerPool.
+// Its channel may stay in workerPool when it stops, so stop it after the
+// dispatcher.
+//
+// Deprecated: a Dispatcher starts and stops its own workers.
 func NewWorker(workerPool chan chan TaskJob) Worker {
+	w := newWorker(make(chan TaskJob))
+	w.WorkerPool = workerPool
+	return w
+}
+
+// newWorker returns a worker taking its jobs from jobs.
+func newWorker(jobs chan TaskJob) Worker {
 	return Worker{
-		WorkerPool:     workerPool,
-		TaskJobChannel: make(chan TaskJob),
+		TaskJobChannel: jobs,
 		quit:           make(chan bool),
+		done:           make(chan struct{}),
 	}
 }
 
+// Start runs the worker in its own goroutine.
 func (w *Worker) Start() {
 	go func() {
+		defer close(w.done)
 		for {
-			w.WorkerPool <- w.TaskJobChannel
+			if w.WorkerPool != nil {
+				select {
+				case w.WorkerPool <- w.TaskJobChannel:
+				case <-w.quit:
+					return
+				}
+			}
+			var idle <-chan time.Time
+			var timer *time.Timer
+			if w.IdleTimeout > 0 && w.retire != nil {
+				timer = time.NewTimer(w.IdleTimeout)
+				idle = timer.C
+			}
 			select {
 			case taskJob := <-w.TaskJobChannel:
-				err := taskJob.Task.Run()
-				if err != nil {
-					log.Println(err)
+				if timer != nil {
+					timer.Stop()
+				}
+				if err := taskJob.run(w.logf); err != nil {
+					w.logf("cron: job: %v", err)
+				}
+			case <-idle:
+				if w.retire(w) {
+					return
 				}
 			case <-w.quit:
+				if timer != nil {
+					timer.Stop()
+				}
 				return
 			}
 		}
 	}()
 }
 
+// Stop stops the worker, waiting for its running job to return.
 func (w *Worker) Stop() {
-	go func() {
-		w.quit <- true
-	}()
+	select {
+	case w.quit <- true:
+	case <-w.done:
+	}
+	<-w.done
+}
+
+func (w *Worker) logf(format string, args ...interface{}) {
+	if w.ErrorLog != nil {
+		w.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// DispatcherOption configures NewDispatcher.
+type DispatcherOption func(*Dispatcher)
+
+// WithMinWorkers lets the dispatcher shrink to min workers when idle, and
+// grow to its max workers when jobs wait. Without it, the worker count is
+// fixed at max.
+func WithMinWorkers(min int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.minWorkers = min
+	}
+}
+
+// WithIdleTimeout sets how long a worker above the minimum count stays idle
+// before it exits, DefaultIdleTimeout by default.
+func WithIdleTimeout(timeout time.Duration) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.idleTimeout = timeout
+	}
+}
+
+// WithRateLimit starts at most perSecond jobs a second, in bursts of up to
+// burst jobs.
+func WithRateLimit(perSecond float64, burst int) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.limiter = newTokenBucket(perSecond, burst, time.Now())
+	}
 }
 
-func NewDispatcher(maxWorker, maxQueue int) *Dispatcher {
-	pool := make(chan chan TaskJob, maxWorker)
-	return &Dispatcher{
-		WorkerPool:   pool,
-		maxWorkers:   maxWorker,
-		TaskJobQueue: make(chan TaskJob, maxQueue),
+// DispatcherStats is a snapshot of the counters of a Dispatcher.
+type DispatcherStats struct {
+	// Queued is the number of jobs waiting, by Priority.
+	Queued    [numPriorities]int
+	InFlight  int64
+	Workers   int
+	Submitted uint64
+	Completed uint64
+	Failed    uint64
+	Rejected  uint64
+}
+
+// QueueLen returns the number of jobs waiting in all lanes.
+func (s DispatcherStats) QueueLen() int {
+	var n int
+	for _, q := range s.Queued {
+		n += q
 	}
+	return n
 }
 
+type dispatcherStats struct {
+	inFlight  int64
+	submitted uint64
+	completed uint64
+	failed    uint64
+	rejected  uint64
+}
+
+// Dispatcher queues jobs in priority lanes and hands them to a pool of
+// workers.
+type Dispatcher struct {
+	stats dispatcherStats // first, for the alignment of its atomics
+
+	// WorkerPool takes the TaskJobChannel of the workers of NewWorker, the
+	// dispatcher hands them jobs too.
+	//
+	// Deprecated: the dispatcher starts its own workers, see
+	// WithMinWorkers.
+	WorkerPool chan chan TaskJob
+	// TaskJobQueue is the lane of PriorityNormal, use Submit to queue jobs.
+	TaskJobQueue chan TaskJob
+	ErrorLog     *log.Logger
+
+	lanes       [numPriorities]chan TaskJob
+	work        chan TaskJob
+	maxWorkers  int
+	minWorkers  int
+	idleTimeout time.Duration
+	limiter     *tokenBucket
+
+	mu      sync.RWMutex
+	closed  bool
+	closing chan struct{} // closed by Shutdown, ends the waits of submit
+	senders sync.WaitGroup
+	started bool
+	handing bool // a job waits in hand for a worker
+	workers map[*Worker]struct{}
+	done    chan struct{}
+}
+
+// NewDispatcher returns a dispatcher of maxWorker workers queueing up to
+// maxQueue jobs in each priority lane.
+func NewDispatcher(maxWorker, maxQueue int, opts ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
+		work:        make(chan TaskJob),
+		maxWorkers:  maxWorker,
+		minWorkers:  maxWorker,
+		idleTimeout: DefaultIdleTimeout,
+		closing:     make(chan struct{}),
+		workers:     make(map[*Worker]struct{}),
+		done:        make(chan struct{}),
+	}
+	for i := range d.lanes {
+		d.lanes[i] = make(chan TaskJob, maxQueue)
+	}
+	d.TaskJobQueue = d.lanes[PriorityNormal]
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.maxWorkers < 1 {
+		d.maxWorkers = 1
+	}
+	d.WorkerPool = make(chan chan TaskJob, d.maxWorkers)
+	if d.minWorkers > d.maxWorkers {
+		d.minWorkers = d.maxWorkers
+	}
+	if d.minWorkers < 0 {
+		d.minWorkers = 0
+	}
+	return d
+}
+
+// AddJob queues t, waiting while the queue is full. Jobs added after
+// Shutdown are dropped.
 func (d *Dispatcher) AddJob(t Task) {
-	job := TaskJob{
-		Task: t,
+	if _, err := d.Submit(context.Background(), t); err != nil {
+		d.logf("cron: add job: %v", err)
+	}
+}
+
+// Submit queues t with PriorityNormal, waiting while the queue is full, and
+// returns the future of its result. ctx is given to t when it is a
+// ContextTask, and a job whose ctx is done before it starts is not run.
+func (d *Dispatcher) Submit(ctx context.Context, t Task) (*Future, error) {
+	return d.submit(ctx, PriorityNormal, t, nil, true)
+}
+
+// SubmitPriority queues t in the lane of p, like Submit.
+func (d *Dispatcher) SubmitPriority(ctx context.Context, p Priority, t Task) (*Future, error) {
+	return d.submit(ctx, p, t, nil, true)
+}
+
+// TrySubmit queues t in the lane of p, or returns ErrQueueFull at once when
+// the lane is full.
+func (d *Dispatcher) TrySubmit(ctx context.Context, p Priority, t Task) (*Future, error) {
+	return d.submit(ctx, p, t, nil, false)
+}
+
+// SubmitWithTimeout queues t in the lane of p, waiting up to timeout for
+// room before it returns ErrQueueFull.
+func (d *Dispatcher) SubmitWithTimeout(ctx context.Context, p Priority, t Task, timeout time.Duration) (*Future, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	return d.submit(ctx, p, t, timer.C, true)
+}
+
+func (d *Dispatcher) submit(ctx context.Context, p Priority, t Task, timeout <-chan time.Time, wait bool) (*Future, error) {
+	if p < PriorityLow || p > PriorityHigh {
+		return nil, fmt.Errorf("cron: invalid priority %d", p)
+	}
+	// The lock is not held while waiting for room, the dispatch loop takes
+	// it to start workers. Shutdown closes the lanes once the senders left.
+	d.mu.RLock()
+	if d.closed {
+		d.mu.RUnlock()
+		return nil, ErrDispatcherClosed
+	}
+	d.senders.Add(1)
+	d.mu.RUnlock()
+	defer d.senders.Done()
+
+	job := TaskJob{Task: t, ctx: ctx, future: &Future{done: make(chan struct{})}, stats: &d.stats}
+	lane := d.lanes[p]
+	select {
+	case lane <- job:
+		atomic.AddUint64(&d.stats.submitted, 1)
+		return job.future, nil
+	default:
 	}
-	d.TaskJobQueue <- job
+	if !wait {
+		atomic.AddUint64(&d.stats.rejected, 1)
+		return nil, ErrQueueFull
+	}
+	select {
+	case lane <- job:
+		atomic.AddUint64(&d.stats.submitted, 1)
+		return job.future, nil
+	case <-timeout:
+		atomic.AddUint64(&d.stats.rejected, 1)
+		return nil, ErrQueueFull
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.closing:
+		return nil, ErrDispatcherClosed
+	}
+}
+
+// Stats returns the queue lengths, in-flight jobs and counters.
+func (d *Dispatcher) Stats() DispatcherStats {
+	var s DispatcherStats
+	for i, lane := range d.lanes {
+		s.Queued[i] = len(lane)
+	}
+	d.mu.RLock()
+	s.Workers = len(d.workers)
+	d.mu.RUnlock()
+	s.InFlight = atomic.LoadInt64(&d.stats.inFlight)
+	s.Submitted = atomic.LoadUint64(&d.stats.submitted)
+	s.Completed = atomic.LoadUint64(&d.stats.completed)
+	s.Failed = atomic.LoadUint64(&d.stats.failed)
+	s.Rejected = atomic.LoadUint64(&d.stats.rejected)
+	return s
 }
 
+// Run starts the workers and the dispatch loop.
 func (d *Dispatcher) Run() {
-	for i := 0; i < d.maxWorkers; i++ {
-		w := NewWorker(d.WorkerPool)
-		w.Start()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started || d.closed {
+		return
+	}
+	d.started = true
+	for i := 0; i < d.minWorkers; i++ {
+		d.startWorkerLocked()
 	}
 	d.dispatcher()
 }
 
+func (d *Dispatcher) startWorkerLocked() {
+	w := newWorker(d.work)
+	w.ErrorLog = d.ErrorLog
+	if d.minWorkers < d.maxWorkers {
+		w.IdleTimeout = d.idleTimeout
+		w.retire = d.retire
+	}
+	d.workers[&w] = struct{}{}
+	w.Start()
+}
+
+// retire lets an idle worker exit while there are more than the minimum.
+// The last worker stays while hand waits for one.
+func (d *Dispatcher) retire(w *Worker) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.workers) <= d.minWorkers || d.handing && len(d.workers) <= 1 {
+		return false
+	}
+	delete(d.workers, w)
+	return true
+}
+
 func (d *Dispatcher) dispatcher() {
 	go func() {
+		defer close(d.done)
+		lanes := d.lanes
 		for {
+			taskJob, ok := nextJob(&lanes)
+			if !ok {
+				return
+			}
+			if d.limiter != nil {
+				if wait := d.limiter.take(time.Now()); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+			d.hand(taskJob)
+		}
+	}()
+}
+
+// hand gives taskJob to an idle worker, starting one when none is idle and
+// the pool may grow.
+func (d *Dispatcher) hand(taskJob TaskJob) {
+	select {
+	case d.work <- taskJob:
+		return
+	case jobs := <-d.WorkerPool:
+		jobs <- taskJob
+		return
+	default:
+	}
+	d.mu.Lock()
+	if len(d.workers) < d.maxWorkers {
+		d.startWorkerLocked()
+	}
+	d.handing = true
+	d.mu.Unlock()
+	select {
+	case d.work <- taskJob:
+	case jobs := <-d.WorkerPool:
+		jobs <- taskJob
+	}
+	d.mu.Lock()
+	d.handing = false
+	d.mu.Unlock()
+}
+
+// nextJob takes a job from the highest lane that has one, or waits for the
+// first to come. Closed lanes are set to nil, and it returns false once all
+// lanes are closed and empty.
+func nextJob(lanes *[numPriorities]chan TaskJob) (TaskJob, bool) {
+	for {
+		open := false
+		for p := numPriorities - 1; p >= 0; p-- {
+			if lanes[p] == nil {
+				continue
+			}
 			select {
-			case taskJob := <-d.TaskJobQueue:
-				go func(taskJob TaskJob) {
-					taskJobChan := <-d.WorkerPool
-					taskJobChan <- taskJob
-				}(taskJob)
+			case taskJob, ok := <-lanes[p]:
+				if ok {
+					return taskJob, true
+				}
+				lanes[p] = nil
+				continue
+			default:
+			}
+			open = true
+		}
+		if !open {
+			return TaskJob{}, false
+		}
+
+		var (
+			taskJob TaskJob
+			ok      bool
+			p       Priority
+		)
+		select {
+		case taskJob, ok = <-lanes[PriorityHigh]:
+			p = PriorityHigh
+		case taskJob, ok = <-lanes[PriorityNormal]:
+			p = PriorityNormal
+		case taskJob, ok = <-lanes[PriorityLow]:
+			p = PriorityLow
+		}
+		if ok {
+			return taskJob, true
+		}
+		lanes[p] = nil
+	}
+}
+
+// Shutdown stops taking jobs, runs the queued ones and waits for the
+// workers to return, or for ctx to be done, in which case it returns
+// ctx.Err() and the jobs carry on in the background.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	closing := !d.closed
+	if closing {
+		d.closed = true
+		close(d.closing)
+	}
+	started := d.started
+	d.mu.Unlock()
+	if closing {
+		d.senders.Wait()
+		for _, lane := range d.lanes {
+			close(lane)
+		}
+	}
+
+	if !started {
+		for _, lane := range d.lanes {
+			for taskJob := range lane {
+				taskJob.finish(ErrDispatcherClosed)
 			}
 		}
+		return nil
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		<-d.done
+		d.mu.Lock()
+		workers := make([]*Worker, 0, len(d.workers))
+		for w := range d.workers {
+			workers = append(workers, w)
+		}
+		d.minWorkers = 0
+		d.mu.Unlock()
+		for _, w := range workers {
+			w.Stop()
+		}
+		close(finished)
 	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+func (d *Dispatcher) logf(format string, args ...interface{}) {
+	if d.ErrorLog != nil {
+		d.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// tokenBucket allows rate starts a second, in bursts of up to burst. It is
+// only used by the dispatch loop.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take takes a token at now and returns how long to wait for it.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
 }
@@ -0,0 +1,293 @@
+package cron
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatcherShutdownDrains(t *testing.T) {
+	d := NewDispatcher(2, 10)
+	d.ErrorLog = log.New(io.Discard, "", 0)
+	d.Run()
+
+	var ran int32
+	var futures []*Future
+	for i := 0; i < 8; i++ {
+		f, err := d.Submit(context.Background(), TaskFunc(func(ctx context.Context) error {
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		futures = append(futures, f)
+	}
+	if err := d.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 8 {
+		t.Fatalf("ran %d of 8 jobs", ran)
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+		default:
+			t.Fatal("future not done after Shutdown")
+		}
+	}
+	if _, err := d.Submit(context.Background(), TaskFunc(func(context.Context) error { return nil })); err != ErrDispatcherClosed {
+		t.Fatalf("Submit after Shutdown = %v", err)
+	}
+}
+
+func TestDispatcherResults(t *testing.T) {
+	d := NewDispatcher(1, 1)
+	d.ErrorLog = log.New(io.Discard, "", 0)
+	d.Run()
+	defer d.Shutdown(context.Background())
+	ctx := context.Background()
+
+	boom := errors.New("boom")
+	f, _ := d.Submit(ctx, TaskFunc(func(context.Context) error { return boom }))
+	if err := f.Wait(ctx); err != boom {
+		t.Fatalf("Wait = %v", err)
+	}
+
+	f, _ = d.Submit(ctx, TaskFunc(func(context.Context) error { panic("oops") }))
+	if err := f.Wait(ctx); err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Fatalf("Wait after panic = %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	f, err := d.Submit(cancelled, TaskFunc(func(context.Context) error { return nil }))
+	if err == nil {
+		if err = f.Wait(ctx); err != context.Canceled {
+			t.Fatalf("Wait of a cancelled job = %v", err)
+		}
+	}
+}
+
+func TestDispatcherPriority(t *testing.T) {
+	d := NewDispatcher(1, 10)
+	d.ErrorLog = log.New(io.Discard, "", 0)
+	ctx := context.Background()
+
+	var order []string
+	record := func(name string) Task {
+		return TaskFunc(func(context.Context) error {
+			order = append(order, name)
+			return nil
+		})
+	}
+	d.SubmitPriority(ctx, PriorityLow, record("low"))
+	d.SubmitPriority(ctx, PriorityNormal, record("normal"))
+	d.SubmitPriority(ctx, PriorityHigh, record("high"))
+	if s := d.Stats(); s.QueueLen() != 3 || s.Submitted != 3 {
+		t.Fatalf("stats %+v", s)
+	}
+	d.Run()
+	d.Shutdown(ctx)
+	if strings.Join(order, ",") != "high,normal,low" {
+		t.Fatalf("ran %v", order)
+	}
+}
+
+func TestDispatcherBackpressure(t *testing.T) {
+	d := NewDispatcher(1, 1)
+	ctx := context.Background()
+	noop := TaskFunc(func(context.Context) error { return nil })
+	if _, err := d.TrySubmit(ctx, PriorityNormal, noop); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.TrySubmit(ctx, PriorityNormal, noop); err != ErrQueueFull {
+		t.Fatalf("TrySubmit on a full lane = %v", err)
+	}
+	if _, err := d.SubmitWithTimeout(ctx, PriorityNormal, noop, 10*time.Millisecond); err != ErrQueueFull {
+		t.Fatalf("SubmitWithTimeout on a full lane = %v", err)
+	}
+	if _, err := d.TrySubmit(ctx, PriorityHigh, noop); err != nil {
+		t.Fatalf("other lanes are not full: %v", err)
+	}
+	if s := d.Stats(); s.Rejected != 2 {
+		t.Fatalf("stats %+v", s)
+	}
+	d.Shutdown(ctx)
+}
+
+func TestDispatcherScales(t *testing.T) {
+	d := NewDispatcher(4, 10, WithMinWorkers(1), WithIdleTimeout(20*time.Millisecond))
+	d.ErrorLog = log.New(io.Discard, "", 0)
+	d.Run()
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	var futures []*Future
+	for i := 0; i < 4; i++ {
+		f, _ := d.Submit(ctx, TaskFunc(func(context.Context) error {
+			<-release
+			return nil
+		}))
+		futures = append(futures, f)
+	}
+	deadline := time.Now().Add(time.Second)
+	for d.Stats().InFlight != 4 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stats %+v", d.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for _, f := range futures {
+		f.Wait(ctx)
+	}
+	for d.Stats().Workers != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("workers did not shrink: %+v", d.Stats())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	d.Shutdown(ctx)
+}
+
+func TestDispatcherLastWorkerStays(t *testing.T) {
+	d := NewDispatcher(1, 10, WithMinWorkers(0), WithIdleTimeout(time.Millisecond))
+	d.ErrorLog = log.New(io.Discard, "", 0)
+	d.Run()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		d.Shutdown(ctx)
+	}()
+
+	// the only worker often times out while the next job waits for it
+	for i := 0; i < 200; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		f, err := d.Submit(ctx, TaskFunc(func(context.Context) error {
+			time.Sleep(time.Duration(i%3) * time.Millisecond)
+			return nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.Wait(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+		time.Sleep(time.Duration(i%2) * time.Millisecond)
+	}
+}
+
+func TestDispatcherSubmitWhileFull(t *testing.T) {
+	d := NewDispatcher(1, 1)
+	d.ErrorLog = log.New(io.Discard, "", 0)
+	d.Run()
+	ctx := context.Background()
+
+	// submitters wait on the full lane while the dispatch loop hands the
+	// jobs out, which must not wait for them
+	var wg sync.WaitGroup
+	var ran int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, err := d.Submit(ctx, TaskFunc(func(context.Context) error {
+				time.Sleep(50 * time.Millisecond)
+				atomic.AddInt32(&ran, 1)
+				return nil
+			}))
+			if err == nil {
+				f.Wait(ctx)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("submitters hang")
+	}
+	if ran != 5 {
+		t.Fatalf("ran %d of 5 jobs", ran)
+	}
+
+	// Shutdown ends the wait of a blocked submitter
+	block := make(chan struct{})
+	d.Submit(ctx, TaskFunc(func(context.Context) error { <-block; return nil }))
+	for d.Stats().InFlight != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// one job waits for the worker in the dispatch loop, one in the lane
+	for i := 0; i < 2; i++ {
+		d.Submit(ctx, TaskFunc(func(context.Context) error { return nil }))
+	}
+	errc := make(chan error, 1)
+	go func() {
+		_, err := d.Submit(ctx, TaskFunc(func(context.Context) error { return nil }))
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go d.Shutdown(ctx)
+	select {
+	case err := <-errc:
+		if err != ErrDispatcherClosed {
+			t.Fatalf("Submit during Shutdown = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not end the wait of Submit")
+	}
+	close(block)
+}
+
+func TestDispatcherWorkerPool(t *testing.T) {
+	d := NewDispatcher(1, 10)
+	d.ErrorLog = log.New(io.Discard, "", 0)
+	d.Run()
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	d.Submit(ctx, TaskFunc(func(context.Context) error { <-release; return nil }))
+	for d.Stats().InFlight != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	// a worker of NewWorker takes the jobs the dispatcher's own cannot
+	w := NewWorker(d.WorkerPool)
+	w.ErrorLog = d.ErrorLog
+	w.Start()
+	f, _ := d.Submit(ctx, TaskFunc(func(context.Context) error { return nil }))
+	wctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := f.Wait(wctx); err != nil {
+		t.Fatalf("job for the pool worker: %v", err)
+	}
+	close(release)
+	d.Shutdown(ctx)
+	w.Stop()
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 2, now)
+	for i, want := range []time.Duration{0, 0, 100 * time.Millisecond, 200 * time.Millisecond} {
+		if got := b.take(now); got != want {
+			t.Fatalf("take %d = %v, want %v", i, got, want)
+		}
+	}
+	if got := b.take(now.Add(time.Second)); got != 0 {
+		t.Fatalf("take after refill = %v", got)
+	}
+}
@@ -0,0 +1,449 @@
+package cron
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/fromiuan/goutils/lib/store/redis"
+)
+
+var (
+	// DefaultQueuePrefix prefixes the redis keys of RedisQueue
+	DefaultQueuePrefix = "cron:queue:"
+	// DefaultVisibility is how long a reserved job stays hidden from other
+	// consumers before it is handed out again
+	DefaultVisibility = time.Minute
+	// DefaultMaxAttempts is how many times a job runs before it goes to
+	// the dead letter list
+	DefaultMaxAttempts = 5
+
+	// ErrJobLost is returned by Ack and Nack when the reservation of the
+	// job expired, so the job may be running elsewhere
+	ErrJobLost = errors.New("cron: job reservation lost")
+	// ErrNoHandler is the error of jobs whose type has no handler
+	ErrNoHandler = errors.New("cron: no handler for job type")
+)
+
+// QueueJob is a message of a RedisQueue
+type QueueJob struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Payload    []byte    `json:"payload"`
+	EnqueuedAt time.Time `json:"enqueued_at"`
+	LastError  string    `json:"last_error,omitempty"`
+	// Attempts counts the reservations of the job, this one included
+	Attempts int `json:"-"`
+}
+
+// The queue keeps the jobs in a hash by id, the ids of the jobs ready to
+// run in a list, those waiting for their time in a sorted set by run time
+// and the reserved ones in a sorted set by visibility deadline. All keys
+// share a hash tag so the scripts also run on a redis cluster.
+const (
+	enqueueScript = `
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])
+else
+	redis.call('LPUSH', KEYS[2], ARGV[1])
+end
+return 1
+`
+	reserveScript = `
+local due = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, id in ipairs(due) do
+	redis.call('ZREM', KEYS[3], id)
+	redis.call('LPUSH', KEYS[2], id)
+end
+local expired = redis.call('ZRANGEBYSCORE', KEYS[4], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[4], id)
+	redis.call('RPUSH', KEYS[2], id)
+end
+while true do
+	local id = redis.call('RPOP', KEYS[2])
+	if not id then
+		return false
+	end
+	local job = redis.call('HGET', KEYS[1], id)
+	if job then
+		redis.call('ZADD', KEYS[4], ARGV[2], id)
+		local n = redis.call('HINCRBY', KEYS[5], id, 1)
+		return {id, job, n}
+	end
+end
+`
+	ackScript = `
+if redis.call('ZREM', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1
+`
+	nackScript = `
+if redis.call('ZREM', KEYS[2], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+local n = tonumber(redis.call('HGET', KEYS[5], ARGV[1]) or '0')
+if tonumber(ARGV[4]) > 0 and n >= tonumber(ARGV[4]) then
+	redis.call('LPUSH', KEYS[4], ARGV[1])
+	return 2
+end
+redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])
+return 1
+`
+	releaseScript = `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HINCRBY', KEYS[3], ARGV[1], -1)
+redis.call('RPUSH', KEYS[2], ARGV[1])
+return 1
+`
+)
+
+// RedisQueue is a durable job queue on redis. A reserved job must be
+// acked before its visibility timeout, or it is handed out again, so
+// handlers run at least once and should be idempotent.
+type RedisQueue struct {
+	Redis       redis.Doer
+	Name        string
+	Prefix      string
+	Visibility  time.Duration
+	MaxAttempts int
+	// Now is the clock of delays and deadlines, defaults to time.Now
+	Now func() time.Time
+}
+
+// NewRedisQueue create the queue name running its commands on r, a
+// *redis.Client of lib/store/redis for example
+func NewRedisQueue(r redis.Doer, name string) *RedisQueue {
+	return &RedisQueue{
+		Redis:       r,
+		Name:        name,
+		Prefix:      DefaultQueuePrefix,
+		Visibility:  DefaultVisibility,
+		MaxAttempts: DefaultMaxAttempts,
+	}
+}
+
+func (q *RedisQueue) key(suffix string) string {
+	return q.Prefix + "{" + q.Name + "}:" + suffix
+}
+
+func (q *RedisQueue) now() time.Time {
+	if q.Now != nil {
+		return q.Now()
+	}
+	return time.Now()
+}
+
+// Enqueue adds a job of type typ, to run after delay, and returns its id
+func (q *RedisQueue) Enqueue(ctx context.Context, typ string, payload []byte, delay time.Duration) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	now := q.now()
+	job := &QueueJob{ID: hex.EncodeToString(b), Type: typ, Payload: payload, EnqueuedAt: now}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return "", err
+	}
+	var runAt int64
+	if delay > 0 {
+		runAt = now.Add(delay).UnixMilli()
+	}
+	_, err = q.Redis.Do(ctx, "EVAL", enqueueScript, 3, q.key("jobs"), q.key("ready"), q.key("delayed"),
+		job.ID, data, runAt)
+	if err != nil {
+		return "", err
+	}
+	return job.ID, nil
+}
+
+// Reserve takes the next job ready to run and hides it for Visibility, it
+// returns nil when there is none
+func (q *RedisQueue) Reserve(ctx context.Context) (*QueueJob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	now := q.now()
+	reply, err := q.Redis.Do(ctx, "EVAL", reserveScript, 5,
+		q.key("jobs"), q.key("ready"), q.key("delayed"), q.key("inflight"), q.key("attempts"),
+		now.UnixMilli(), now.Add(q.visibility()).UnixMilli(), 100)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 3 {
+		return nil, fmt.Errorf("cron: unexpected redis reply %v", reply)
+	}
+	job := new(QueueJob)
+	if err := json.Unmarshal(replyBytes(values[1]), job); err != nil {
+		return nil, err
+	}
+	n, _ := values[2].(int64)
+	job.Attempts = int(n)
+	return job, nil
+}
+
+// Ack removes a job that ran
+func (q *RedisQueue) Ack(ctx context.Context, job *QueueJob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reply, err := q.Redis.Do(ctx, "EVAL", ackScript, 3, q.key("jobs"), q.key("inflight"), q.key("attempts"), job.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrJobLost
+	}
+	return nil
+}
+
+// Nack records the failure of a job and runs it again after delay, or moves
+// it to the dead letter list once it ran MaxAttempts times, in which case
+// dead is true
+func (q *RedisQueue) Nack(ctx context.Context, job *QueueJob, delay time.Duration, cause error) (dead bool, err error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if cause != nil {
+		job.LastError = cause.Error()
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return false, err
+	}
+	reply, err := q.Redis.Do(ctx, "EVAL", nackScript, 5,
+		q.key("jobs"), q.key("inflight"), q.key("delayed"), q.key("dead"), q.key("attempts"),
+		job.ID, data, q.now().Add(delay).UnixMilli(), q.MaxAttempts)
+	if err != nil {
+		return false, err
+	}
+	switch n, _ := reply.(int64); n {
+	case 0:
+		return false, ErrJobLost
+	case 2:
+		return true, nil
+	}
+	return false, nil
+}
+
+// Release hands back a reserved job that did not run, it is the next one
+// reserved and the reservation does not count as an attempt
+func (q *RedisQueue) Release(ctx context.Context, job *QueueJob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	reply, err := q.Redis.Do(ctx, "EVAL", releaseScript, 3, q.key("inflight"), q.key("ready"), q.key("attempts"), job.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrJobLost
+	}
+	return nil
+}
+
+// DeadJobs returns the jobs of the dead letter list, the last one first
+func (q *RedisQueue) DeadJobs(ctx context.Context) ([]*QueueJob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	reply, err := q.Redis.Do(ctx, "LRANGE", q.key("dead"), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	ids, _ := reply.([]interface{})
+	jobs := make([]*QueueJob, 0, len(ids))
+	for _, id := range ids {
+		data, err := q.Redis.Do(ctx, "HGET", q.key("jobs"), id)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		job := new(QueueJob)
+		if err := json.Unmarshal(replyBytes(data), job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (q *RedisQueue) visibility() time.Duration {
+	if q.Visibility > 0 {
+		return q.Visibility
+	}
+	return DefaultVisibility
+}
+
+func replyBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
+
+// JobHandler handles the jobs of one type
+type JobHandler func(ctx context.Context, job *QueueJob) error
+
+// Registry maps job types to their handler
+type Registry struct {
+	mu       sync.RWMutex
+	handlers map[string]JobHandler
+}
+
+// NewRegistry create an empty registry
+func NewRegistry() *Registry {
+	return &Registry{handlers: make(map[string]JobHandler)}
+}
+
+// Register sets the handler of typ
+func (r *Registry) Register(typ string, h JobHandler) {
+	r.mu.Lock()
+	r.handlers[typ] = h
+	r.mu.Unlock()
+}
+
+// Handler returns the handler of typ
+func (r *Registry) Handler(typ string) (JobHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.handlers[typ]
+	return h, ok
+}
+
+// QueueConsumer reserves the jobs of a RedisQueue and runs their handler on
+// the workers of a Dispatcher. A job waiting for a worker counts against
+// its visibility timeout, so keep the dispatcher queue short.
+type QueueConsumer struct {
+	Queue      *RedisQueue
+	Registry   *Registry
+	Dispatcher *Dispatcher
+	// PollInterval is the wait when the queue is empty
+	PollInterval time.Duration
+	// Backoff is the delay before a failed job runs again, by attempt
+	Backoff  func(attempt int) time.Duration
+	ErrorLog *log.Logger
+}
+
+// NewQueueConsumer create a consumer of q running the handlers of r on d
+func NewQueueConsumer(q *RedisQueue, r *Registry, d *Dispatcher) *QueueConsumer {
+	return &QueueConsumer{
+		Queue:        q,
+		Registry:     r,
+		Dispatcher:   d,
+		PollInterval: time.Second,
+		Backoff:      ExponentialBackoff(time.Second, time.Hour),
+	}
+}
+
+// ExponentialBackoff doubles the delay from base with every attempt, up to
+// max
+func ExponentialBackoff(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// Run consumes the queue until ctx is done
+func (c *QueueConsumer) Run(ctx context.Context) error {
+	for {
+		job, err := c.Queue.Reserve(ctx)
+		if err != nil && ctx.Err() == nil {
+			c.logf("cron: reserve from %s: %v", c.Queue.Name, err)
+		}
+		if job == nil {
+			select {
+			case <-time.After(c.PollInterval):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		_, err = c.Dispatcher.Submit(ctx, TaskFunc(func(jobCtx context.Context) error {
+			return c.handle(jobCtx, job)
+		}))
+		if err != nil {
+			// hand it back at once rather than at the end of its visibility
+			if rerr := c.Queue.Release(context.Background(), job); rerr != nil {
+				c.logf("cron: release job %s: %v", job.ID, rerr)
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+}
+
+func (c *QueueConsumer) handle(ctx context.Context, job *QueueJob) error {
+	if job.Attempts > c.Queue.MaxAttempts && c.Queue.MaxAttempts > 0 {
+		// ran out of attempts by visibility timeouts
+		_, err := c.Queue.Nack(ctx, job, 0, errors.New("cron: visibility timeout"))
+		return err
+	}
+	var err error
+	if h, ok := c.Registry.Handler(job.Type); ok {
+		hctx, cancel := context.WithTimeout(ctx, c.Queue.visibility())
+		err = h(hctx, job)
+		cancel()
+	} else {
+		err = fmt.Errorf("%w %s", ErrNoHandler, job.Type)
+	}
+
+	ackCtx := context.Background()
+	if err == nil {
+		if aerr := c.Queue.Ack(ackCtx, job); aerr != nil {
+			c.logf("cron: ack job %s: %v", job.ID, aerr)
+		}
+		return nil
+	}
+	var delay time.Duration
+	if c.Backoff != nil {
+		delay = c.Backoff(job.Attempts)
+	}
+	dead, nerr := c.Queue.Nack(ackCtx, job, delay, err)
+	if nerr != nil {
+		c.logf("cron: nack job %s: %v", job.ID, nerr)
+	} else if dead {
+		c.logf("cron: job %s of type %s is dead after %d attempts: %v", job.ID, job.Type, job.Attempts, err)
+	}
+	return err
+}
+
+func (c *QueueConsumer) logf(format string, args ...interface{}) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,168 @@
+package cron
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/fromiuan/goutils/lib/store/redis"
+	redigo "github.com/gomodule/redigo/redis"
+)
+
+// newTestQueue returns the queue name on a fresh miniredis, which runs the
+// queue scripts with its own lua interpreter.
+func newTestQueue(t *testing.T, name string) (*RedisQueue, *miniredis.Miniredis) {
+	t.Helper()
+	s := miniredis.RunT(t)
+	pool := &redigo.Pool{Dial: func() (redigo.Conn, error) { return redigo.Dial("tcp", s.Addr()) }}
+	c := redis.NewClient(pool)
+	t.Cleanup(func() { c.Close() })
+	return NewRedisQueue(c, name), s
+}
+
+func TestRedisQueue(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	q, _ := newTestQueue(t, "mail")
+	q.Now = func() time.Time { return now }
+	q.MaxAttempts = 2
+
+	later, _ := q.Enqueue(ctx, "send", []byte("later"), 30*time.Minute)
+	first, _ := q.Enqueue(ctx, "send", []byte("first"), 0)
+
+	job, err := q.Reserve(ctx)
+	if err != nil || job == nil || job.ID != first || string(job.Payload) != "first" || job.Attempts != 1 {
+		t.Fatalf("Reserve = %+v, %v", job, err)
+	}
+	if next, _ := q.Reserve(ctx); next != nil {
+		t.Fatalf("delayed job reserved early: %+v", next)
+	}
+
+	// the reservation expires and the job is handed out again
+	now = now.Add(2 * DefaultVisibility)
+	again, _ := q.Reserve(ctx)
+	if again == nil || again.ID != first || again.Attempts != 2 {
+		t.Fatalf("Reserve after visibility = %+v", again)
+	}
+	if err := q.Ack(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(ctx, job); err != ErrJobLost {
+		t.Fatalf("second Ack = %v", err)
+	}
+
+	now = now.Add(30 * time.Minute)
+	job, _ = q.Reserve(ctx)
+	if job == nil || job.ID != later {
+		t.Fatalf("Reserve of the delayed job = %+v", job)
+	}
+	if dead, err := q.Nack(ctx, job, time.Minute, errors.New("smtp down")); dead || err != nil {
+		t.Fatalf("Nack = %v, %v", dead, err)
+	}
+	now = now.Add(time.Minute)
+	job, _ = q.Reserve(ctx)
+	if job == nil || job.LastError != "smtp down" || job.Attempts != 2 {
+		t.Fatalf("Reserve after Nack = %+v", job)
+	}
+	if dead, err := q.Nack(ctx, job, time.Minute, errors.New("smtp still down")); !dead || err != nil {
+		t.Fatalf("last Nack = %v, %v", dead, err)
+	}
+	jobs, err := q.DeadJobs(ctx)
+	if err != nil || len(jobs) != 1 || jobs[0].ID != later || jobs[0].LastError != "smtp still down" {
+		t.Fatalf("DeadJobs = %+v, %v", jobs, err)
+	}
+}
+
+func TestRedisQueueReserveLimit(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	q, s := newTestQueue(t, "bulk")
+	q.Now = func() time.Time { return now }
+
+	for i := 0; i < 150; i++ {
+		if _, err := q.Enqueue(ctx, "send", []byte(fmt.Sprint(i)), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(time.Minute)
+	if job, err := q.Reserve(ctx); job == nil || err != nil {
+		t.Fatalf("Reserve = %+v, %v", job, err)
+	}
+	// one Reserve moves at most 100 due jobs to the ready list
+	delayed, _ := s.ZMembers(q.key("delayed"))
+	ready, _ := s.List(q.key("ready"))
+	if len(delayed) != 50 || len(ready) != 99 {
+		t.Fatalf("%d delayed and %d ready jobs", len(delayed), len(ready))
+	}
+}
+
+func TestQueueConsumer(t *testing.T) {
+	q, _ := newTestQueue(t, "work")
+	d := NewDispatcher(2, 4)
+	d.ErrorLog = log.New(io.Discard, "", 0)
+	d.Run()
+	defer d.Shutdown(context.Background())
+
+	done := make(chan string, 3)
+	r := NewRegistry()
+	r.Register("echo", func(ctx context.Context, job *QueueJob) error {
+		if job.Attempts == 1 && string(job.Payload) == "flaky" {
+			return errors.New("first try fails")
+		}
+		done <- string(job.Payload)
+		return nil
+	})
+	c := NewQueueConsumer(q, r, d)
+	c.PollInterval = time.Millisecond
+	c.Backoff = func(int) time.Duration { return 0 }
+	c.ErrorLog = log.New(io.Discard, "", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+	for _, p := range []string{"a", "flaky", "b"} {
+		q.Enqueue(ctx, "echo", []byte(p), 0)
+	}
+	q.Enqueue(ctx, "unknown", nil, 0)
+
+	got := map[string]bool{}
+	for len(got) < 3 {
+		select {
+		case p := <-done:
+			got[p] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("handled %v", got)
+		}
+	}
+}
+
+func TestQueueConsumerRejected(t *testing.T) {
+	ctx := context.Background()
+	q, _ := newTestQueue(t, "rejected")
+	d := NewDispatcher(1, 1)
+	d.Run()
+	d.Shutdown(ctx)
+
+	id, _ := q.Enqueue(ctx, "echo", nil, 0)
+	c := NewQueueConsumer(q, NewRegistry(), d)
+	c.ErrorLog = log.New(io.Discard, "", 0)
+	if err := c.Run(ctx); err != ErrDispatcherClosed {
+		t.Fatalf("Run = %v", err)
+	}
+	// the job the dispatcher rejected is back without a spent attempt
+	job, err := q.Reserve(ctx)
+	if err != nil || job == nil || job.ID != id || job.Attempts != 1 {
+		t.Fatalf("Reserve = %+v, %v", job, err)
+	}
+	if err := q.Release(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Release(ctx, job); err != ErrJobLost {
+		t.Fatalf("second Release = %v", err)
+	}
+}
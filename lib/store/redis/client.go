@@ -0,0 +1,302 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Pool hands out the connections of a Client, *redis.Pool is one
+type Pool interface {
+	GetContext(ctx context.Context) (redis.Conn, error)
+	Close() error
+}
+
+// Doer runs one redis command, cancelled with ctx. *Client is one, and
+// the packages storing data on redis take a Doer.
+type Doer interface {
+	Do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error)
+}
+
+// DoFunc is a function used as a Doer
+type DoFunc func(ctx context.Context, cmd string, args ...interface{}) (interface{}, error)
+
+// Do calls f
+func (f DoFunc) Do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return f(ctx, cmd, args...)
+}
+
+// Client runs redis commands on its own pool
+type Client struct {
+	pool Pool
+}
+
+// NewClient create a client on pool
+func NewClient(pool Pool) *Client {
+	return &Client{pool: pool}
+}
+
+// Dial create a client with a pool like the one of Init
+func Dial(addr, db, password string, timeout int) *Client {
+	return NewClient(newRedisPool(addr, db, password, timeout))
+}
+
+// Pool returns the pool of the client
+func (c *Client) Pool() Pool {
+	return c.pool
+}
+
+// Close closes the pool of the client
+func (c *Client) Close() error {
+	return c.pool.Close()
+}
+
+// Conn returns a connection of the pool, close it when done
+func (c *Client) Conn(ctx context.Context) (redis.Conn, error) {
+	return c.pool.GetContext(ctx)
+}
+
+// Do runs a command, it is cancelled with ctx
+func (c *Client) Do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return redis.DoContext(conn, ctx, cmd, args...)
+}
+
+// STRING
+// --------------------------------------------------------------------------------
+
+func (c *Client) Del(ctx context.Context, key string) error {
+	_, err := c.Do(ctx, "DEL", key)
+	return err
+}
+
+func (c *Client) Expire(ctx context.Context, key string, expire int) error {
+	_, err := c.Do(ctx, "EXPIRE", key, expire)
+	return err
+}
+
+func (c *Client) Persist(ctx context.Context, key string) error {
+	_, err := c.Do(ctx, "PERSIST", key)
+	return err
+}
+
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return redis.String(c.Do(ctx, "GET", key))
+}
+
+func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return redis.Int64(c.Do(ctx, "INCRBY", key, 1))
+}
+
+func (c *Client) IncrBy(ctx context.Context, key string, val int64) (int64, error) {
+	return redis.Int64(c.Do(ctx, "INCRBY", key, val))
+}
+
+func (c *Client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	return redis.Strings(c.Do(ctx, "KEYS", pattern))
+}
+
+func (c *Client) Set(ctx context.Context, key string, val []byte) error {
+	_, err := c.Do(ctx, "SET", key, string(val))
+	return err
+}
+
+func (c *Client) Setex(ctx context.Context, key string, expire int, val interface{}) error {
+	_, err := c.Do(ctx, "SETEX", key, expire, val)
+	return err
+}
+
+func (c *Client) Exist(ctx context.Context, key string) (bool, error) {
+	i, err := redis.Int(c.Do(ctx, "EXISTS", key))
+	if err != nil {
+		return false, err
+	}
+	return i > 0, nil
+}
+
+// HASH
+// --------------------------------------------------------------------------------
+
+func (c *Client) Hgetall(ctx context.Context, key string) (map[string]string, error) {
+	res, err := bytesSlice(c.Do(ctx, "HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	writeToContainer(res, reflect.ValueOf(result))
+
+	return result, err
+}
+
+func (c *Client) Hmset(ctx context.Context, key string, mapping interface{}) error {
+	_, err := c.Do(ctx, "HMSET", redis.Args{}.Add(key).AddFlat(mapping)...)
+	return err
+}
+
+func (c *Client) Hget(ctx context.Context, key string, filed interface{}) (string, error) {
+	return redis.String(c.Do(ctx, "HGET", key, filed))
+}
+
+func (c *Client) Hset(ctx context.Context, key string, filed interface{}, val interface{}) error {
+	_, err := c.Do(ctx, "HSET", key, filed, val)
+	return err
+}
+
+func (c *Client) Hdel(ctx context.Context, key string, filed interface{}) (interface{}, error) {
+	return c.Do(ctx, "HDEL", key, filed)
+}
+
+// SETS
+// --------------------------------------------------------------------------------
+
+func (c *Client) Smembers(ctx context.Context, key string) ([]string, error) {
+	return redis.Strings(c.Do(ctx, "SMEMBERS", key))
+}
+
+func (c *Client) Sadd(ctx context.Context, key string, val interface{}) error {
+	_, err := c.Do(ctx, "SADD", key, val)
+	return err
+}
+
+func (c *Client) Srem(ctx context.Context, key string, val interface{}) error {
+	_, err := c.Do(ctx, "SREM", key, val)
+	return err
+}
+
+func (c *Client) Srandmember(ctx context.Context, key string, length int) ([]string, error) {
+	return redis.Strings(c.Do(ctx, "SRANDMEMBER", key, length))
+}
+
+func (c *Client) Sismember(ctx context.Context, key string, member interface{}) (bool, error) {
+	return redis.Bool(c.Do(ctx, "SISMEMBER", key, member))
+}
+
+// ZSETS
+// --------------------------------------------------------------------------------
+
+// 有序集合成员设置
+func (c *Client) Zadd(ctx context.Context, key string, score interface{}, member interface{}) error {
+	_, err := c.Do(ctx, "ZADD", key, score, member)
+	return err
+}
+
+// 有序集合增量修改
+func (c *Client) Zincrby(ctx context.Context, key string, increment int, member interface{}) error {
+	_, err := c.Do(ctx, "ZINCRBY", key, increment, member)
+	return err
+}
+
+// 删除有序集合成员
+func (c *Client) Zrem(ctx context.Context, key string, member interface{}) error {
+	_, err := c.Do(ctx, "ZREM", key, member)
+	return err
+}
+
+// 获取集合成员数
+func (c *Client) Zcard(ctx context.Context, key string) (int, error) {
+	return redis.Int(c.Do(ctx, "ZCARD", key))
+}
+
+// Zadds adds score, member pairs
+func (c *Client) Zadds(ctx context.Context, key string, data ...interface{}) error {
+	_, err := c.Do(ctx, "ZADD", append([]interface{}{key}, data...)...)
+	return err
+}
+
+func (c *Client) Zrange(ctx context.Context, key string, withScore bool) ([]string, error) {
+	if withScore {
+		return redis.Strings(c.Do(ctx, "ZRANGEBYSCORE", key, "-INF", "+INF", "WITHSCORES"))
+	}
+	return redis.Strings(c.Do(ctx, "ZRANGEBYSCORE", key, "-INF", "+INF"))
+}
+
+func (c *Client) Zranges(ctx context.Context, key string, start int, stop int) ([]string, error) {
+	return redis.Strings(c.Do(ctx, "ZRANGE", key, start, stop))
+}
+
+func (c *Client) ZrangeByScore(ctx context.Context, key string, start string, end string, offset int, count int) ([]string, error) {
+	return redis.Strings(c.Do(ctx, "ZRANGEBYSCORE", key, start, end, "WITHSCORES", "LIMIT", offset, count))
+}
+
+func (c *Client) Zrevrangebyscore(ctx context.Context, key string, offset int, count int) ([]string, error) {
+	return redis.Strings(c.Do(ctx, "ZREVRANGEBYSCORE", key, "+INF", "-INF", "WITHSCORES", "LIMIT", offset, count))
+}
+
+// LIST
+// --------------------------------------------------------------------------------
+
+func (c *Client) Brpoplpush(ctx context.Context, src string, dest string, timeout int) (string, error) {
+	return redis.String(c.Do(ctx, "BRPOPLPUSH", src, dest, timeout))
+}
+
+func (c *Client) LRange(ctx context.Context, key string, start int, end int) ([]string, error) {
+	return redis.Strings(c.Do(ctx, "LRANGE", key, start, end))
+}
+
+func (c *Client) Lrem(ctx context.Context, key string, count int, val interface{}) error {
+	_, err := c.Do(ctx, "LREM", key, count, val)
+	return err
+}
+
+func (c *Client) Rpush(ctx context.Context, key string, val interface{}) error {
+	_, err := c.Do(ctx, "RPUSH", key, val)
+	return err
+}
+
+func (c *Client) Lpush(ctx context.Context, key string, val interface{}) error {
+	_, err := c.Do(ctx, "LPUSH", key, val)
+	return err
+}
+
+func (c *Client) Llen(ctx context.Context, key string) (int, error) {
+	n, err := redis.Int(c.Do(ctx, "LLEN", key))
+	if err != nil {
+		return -1, err
+	}
+	return n, nil
+}
+
+func (c *Client) Lpop(ctx context.Context, key string) ([]byte, error) {
+	return c.pop(ctx, "LPOP", key)
+}
+
+func (c *Client) Rpop(ctx context.Context, key string) ([]byte, error) {
+	return c.pop(ctx, "RPOP", key)
+}
+
+func (c *Client) pop(ctx context.Context, cmd string, key string) ([]byte, error) {
+	res, err := redis.Bytes(c.Do(ctx, cmd, key))
+	if err == redis.ErrNil {
+		return nil, errors.New("EOF")
+	}
+	return res, err
+}
+
+func (c *Client) Blpop(ctx context.Context, key string, timeout int) (interface{}, error) {
+	return c.bpop(ctx, "BLPOP", key, timeout)
+}
+
+func (c *Client) Brpop(ctx context.Context, key string, timeout int) (interface{}, error) {
+	return c.bpop(ctx, "BRPOP", key, timeout)
+}
+
+func (c *Client) bpop(ctx context.Context, cmd string, key string, timeout int) (interface{}, error) {
+	res, err := c.Do(ctx, cmd, key, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get value from list
+	if list, ok := res.([]interface{}); ok && len(list) == 2 {
+		return list[1], nil
+	}
+	return nil, errors.New("EOF")
+}
@@ -0,0 +1,275 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakePool hands out connections running the commands on a map.
+type fakePool struct {
+	mu       sync.Mutex
+	values   map[string]interface{}
+	versions map[string]int    // bumped on each write, for WATCH
+	scripts  map[string]string // loaded scripts by SHA1
+	streams  map[string]*fakeStream
+	node     fakeNode // ROLE and SENTINEL replies
+	cmds     []string
+	open     int
+}
+
+func newFakePool() *fakePool {
+	return &fakePool{
+		values:   make(map[string]interface{}),
+		versions: make(map[string]int),
+		scripts:  make(map[string]string),
+		streams:  make(map[string]*fakeStream),
+	}
+}
+
+func (p *fakePool) GetContext(ctx context.Context) (redis.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.open++
+	return &fakeConn{p: p}, nil
+}
+
+func (p *fakePool) Close() error { return nil }
+
+func (p *fakePool) do(cmd string, args ...interface{}) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cmds = append(p.cmds, strings.TrimSpace(cmd+" "+fmt.Sprint(args...)))
+	switch cmd {
+	case "SET":
+		p.values[args[0].(string)] = []byte(fmt.Sprint(args[1]))
+		p.versions[args[0].(string)]++
+		return "OK", nil
+	case "INCRBY":
+		key := args[0].(string)
+		old, _ := p.values[key].([]byte)
+		n, err := strconv.ParseInt(string(old), 10, 64)
+		if old == nil {
+			n, err = 0, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ERR value is not an integer")
+		}
+		n += num(args[1])
+		p.values[key] = []byte(strconv.FormatInt(n, 10))
+		p.versions[key]++
+		return n, nil
+	case "EVAL", "EVALSHA":
+		// scripts reply with their first argument
+		src := args[0].(string)
+		if cmd == "EVALSHA" {
+			var ok bool
+			if src, ok = p.scripts[src]; !ok {
+				return nil, fmt.Errorf("NOSCRIPT No matching script")
+			}
+		}
+		sum := sha1.Sum([]byte(src))
+		p.scripts[hex.EncodeToString(sum[:])] = src
+		return []byte(fmt.Sprint(args[2+args[1].(int)])), nil
+	case "GET":
+		return p.values[args[0].(string)], nil
+	case "EXISTS":
+		if _, ok := p.values[args[0].(string)]; ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	if cmd == "ROLE" || cmd == "SENTINEL" {
+		return p.node.do(cmd, args...)
+	}
+	if strings.HasPrefix(cmd, "X") {
+		return p.stream(cmd, args...)
+	}
+	return nil, fmt.Errorf("unexpected %s", cmd)
+}
+
+// fakeConn is a connection of fakePool. Send queues commands and Receive
+// replies to them in order, like a real connection.
+type fakeConn struct {
+	p       *fakePool
+	pending []interface{}
+	closed  bool
+	multi   bool
+	queued  [][]interface{}
+	watched map[string]int
+}
+
+func (c *fakeConn) Close() error {
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		c.p.open--
+	}
+	return nil
+}
+
+func (c *fakeConn) Err() error { return nil }
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.DoContext(context.Background(), cmd, args...)
+}
+
+func (c *fakeConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// like redigo: an empty command returns all the pending replies,
+	// otherwise the last one with the first redis error
+	if cmd == "" {
+		replies := c.pending
+		c.pending = nil
+		return replies, nil
+	}
+	c.Send(cmd, args...)
+	var reply interface{}
+	var err error
+	for _, r := range c.pending {
+		reply = r
+		if e, ok := r.(redis.Error); ok && err == nil {
+			err = e
+		}
+	}
+	c.pending = nil
+	return reply, err
+}
+
+func (c *fakeConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	return c.Do(cmd, args...)
+}
+
+func (c *fakeConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, c.exec(cmd, args...))
+	return nil
+}
+
+func (c *fakeConn) exec(cmd string, args ...interface{}) interface{} {
+	switch {
+	case cmd == "MULTI":
+		c.multi = true
+		return "OK"
+	case cmd == "EXEC":
+		c.multi = false
+		queued, watched := c.queued, c.watched
+		c.queued, c.watched = nil, nil
+		c.p.mu.Lock()
+		for key, v := range watched {
+			if c.p.versions[key] != v {
+				c.p.mu.Unlock()
+				return nil
+			}
+		}
+		c.p.mu.Unlock()
+		replies := make([]interface{}, len(queued))
+		for i, q := range queued {
+			replies[i] = c.reply(q[0].(string), q[1:]...)
+		}
+		return replies
+	case c.multi:
+		c.queued = append(c.queued, append([]interface{}{cmd}, args...))
+		return "QUEUED"
+	case cmd == "WATCH":
+		c.p.mu.Lock()
+		defer c.p.mu.Unlock()
+		if c.watched == nil {
+			c.watched = make(map[string]int)
+		}
+		for _, key := range args {
+			c.watched[key.(string)] = c.p.versions[key.(string)]
+		}
+		return "OK"
+	case cmd == "UNWATCH":
+		c.watched = nil
+		return "OK"
+	}
+	return c.reply(cmd, args...)
+}
+
+func (c *fakeConn) reply(cmd string, args ...interface{}) interface{} {
+	reply, err := c.p.do(cmd, args...)
+	if err != nil {
+		return redis.Error(err.Error())
+	}
+	return reply
+}
+
+func (c *fakeConn) Flush() error { return nil }
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	if len(c.pending) == 0 {
+		return nil, fmt.Errorf("nothing to receive")
+	}
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+	if err, ok := reply.(redis.Error); ok {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (c *fakeConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return c.Receive()
+}
+
+func (c *fakeConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return c.Receive()
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	p := newFakePool()
+	c := NewClient(p)
+
+	if err := c.Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := c.Get(ctx, "k"); err != nil || v != "v" {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+	for _, key := range []string{"k", "missing"} {
+		ok, err := c.Exist(ctx, key)
+		if err != nil || ok != (key == "k") {
+			t.Fatalf("Exist(%s) = %v, %v", key, ok, err)
+		}
+	}
+	if p.open != 0 {
+		t.Fatalf("%d connections left open", p.open)
+	}
+
+	done, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Get(done, "k"); err != context.Canceled {
+		t.Fatalf("Get with a cancelled context = %v", err)
+	}
+}
+
+func TestPackageFunctionsUseDefaultClient(t *testing.T) {
+	old := DefaultClient
+	defer func() { DefaultClient = old }()
+	DefaultClient = NewClient(newFakePool())
+
+	if err := Set("k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Exist("k"); !ok || err != nil {
+		t.Fatalf("Exist = %v, %v", ok, err)
+	}
+}
+
+func num(v interface{}) int64 {
+	n, _ := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+	return n
+}
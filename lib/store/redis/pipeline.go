@@ -0,0 +1,412 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// DefaultTxRetries is how many times Client.Tx runs its func when the
+	// watched keys keep changing
+	DefaultTxRetries = 10
+
+	// ErrNotExecuted is the error of a result before its pipeline runs
+	ErrNotExecuted = errors.New("redis: pipeline not executed")
+	// ErrTxAborted is returned by Client.Tx when the watched keys changed
+	// on every attempt
+	ErrTxAborted = errors.New("redis: transaction aborted, watched keys changed")
+)
+
+// Script is a Lua script sent with EVALSHA, and with EVAL when the server
+// does not have it yet
+type Script struct {
+	s *redis.Script
+}
+
+// NewScript create a script taking keyCount keys, before its arguments
+func NewScript(keyCount int, src string) *Script {
+	return &Script{s: redis.NewScript(keyCount, src)}
+}
+
+// Hash returns the SHA1 of the script
+func (s *Script) Hash() string {
+	return s.s.Hash()
+}
+
+// Eval runs script with EVALSHA, falling back to EVAL
+func (c *Client) Eval(ctx context.Context, script *Script, keysAndArgs ...interface{}) (interface{}, error) {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return script.s.DoContext(ctx, conn, keysAndArgs...)
+}
+
+// pipeCmd is a queued command and, once run, its reply
+type pipeCmd struct {
+	cmd    string
+	args   []interface{}
+	script *Script
+	reply  interface{}
+	err    error
+}
+
+func (c *pipeCmd) set(reply interface{}) {
+	if err, ok := reply.(redis.Error); ok {
+		c.reply, c.err = nil, err
+		return
+	}
+	c.reply, c.err = reply, nil
+}
+
+// Result is the reply to a queued command
+type Result struct{ c *pipeCmd }
+
+// Val returns the raw reply
+func (r *Result) Val() (interface{}, error) { return r.c.reply, r.c.err }
+
+// Err returns the error of the command
+func (r *Result) Err() error { return r.c.err }
+
+// StringResult is the reply to a queued command returning a string
+type StringResult struct{ Result }
+
+// Val returns the reply, redis.ErrNil for a missing value
+func (r *StringResult) Val() (string, error) { return redis.String(r.c.reply, r.c.err) }
+
+// IntResult is the reply to a queued command returning an integer
+type IntResult struct{ Result }
+
+// Val returns the reply
+func (r *IntResult) Val() (int64, error) { return redis.Int64(r.c.reply, r.c.err) }
+
+// BoolResult is the reply to a queued command returning a boolean
+type BoolResult struct{ Result }
+
+// Val returns the reply
+func (r *BoolResult) Val() (bool, error) { return redis.Bool(r.c.reply, r.c.err) }
+
+// StringsResult is the reply to a queued command returning a list
+type StringsResult struct{ Result }
+
+// Val returns the reply
+func (r *StringsResult) Val() ([]string, error) { return redis.Strings(r.c.reply, r.c.err) }
+
+// StringMapResult is the reply to a queued command returning a hash
+type StringMapResult struct{ Result }
+
+// Val returns the reply
+func (r *StringMapResult) Val() (map[string]string, error) {
+	return redis.StringMap(r.c.reply, r.c.err)
+}
+
+// commands queues commands for a Pipeline or a Tx
+type commands struct {
+	cmds []*pipeCmd
+}
+
+func (q *commands) queue(cmd string, args ...interface{}) Result {
+	c := &pipeCmd{cmd: cmd, args: args, err: ErrNotExecuted}
+	q.cmds = append(q.cmds, c)
+	return Result{c}
+}
+
+// Len returns the number of queued commands
+func (q *commands) Len() int { return len(q.cmds) }
+
+// Do queues any command
+func (q *commands) Do(cmd string, args ...interface{}) *Result {
+	r := q.queue(cmd, args...)
+	return &r
+}
+
+// Eval queues a script, see Script
+func (q *commands) Eval(script *Script, keysAndArgs ...interface{}) *Result {
+	r := q.queue("EVALSHA", keysAndArgs...)
+	r.c.script = script
+	return &r
+}
+
+func (q *commands) Del(key string) *IntResult {
+	return &IntResult{q.queue("DEL", key)}
+}
+
+func (q *commands) Expire(key string, expire int) *BoolResult {
+	return &BoolResult{q.queue("EXPIRE", key, expire)}
+}
+
+func (q *commands) Get(key string) *StringResult {
+	return &StringResult{q.queue("GET", key)}
+}
+
+func (q *commands) Set(key string, val interface{}) *Result {
+	r := q.queue("SET", key, val)
+	return &r
+}
+
+func (q *commands) Setex(key string, expire int, val interface{}) *Result {
+	r := q.queue("SETEX", key, expire, val)
+	return &r
+}
+
+func (q *commands) Incr(key string) *IntResult {
+	return &IntResult{q.queue("INCRBY", key, 1)}
+}
+
+func (q *commands) IncrBy(key string, val int64) *IntResult {
+	return &IntResult{q.queue("INCRBY", key, val)}
+}
+
+func (q *commands) Exist(key string) *BoolResult {
+	return &BoolResult{q.queue("EXISTS", key)}
+}
+
+func (q *commands) Hget(key string, field interface{}) *StringResult {
+	return &StringResult{q.queue("HGET", key, field)}
+}
+
+func (q *commands) Hset(key string, field interface{}, val interface{}) *IntResult {
+	return &IntResult{q.queue("HSET", key, field, val)}
+}
+
+func (q *commands) Hmset(key string, mapping interface{}) *Result {
+	r := q.queue("HMSET", redis.Args{}.Add(key).AddFlat(mapping)...)
+	return &r
+}
+
+func (q *commands) Hgetall(key string) *StringMapResult {
+	return &StringMapResult{q.queue("HGETALL", key)}
+}
+
+func (q *commands) Hdel(key string, field interface{}) *IntResult {
+	return &IntResult{q.queue("HDEL", key, field)}
+}
+
+func (q *commands) Sadd(key string, val interface{}) *IntResult {
+	return &IntResult{q.queue("SADD", key, val)}
+}
+
+func (q *commands) Srem(key string, val interface{}) *IntResult {
+	return &IntResult{q.queue("SREM", key, val)}
+}
+
+func (q *commands) Smembers(key string) *StringsResult {
+	return &StringsResult{q.queue("SMEMBERS", key)}
+}
+
+func (q *commands) Sismember(key string, member interface{}) *BoolResult {
+	return &BoolResult{q.queue("SISMEMBER", key, member)}
+}
+
+func (q *commands) Zadd(key string, score interface{}, member interface{}) *IntResult {
+	return &IntResult{q.queue("ZADD", key, score, member)}
+}
+
+func (q *commands) Zincrby(key string, increment int, member interface{}) *StringResult {
+	return &StringResult{q.queue("ZINCRBY", key, increment, member)}
+}
+
+func (q *commands) Zrem(key string, member interface{}) *IntResult {
+	return &IntResult{q.queue("ZREM", key, member)}
+}
+
+func (q *commands) Zcard(key string) *IntResult {
+	return &IntResult{q.queue("ZCARD", key)}
+}
+
+func (q *commands) Lpush(key string, val interface{}) *IntResult {
+	return &IntResult{q.queue("LPUSH", key, val)}
+}
+
+func (q *commands) Rpush(key string, val interface{}) *IntResult {
+	return &IntResult{q.queue("RPUSH", key, val)}
+}
+
+func (q *commands) Llen(key string) *IntResult {
+	return &IntResult{q.queue("LLEN", key)}
+}
+
+// firstErr returns the first error of cmds
+func firstErr(cmds []*pipeCmd) error {
+	for _, c := range cmds {
+		if c.err != nil {
+			return c.err
+		}
+	}
+	return nil
+}
+
+func failAll(cmds []*pipeCmd, err error) {
+	for _, c := range cmds {
+		c.reply, c.err = nil, err
+	}
+}
+
+// Pipeline sends its queued commands in one round trip. It is not safe for
+// concurrent use.
+type Pipeline struct {
+	commands
+	c *Client
+}
+
+// Pipeline create an empty pipeline
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Exec sends the queued commands and fills their results. It returns the
+// first error, of the connection or of a command, and empties the queue
+// so the pipeline can be used again.
+func (p *Pipeline) Exec(ctx context.Context) error {
+	cmds := p.cmds
+	p.cmds = nil
+	if len(cmds) == 0 {
+		return nil
+	}
+	conn, err := p.c.pool.GetContext(ctx)
+	if err != nil {
+		failAll(cmds, err)
+		return err
+	}
+	defer conn.Close()
+
+	if err := sendAll(ctx, conn, cmds, false); err != nil {
+		return err
+	}
+
+	// scripts the server did not know, run again with EVAL
+	var retry []*pipeCmd
+	for _, c := range cmds {
+		if c.script != nil && c.err != nil && strings.HasPrefix(c.err.Error(), "NOSCRIPT ") {
+			retry = append(retry, c)
+		}
+	}
+	if len(retry) > 0 {
+		if err := sendAll(ctx, conn, retry, true); err != nil {
+			return err
+		}
+	}
+	return firstErr(cmds)
+}
+
+// sendAll sends cmds, flushes and fills their replies, sending scripts
+// with EVAL when eval is true.
+func sendAll(ctx context.Context, conn redis.Conn, cmds []*pipeCmd, eval bool) error {
+	for _, c := range cmds {
+		var err error
+		switch {
+		case c.script != nil && eval:
+			err = c.script.s.Send(conn, c.args...)
+		case c.script != nil:
+			err = c.script.s.SendHash(conn, c.args...)
+		default:
+			err = conn.Send(c.cmd, c.args...)
+		}
+		if err != nil {
+			failAll(cmds, err)
+			return err
+		}
+	}
+	replies, err := redis.Values(redis.DoContext(conn, ctx, ""))
+	if err == nil && len(replies) != len(cmds) {
+		err = errors.New("redis: pipeline reply count mismatch")
+	}
+	if err != nil {
+		failAll(cmds, err)
+		return err
+	}
+	for i, c := range cmds {
+		c.set(replies[i])
+	}
+	return nil
+}
+
+// Tx is a MULTI/EXEC transaction. Commands queued on it run atomically
+// when the func given to Client.Tx returns, Do runs a command at once on
+// the watched connection, to read the keys the transaction depends on.
+// Scripts queued in a Tx are sent with EVAL.
+type Tx struct {
+	commands
+	conn redis.Conn
+	ctx  context.Context
+}
+
+// Do runs a command now, outside the transaction
+func (tx *Tx) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return redis.DoContext(tx.conn, tx.ctx, cmd, args...)
+}
+
+// Queue queues any command in the transaction
+func (tx *Tx) Queue(cmd string, args ...interface{}) *Result {
+	return tx.commands.Do(cmd, args...)
+}
+
+// Tx runs fn and then the commands it queued in MULTI/EXEC, after a WATCH
+// of keys. When a watched key changes before EXEC, it runs fn again, up to
+// DefaultTxRetries times before it returns ErrTxAborted. An error from fn
+// discards the transaction and is returned as is.
+func (c *Client) Tx(ctx context.Context, fn func(tx *Tx) error, keys ...string) error {
+	conn, err := c.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for i := 0; i < DefaultTxRetries; i++ {
+		if len(keys) > 0 {
+			if _, err := redis.DoContext(conn, ctx, "WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+				return err
+			}
+		}
+		tx := &Tx{conn: conn, ctx: ctx}
+		if err := fn(tx); err != nil {
+			redis.DoContext(conn, ctx, "UNWATCH")
+			return err
+		}
+		if len(tx.cmds) == 0 {
+			_, err := redis.DoContext(conn, ctx, "UNWATCH")
+			return err
+		}
+
+		if err := conn.Send("MULTI"); err != nil {
+			return err
+		}
+		for _, cmd := range tx.cmds {
+			if cmd.script != nil {
+				err = cmd.script.s.Send(conn, cmd.args...)
+			} else {
+				err = conn.Send(cmd.cmd, cmd.args...)
+			}
+			if err != nil {
+				failAll(tx.cmds, err)
+				return err
+			}
+		}
+		reply, err := redis.DoContext(conn, ctx, "EXEC")
+		if err != nil {
+			failAll(tx.cmds, err)
+			return err
+		}
+		if reply == nil {
+			continue
+		}
+		replies, err := redis.Values(reply, nil)
+		if err == nil && len(replies) != len(tx.cmds) {
+			err = errors.New("redis: transaction reply count mismatch")
+		}
+		if err != nil {
+			failAll(tx.cmds, err)
+			return err
+		}
+		for i, cmd := range tx.cmds {
+			cmd.set(replies[i])
+		}
+		return firstErr(tx.cmds)
+	}
+	return ErrTxAborted
+}
@@ -0,0 +1,125 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestPipeline(t *testing.T) {
+	ctx := context.Background()
+	p := newFakePool()
+	c := NewClient(p)
+
+	pipe := c.Pipeline()
+	set := pipe.Set("k", "v")
+	get := pipe.Get("k")
+	missing := pipe.Get("missing")
+	n := pipe.IncrBy("n", 2)
+	bad := pipe.Incr("k")
+	exist := pipe.Exist("k")
+	if _, err := get.Val(); err != ErrNotExecuted {
+		t.Fatalf("Val before Exec = %v", err)
+	}
+
+	if err := pipe.Exec(ctx); err == nil || err != bad.Err() {
+		t.Fatalf("Exec = %v, want the INCR error", err)
+	}
+	if err := set.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := get.Val(); v != "v" || err != nil {
+		t.Fatalf("Get = %q, %v", v, err)
+	}
+	if _, err := missing.Val(); err != redis.ErrNil {
+		t.Fatalf("Get of a missing key = %v", err)
+	}
+	if v, err := n.Val(); v != 2 || err != nil {
+		t.Fatalf("IncrBy = %d, %v", v, err)
+	}
+	if ok, err := exist.Val(); !ok || err != nil {
+		t.Fatalf("Exist = %v, %v", ok, err)
+	}
+	if pipe.Len() != 0 || pipe.Exec(ctx) != nil {
+		t.Fatal("Exec did not empty the pipeline")
+	}
+	if p.open != 0 {
+		t.Fatalf("%d connections left open", p.open)
+	}
+}
+
+func TestScript(t *testing.T) {
+	ctx := context.Background()
+	p := newFakePool()
+	c := NewClient(p)
+	echo := NewScript(1, "return ARGV[1]")
+
+	pipe := c.Pipeline()
+	r := pipe.Eval(echo, "k", "hello")
+	if err := pipe.Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := redis.String(r.Val()); v != "hello" || err != nil {
+		t.Fatalf("Eval = %q, %v", v, err)
+	}
+	if len(p.cmds) != 2 || p.cmds[0][:7] != "EVALSHA" || p.cmds[1][:5] != "EVAL " {
+		t.Fatalf("sent %q, want EVALSHA then EVAL", p.cmds)
+	}
+
+	// the script is cached now
+	p.cmds = nil
+	if v, err := redis.String(c.Eval(ctx, echo, "k", "again")); v != "again" || err != nil {
+		t.Fatalf("Client.Eval = %q, %v", v, err)
+	}
+	if len(p.cmds) != 1 || p.cmds[0][:7] != "EVALSHA" {
+		t.Fatalf("sent %q, want EVALSHA", p.cmds)
+	}
+}
+
+func TestTx(t *testing.T) {
+	ctx := context.Background()
+	c := NewClient(newFakePool())
+	c.Set(ctx, "n", []byte("1"))
+
+	// the key changes under the first attempt, which runs again
+	runs := 0
+	var set *Result
+	err := c.Tx(ctx, func(tx *Tx) error {
+		runs++
+		n, err := redis.Int(tx.Do("GET", "n"))
+		if err != nil {
+			return err
+		}
+		if runs == 1 {
+			c.Set(ctx, "n", []byte("10"))
+		}
+		set = tx.Set("n", n*2)
+		return nil
+	}, "n")
+	if err != nil || runs != 2 || set.Err() != nil {
+		t.Fatalf("Tx = %v after %d runs", err, runs)
+	}
+	if v, _ := c.Get(ctx, "n"); v != "20" {
+		t.Fatalf("n = %s, want 20", v)
+	}
+
+	err = c.Tx(ctx, func(tx *Tx) error {
+		c.Set(ctx, "n", []byte("0"))
+		tx.Set("n", 1)
+		return nil
+	}, "n")
+	if err != ErrTxAborted {
+		t.Fatalf("Tx with a key always changing = %v", err)
+	}
+
+	failed := errors.New("failed")
+	err = c.Tx(ctx, func(tx *Tx) error {
+		tx.Set("n", 1)
+		return failed
+	}, "n")
+	if v, _ := c.Get(ctx, "n"); err != failed || v != "0" {
+		t.Fatalf("Tx with an error = %v, n = %s", err, v)
+	}
+}
@@ -1,117 +1,553 @@
-package redis
-
-import (
-	"net"
-	"strings"
-	"sync"
-	"time"
-
-	"share/logging"
-
-	"github.com/gomodule/redigo/redis"
-)
-
-type SentinelPool struct {
-	sentinelAddr string
-	masterName   string
-	masterAddr   string
-	db           string
-	password     string
-	pools        map[string]*redis.Pool
-	l            sync.RWMutex
-}
-
-func NewSentinelPool(sentinelAddr string, masterName string, masterAddr string, db string, password string) *SentinelPool {
-	sc := &SentinelPool{
-		masterName:   masterName,
-		masterAddr:   masterAddr,
-		sentinelAddr: sentinelAddr,
-		db:           db,
-		password:     password,
-		pools:        make(map[string]*redis.Pool),
-	}
-
-	if len(sentinelAddr) > 0 {
-		go sc.listen()
-	}
-	return sc
-}
-
-func (this *SentinelPool) Get() redis.Conn {
-	return this.switchPool().Get()
-}
-
-func (this *SentinelPool) ActiveCount() int {
-	return this.switchPool().ActiveCount()
-}
-
-// ------------------------------------------------------------------------
-
-// Maseter and slave switch
-func (this *SentinelPool) switchPool() *redis.Pool {
-
-	this.l.Lock()
-	defer this.l.Unlock()
-
-	if _, ok := this.pools[this.masterAddr]; !ok {
-		this.pools[this.masterAddr] = &redis.Pool{
-			MaxIdle:     80,
-			MaxActive:   10000,
-			IdleTimeout: 600 * time.Second,
-			Dial: func() (redis.Conn, error) {
-				con, err := redis.Dial("tcp", this.masterAddr)
-				if err != nil {
-					return nil, err
-				}
-				_, err = con.Do("AUTH", this.password)
-				if err == nil {
-					con.Do("SELECT", this.db)
-				}
-
-				return con, err
-			},
-		}
-	}
-
-	return this.pools[this.masterAddr]
-
-}
-
-// Monitor sentinel message
-func (this *SentinelPool) listen() {
-	conn, _ := redis.Dial("tcp", this.sentinelAddr)
-	pubsub := redis.PubSubConn{Conn: conn}
-
-	if err := pubsub.Subscribe("+switch-master"); err != nil {
-		return
-	}
-
-	for {
-
-		switch msg := pubsub.Receive().(type) {
-		case redis.Message:
-			switch msg.Channel {
-			case "+switch-master":
-				parts := strings.Split(string(msg.Data), " ")
-				if parts[0] != this.masterName {
-					logging.Info("Redis sentinel: Ignore new %s addr", parts[0])
-					continue
-				}
-
-				masterAddr := net.JoinHostPort(parts[3], parts[4])
-				logging.Info("Redis sentinel: New %q addr is %s", this.masterName, masterAddr)
-
-				this.l.Lock()
-				this.masterAddr = masterAddr
-				this.l.Unlock()
-
-			default:
-				logging.Info("Redis sentinel: Unsupported message: %s", msg)
-			}
-		case redis.Subscription:
-			// Ignore.
-		default:
-			logging.Warning("%v", msg)
-		}
-	}
-}
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// DefaultCheckInterval is the time between two queries of the
+	// sentinels by a SentinelPool, besides the failover notifications
+	DefaultCheckInterval = 30 * time.Second
+
+	// ErrSentinelPoolClosed is returned by a closed SentinelPool
+	ErrSentinelPoolClosed = errors.New("redis: sentinel pool closed")
+)
+
+// SentinelOptions configures a SentinelPool
+type SentinelOptions struct {
+	// Addrs are the sentinels, asked in turn
+	Addrs      []string
+	MasterName string
+	// SentinelPassword authenticates to the sentinels
+	SentinelPassword string
+
+	Password string
+	DB       int
+
+	// MaxIdle and MaxActive default to the ones of Init, 80 and 10000
+	MaxIdle   int
+	MaxActive int
+	// IdleTimeout closes connections idle for longer, default 10 minutes
+	IdleTimeout time.Duration
+	// Wait makes Get wait for a connection when MaxActive are in use
+	Wait bool
+	// ConnectTimeout bounds dialing, default 5 seconds
+	ConnectTimeout time.Duration
+
+	// CheckInterval is the time between two queries of the sentinels, see
+	// DefaultCheckInterval
+	CheckInterval time.Duration
+	ErrorLog      *log.Logger
+}
+
+// SentinelPool is a pool of connections to the master that the sentinels
+// report. It follows failovers, told by the sentinels and checked every
+// CheckInterval, confirms a new master with ROLE before it switches to it,
+// and closes the pools of the servers it leaves. Replicas gives a pool of
+// the replicas for reads.
+type SentinelPool struct {
+	opts SentinelOptions
+	dial func(ctx context.Context, network, addr string, options ...redis.DialOption) (redis.Conn, error)
+
+	refreshMu sync.Mutex // one refresh at a time
+	mu        sync.RWMutex
+	sentinels []string // the one that answered last goes first
+	closed    bool
+
+	masterAddr string
+	master     *redis.Pool
+	replicas   map[string]*redis.Pool
+	replicaSet []*redis.Pool
+	next       uint32
+
+	kick   chan struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewSentinelPool create a pool for opts.MasterName and starts following
+// its failovers. The master is looked up on first use.
+func NewSentinelPool(opts SentinelOptions) (*SentinelPool, error) {
+	return newSentinelPool(opts, redis.DialContext)
+}
+
+func newSentinelPool(opts SentinelOptions, dial func(ctx context.Context, network, addr string, options ...redis.DialOption) (redis.Conn, error)) (*SentinelPool, error) {
+	if len(opts.Addrs) == 0 || opts.MasterName == "" {
+		return nil, errors.New("redis: sentinel pool needs sentinels and a master name")
+	}
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = 80
+	}
+	if opts.MaxActive == 0 {
+		opts.MaxActive = 10000
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = 600 * time.Second
+	}
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = 5 * time.Second
+	}
+	if opts.CheckInterval == 0 {
+		opts.CheckInterval = DefaultCheckInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sp := &SentinelPool{
+		opts:      opts,
+		dial:      dial,
+		sentinels: append([]string(nil), opts.Addrs...),
+		replicas:  make(map[string]*redis.Pool),
+		kick:      make(chan struct{}, 1),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	go sp.watch(ctx)
+	return sp, nil
+}
+
+// Get returns a connection to the master, its Err reports a failed lookup
+func (this *SentinelPool) Get() redis.Conn {
+	conn, err := this.GetContext(context.Background())
+	if err != nil {
+		return errorConn{err}
+	}
+	return conn
+}
+
+// GetContext returns a connection to the master
+func (this *SentinelPool) GetContext(ctx context.Context) (redis.Conn, error) {
+	pool, err := this.masterPool(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pool.GetContext(ctx)
+}
+
+// ActiveCount returns the number of connections to the master
+func (this *SentinelPool) ActiveCount() int {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if this.master == nil {
+		return 0
+	}
+	return this.master.ActiveCount()
+}
+
+// MasterAddr returns the address of the master, empty before the first
+// lookup
+func (this *SentinelPool) MasterAddr() string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.masterAddr
+}
+
+// Replicas returns a pool handing out connections to the replicas in turn,
+// or to the master when no replica is up. It is closed with the
+// SentinelPool.
+func (this *SentinelPool) Replicas() Pool {
+	return replicaPool{this}
+}
+
+// Close stops following the master and closes the pools
+func (this *SentinelPool) Close() error {
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return nil
+	}
+	this.closed = true
+	pools := append([]*redis.Pool(nil), this.replicaSet...)
+	if this.master != nil {
+		pools = append(pools, this.master)
+	}
+	this.master, this.replicas, this.replicaSet = nil, nil, nil
+	this.mu.Unlock()
+
+	this.cancel()
+	<-this.done
+	for _, p := range pools {
+		p.Close()
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------
+
+func (this *SentinelPool) masterPool(ctx context.Context) (*redis.Pool, error) {
+	this.mu.RLock()
+	pool, closed := this.master, this.closed
+	this.mu.RUnlock()
+	if closed {
+		return nil, ErrSentinelPoolClosed
+	}
+	if pool != nil {
+		return pool, nil
+	}
+
+	if err := this.refresh(ctx); err != nil {
+		return nil, err
+	}
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	if this.master == nil {
+		return nil, ErrSentinelPoolClosed
+	}
+	return this.master, nil
+}
+
+// refresh asks the sentinels for the master and its replicas and switches
+// to them, once the new master confirms its role
+func (this *SentinelPool) refresh(ctx context.Context) error {
+	this.refreshMu.Lock()
+	defer this.refreshMu.Unlock()
+
+	var masterAddr string
+	var replicaAddrs []string
+	err := this.askSentinels(ctx, func(conn redis.Conn) error {
+		parts, err := redis.Strings(redis.DoContext(conn, ctx, "SENTINEL", "get-master-addr-by-name", this.opts.MasterName))
+		if err != nil {
+			return err
+		}
+		if len(parts) != 2 {
+			return fmt.Errorf("no master %q", this.opts.MasterName)
+		}
+		masterAddr = net.JoinHostPort(parts[0], parts[1])
+		replicaAddrs, err = this.replicaAddrs(ctx, conn)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	this.mu.RLock()
+	switched := masterAddr != this.masterAddr
+	this.mu.RUnlock()
+	if switched {
+		// the sentinels announce a failover before the replica is promoted
+		if err := this.checkRole(ctx, masterAddr, "master"); err != nil {
+			return fmt.Errorf("redis: new master %s: %v", masterAddr, err)
+		}
+	}
+
+	var stale []*redis.Pool
+	this.mu.Lock()
+	if this.closed {
+		this.mu.Unlock()
+		return ErrSentinelPoolClosed
+	}
+	if switched {
+		if this.master != nil {
+			stale = append(stale, this.master)
+			this.logf("redis: sentinel: master %q moved from %s to %s", this.opts.MasterName, this.masterAddr, masterAddr)
+		}
+		this.masterAddr, this.master = masterAddr, this.newPool(masterAddr, "master")
+	}
+	replicas := make(map[string]*redis.Pool, len(replicaAddrs))
+	for _, addr := range replicaAddrs {
+		if p, ok := this.replicas[addr]; ok {
+			replicas[addr] = p
+		} else {
+			replicas[addr] = this.newPool(addr, "slave")
+		}
+	}
+	for addr, p := range this.replicas {
+		if _, ok := replicas[addr]; !ok {
+			stale = append(stale, p)
+		}
+	}
+	this.replicas = replicas
+	this.replicaSet = this.replicaSet[:0:0]
+	for _, addr := range replicaAddrs {
+		this.replicaSet = append(this.replicaSet, replicas[addr])
+	}
+	this.mu.Unlock()
+
+	for _, p := range stale {
+		p.Close()
+	}
+	return nil
+}
+
+// replicaAddrs returns the replicas of the master that are up, sorted
+func (this *SentinelPool) replicaAddrs(ctx context.Context, conn redis.Conn) ([]string, error) {
+	reply, err := redis.Values(redis.DoContext(conn, ctx, "SENTINEL", "replicas", this.opts.MasterName))
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, r := range reply {
+		info, err := redis.StringMap(r, nil)
+		if err != nil {
+			return nil, err
+		}
+		flags := "," + info["flags"] + ","
+		if strings.Contains(flags, ",s_down,") || strings.Contains(flags, ",o_down,") || strings.Contains(flags, ",disconnected,") {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(info["ip"], info["port"]))
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// askSentinels runs f on the sentinels in turn until one succeeds
+func (this *SentinelPool) askSentinels(ctx context.Context, f func(conn redis.Conn) error) error {
+	var errs []string
+	for _, addr := range this.sentinelAddrs() {
+		conn, err := this.dialSentinel(ctx, addr)
+		if err == nil {
+			err = f(conn)
+			conn.Close()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", addr, err))
+			continue
+		}
+		this.promote(addr)
+		return nil
+	}
+	return errors.New("redis: no sentinel answered: " + strings.Join(errs, "; "))
+}
+
+// dialSentinels dials the sentinels in turn, for the Subscriber
+func (this *SentinelPool) dialSentinels(ctx context.Context) (redis.Conn, error) {
+	var errs []string
+	for _, addr := range this.sentinelAddrs() {
+		conn, err := this.dialSentinel(ctx, addr)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		this.promote(addr)
+		return conn, nil
+	}
+	return nil, errors.New("redis: no sentinel answered: " + strings.Join(errs, "; "))
+}
+
+func (this *SentinelPool) dialSentinel(ctx context.Context, addr string) (redis.Conn, error) {
+	return this.dial(ctx, "tcp", addr,
+		redis.DialPassword(this.opts.SentinelPassword),
+		redis.DialConnectTimeout(this.opts.ConnectTimeout))
+}
+
+func (this *SentinelPool) sentinelAddrs() []string {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return append([]string(nil), this.sentinels...)
+}
+
+// promote moves addr first, the sentinel that answers is asked first
+func (this *SentinelPool) promote(addr string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+	for i, a := range this.sentinels {
+		if a == addr {
+			copy(this.sentinels[1:i+1], this.sentinels[:i])
+			this.sentinels[0] = addr
+			return
+		}
+	}
+}
+
+func (this *SentinelPool) dialServer(ctx context.Context, addr string) (redis.Conn, error) {
+	return this.dial(ctx, "tcp", addr,
+		redis.DialPassword(this.opts.Password),
+		redis.DialDatabase(this.opts.DB),
+		redis.DialConnectTimeout(this.opts.ConnectTimeout))
+}
+
+// newPool create the pool of a server, a new connection and an idle one
+// when borrowed are checked to be in role. A server out of role asks for a
+// refresh.
+func (this *SentinelPool) newPool(addr, role string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     this.opts.MaxIdle,
+		MaxActive:   this.opts.MaxActive,
+		IdleTimeout: this.opts.IdleTimeout,
+		Wait:        this.opts.Wait,
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			conn, err := this.dialServer(ctx, addr)
+			if err != nil {
+				return nil, err
+			}
+			if err := this.testRole(conn, role); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("redis: %s: %v", addr, err)
+			}
+			return conn, nil
+		},
+		TestOnBorrow: func(conn redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Second {
+				return nil
+			}
+			return this.testRole(conn, role)
+		},
+	}
+}
+
+// testRole is roleIs, asking for a refresh when conn is out of role
+func (this *SentinelPool) testRole(conn redis.Conn, role string) error {
+	err := roleIs(conn, role)
+	if err != nil {
+		select {
+		case this.kick <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+func (this *SentinelPool) checkRole(ctx context.Context, addr, role string) error {
+	conn, err := this.dialServer(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return roleIs(conn, role)
+}
+
+// roleIs fails unless conn is a server in role
+func roleIs(conn redis.Conn, role string) error {
+	reply, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return errors.New("redis: empty ROLE reply")
+	}
+	got, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	if got != role {
+		return fmt.Errorf("redis: server is a %s, not a %s", got, role)
+	}
+	return nil
+}
+
+// watch refreshes the master on sentinel events and every CheckInterval.
+// A failed refresh, like a new master not promoted yet, is tried again
+// after a growing delay.
+func (this *SentinelPool) watch(ctx context.Context) {
+	defer close(this.done)
+
+	sub := NewSubscriber(this.dialSentinels)
+	sub.ErrorLog = this.opts.ErrorLog
+	sub.Subscribe(this.onEvent, "+switch-master", "+slave", "+sdown", "-sdown")
+	subDone := make(chan struct{})
+	go func() {
+		defer close(subDone)
+		sub.Run(ctx)
+	}()
+	defer func() { <-subDone }()
+
+	ticker := time.NewTicker(this.opts.CheckInterval)
+	defer ticker.Stop()
+	retry := time.NewTimer(0)
+	retry.Stop()
+	defer retry.Stop()
+	var backoff time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-this.kick:
+		case <-retry.C:
+		}
+		err := this.refresh(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			backoff = 0
+			continue
+		}
+		this.logf("redis: sentinel: %v", err)
+		if backoff == 0 {
+			backoff = 100 * time.Millisecond
+		} else {
+			backoff *= 2
+		}
+		if backoff > this.opts.CheckInterval {
+			backoff = this.opts.CheckInterval
+		}
+		if !retry.Stop() {
+			select {
+			case <-retry.C:
+			default:
+			}
+		}
+		retry.Reset(backoff)
+	}
+}
+
+// onEvent asks for a refresh on the events of the master and its replicas
+func (this *SentinelPool) onEvent(ctx context.Context, msg Message) {
+	if !strings.Contains(" "+string(msg.Data)+" ", " "+this.opts.MasterName+" ") {
+		return
+	}
+	select {
+	case this.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (this *SentinelPool) logf(format string, args ...interface{}) {
+	if this.opts.ErrorLog != nil {
+		this.opts.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// replicaPool is the Pool of Replicas
+type replicaPool struct {
+	sp *SentinelPool
+}
+
+func (r replicaPool) GetContext(ctx context.Context) (redis.Conn, error) {
+	if _, err := r.sp.masterPool(ctx); err != nil {
+		return nil, err
+	}
+	r.sp.mu.RLock()
+	pools := r.sp.replicaSet
+	r.sp.mu.RUnlock()
+
+	if n := uint32(len(pools)); n > 0 {
+		i := atomic.AddUint32(&r.sp.next, 1)
+		for k := uint32(0); k < n; k++ {
+			conn, err := pools[(i+k)%n].GetContext(ctx)
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return r.sp.GetContext(ctx)
+}
+
+func (r replicaPool) Close() error { return nil }
+
+// errorConn is the connection of a failed Get
+type errorConn struct{ err error }
+
+func (c errorConn) Close() error                                   { return nil }
+func (c errorConn) Err() error                                     { return c.err }
+func (c errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, c.err }
+func (c errorConn) Send(string, ...interface{}) error              { return c.err }
+func (c errorConn) Flush() error                                   { return c.err }
+func (c errorConn) Receive() (interface{}, error)                  { return nil, c.err }
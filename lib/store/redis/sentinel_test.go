@@ -0,0 +1,253 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakeNode is the role of a fakePool server, and what it reports when it
+// is a sentinel.
+type fakeNode struct {
+	role     string
+	master   string
+	replicas []string
+}
+
+func (n *fakeNode) do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "ROLE" {
+		return []interface{}{[]byte(n.role)}, nil
+	}
+	if n.role != "sentinel" {
+		return nil, errors.New("ERR unknown command SENTINEL")
+	}
+	switch args[0] {
+	case "get-master-addr-by-name":
+		if n.master == "" {
+			return nil, nil
+		}
+		host, port, _ := net.SplitHostPort(n.master)
+		return []interface{}{[]byte(host), []byte(port)}, nil
+	case "replicas":
+		var reply []interface{}
+		for _, r := range n.replicas {
+			host, port, _ := net.SplitHostPort(r)
+			reply = append(reply, []interface{}{
+				[]byte("ip"), []byte(host), []byte("port"), []byte(port), []byte("flags"), []byte("slave"),
+			})
+		}
+		return reply, nil
+	}
+	return nil, fmt.Errorf("unexpected SENTINEL %v", args[0])
+}
+
+// fakeServers are fakePools by address, an address missing refuses
+// connections.
+type fakeServers struct {
+	mu      sync.Mutex
+	servers map[string]*fakePool
+}
+
+func (f *fakeServers) add(addr, role string) *fakePool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	p := newFakePool()
+	p.node.role = role
+	f.servers[addr] = p
+	return p
+}
+
+func (f *fakeServers) dial(ctx context.Context, network, addr string, options ...redis.DialOption) (redis.Conn, error) {
+	f.mu.Lock()
+	p := f.servers[addr]
+	f.mu.Unlock()
+	if p == nil {
+		return nil, errors.New("connection refused")
+	}
+	return p.GetContext(ctx)
+}
+
+func setNode(p *fakePool, f func(n *fakeNode)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f(&p.node)
+}
+
+func TestSentinelPool(t *testing.T) {
+	ctx := context.Background()
+	servers := &fakeServers{servers: map[string]*fakePool{}}
+	sentinel := servers.add("10.0.0.2:26379", "sentinel")
+	master := servers.add("10.0.1.1:6379", "master")
+	replica := servers.add("10.0.1.2:6379", "slave")
+	setNode(sentinel, func(n *fakeNode) {
+		n.master, n.replicas = "10.0.1.1:6379", []string{"10.0.1.2:6379"}
+	})
+
+	sp, err := newSentinelPool(SentinelOptions{
+		Addrs:         []string{"10.0.0.1:26379", "10.0.0.2:26379"},
+		MasterName:    "mymaster",
+		CheckInterval: 5 * time.Millisecond,
+		ErrorLog:      log.New(io.Discard, "", 0),
+	}, servers.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+
+	c := NewClient(sp)
+	if err := c.Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := master.do("GET", "k"); sp.MasterAddr() != "10.0.1.1:6379" || v == nil {
+		t.Fatalf("wrote to %s", sp.MasterAddr())
+	}
+	if addrs := sp.sentinelAddrs(); addrs[0] != "10.0.0.2:26379" {
+		t.Fatalf("sentinels %v, the one answering should go first", addrs)
+	}
+
+	replica.do("SET", "r", "from replica")
+	if v, err := NewClient(sp.Replicas()).Get(ctx, "r"); v != "from replica" || err != nil {
+		t.Fatalf("Get on the replicas = %q, %v", v, err)
+	}
+
+	// the sentinel reports the replica as the master before its promotion
+	setNode(sentinel, func(n *fakeNode) { n.master, n.replicas = "10.0.1.2:6379", nil })
+	time.Sleep(50 * time.Millisecond)
+	if sp.MasterAddr() != "10.0.1.1:6379" {
+		t.Fatalf("switched to %s before its promotion", sp.MasterAddr())
+	}
+
+	setNode(replica, func(n *fakeNode) { n.role = "master" })
+	deadline := time.Now().Add(2 * time.Second)
+	for sp.MasterAddr() != "10.0.1.2:6379" {
+		if time.Now().After(deadline) {
+			t.Fatal("master not switched")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := c.Set(ctx, "k2", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := replica.do("GET", "k2"); v == nil {
+		t.Fatal("Set after failover did not reach the new master")
+	}
+	master.mu.Lock()
+	open := master.open
+	master.mu.Unlock()
+	if open != 0 {
+		t.Fatalf("%d connections to the old master left open", open)
+	}
+
+	sp.Close()
+	if _, err := c.Get(ctx, "k"); err != ErrSentinelPoolClosed {
+		t.Fatalf("Get after Close = %v", err)
+	}
+}
+
+func TestSentinelPoolRetry(t *testing.T) {
+	servers := &fakeServers{servers: map[string]*fakePool{}}
+	sentinel := servers.add("10.0.0.1:26379", "sentinel")
+	servers.add("10.0.1.1:6379", "master")
+	replica := servers.add("10.0.1.2:6379", "slave")
+	setNode(sentinel, func(n *fakeNode) { n.master = "10.0.1.1:6379" })
+
+	sp, err := newSentinelPool(SentinelOptions{
+		Addrs:         []string{"10.0.0.1:26379"},
+		MasterName:    "mymaster",
+		CheckInterval: time.Hour,
+		ErrorLog:      log.New(io.Discard, "", 0),
+	}, servers.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	if _, err := sp.masterPool(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the failover event comes before the promotion, the refresh it asks
+	// for fails and is tried again well before CheckInterval
+	setNode(sentinel, func(n *fakeNode) { n.master = "10.0.1.2:6379" })
+	sp.kick <- struct{}{}
+	time.Sleep(50 * time.Millisecond)
+	setNode(replica, func(n *fakeNode) { n.role = "master" })
+	deadline := time.Now().Add(2 * time.Second)
+	for sp.MasterAddr() != "10.0.1.2:6379" {
+		if time.Now().After(deadline) {
+			t.Fatal("master not switched")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSentinelPoolDialRole(t *testing.T) {
+	ctx := context.Background()
+	servers := &fakeServers{servers: map[string]*fakePool{}}
+	sentinel := servers.add("10.0.0.1:26379", "sentinel")
+	master := servers.add("10.0.1.1:6379", "master")
+	replica := servers.add("10.0.1.2:6379", "master")
+	setNode(sentinel, func(n *fakeNode) { n.master = "10.0.1.1:6379" })
+
+	sp, err := newSentinelPool(SentinelOptions{
+		Addrs:         []string{"10.0.0.1:26379"},
+		MasterName:    "mymaster",
+		CheckInterval: time.Hour,
+		ErrorLog:      log.New(io.Discard, "", 0),
+	}, servers.dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	c := NewClient(sp)
+	if err := c.Set(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the master was demoted while the sentinels were unreachable, a new
+	// connection to it fails and asks for a refresh
+	setNode(master, func(n *fakeNode) { n.role = "slave" })
+	setNode(sentinel, func(n *fakeNode) { n.master = "10.0.1.2:6379" })
+	conn, _ := sp.GetContext(ctx) // the idle connection, conn2 is dialed
+	conn2, err := sp.GetContext(ctx)
+	if err == nil {
+		_, err = conn2.Do("SET", "k", "v")
+		conn2.Close()
+	}
+	conn.Close()
+	if err == nil {
+		t.Fatal("new connection to a demoted master")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for sp.MasterAddr() != "10.0.1.2:6379" {
+		if time.Now().After(deadline) {
+			t.Fatal("master not switched")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := c.Set(ctx, "k2", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := replica.do("GET", "k2"); v == nil {
+		t.Fatal("Set did not reach the new master")
+	}
+}
+
+func TestSentinelPoolEvents(t *testing.T) {
+	sp := &SentinelPool{opts: SentinelOptions{MasterName: "mymaster"}, kick: make(chan struct{}, 1)}
+	sp.onEvent(context.Background(), Message{Channel: "+switch-master", Data: []byte("other 10.0.1.1 6379 10.0.1.2 6379")})
+	if len(sp.kick) != 0 {
+		t.Fatal("refresh for another master")
+	}
+	sp.onEvent(context.Background(), Message{Channel: "+sdown", Data: []byte("slave 10.0.1.2:6379 10.0.1.2 6379 @ mymaster 10.0.1.1 6379")})
+	if len(sp.kick) != 1 {
+		t.Fatal("no refresh for a replica of the master")
+	}
+}
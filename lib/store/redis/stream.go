@@ -0,0 +1,347 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// XMessage is an entry of a stream
+type XMessage struct {
+	ID     string
+	Values map[string]string
+}
+
+// XPendingEntry is a message delivered to a consumer of a group and not
+// acknowledged yet
+type XPendingEntry struct {
+	ID         string
+	Consumer   string
+	Idle       time.Duration
+	Deliveries int64
+}
+
+// STREAMS
+// --------------------------------------------------------------------------------
+
+// Xadd appends values, a map or a struct, to stream and returns the id of
+// the entry. With maxLen > 0 the stream is trimmed to about maxLen entries.
+func (c *Client) Xadd(ctx context.Context, stream string, maxLen int64, values interface{}) (string, error) {
+	args := redis.Args{}.Add(stream)
+	if maxLen > 0 {
+		args = args.Add("MAXLEN", "~", maxLen)
+	}
+	return redis.String(c.Do(ctx, "XADD", args.Add("*").AddFlat(values)...))
+}
+
+// XgroupCreate creates group on stream, and the stream if missing. The
+// group reads from start, "0" for the whole stream and "$" for new entries.
+// A group that already exists is not an error.
+func (c *Client) XgroupCreate(ctx context.Context, stream, group, start string) error {
+	_, err := c.Do(ctx, "XGROUP", "CREATE", stream, group, start, "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// Xreadgroup reads up to count messages of stream for consumer of group.
+// id ">" reads new messages, any other id the pending messages of the
+// consumer after it. With block > 0 it waits that long for new messages.
+func (c *Client) Xreadgroup(ctx context.Context, group, consumer, stream string, count int, block time.Duration, id string) ([]XMessage, error) {
+	args := redis.Args{}.Add("GROUP", group, consumer)
+	if count > 0 {
+		args = args.Add("COUNT", count)
+	}
+	if block > 0 {
+		args = args.Add("BLOCK", block.Milliseconds())
+	}
+	reply, err := redis.Values(c.Do(ctx, "XREADGROUP", args.Add("STREAMS", stream, id)...))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// one [stream, messages] pair per stream read
+	for _, s := range reply {
+		pair, err := redis.Values(s, nil)
+		if err != nil || len(pair) != 2 {
+			return nil, fmt.Errorf("redis: unexpected XREADGROUP reply %v", s)
+		}
+		return xmessages(pair[1], nil)
+	}
+	return nil, nil
+}
+
+// Xack acknowledges messages of group and returns how many were pending
+func (c *Client) Xack(ctx context.Context, stream, group string, ids ...string) (int64, error) {
+	return redis.Int64(c.Do(ctx, "XACK", redis.Args{}.Add(stream, group).AddFlat(ids)...))
+}
+
+// Xpending returns up to count pending messages of group, oldest first
+func (c *Client) Xpending(ctx context.Context, stream, group string, count int) ([]XPendingEntry, error) {
+	reply, err := redis.Values(c.Do(ctx, "XPENDING", stream, group, "-", "+", count))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]XPendingEntry, 0, len(reply))
+	for _, r := range reply {
+		var e XPendingEntry
+		var idle int64
+		fields, err := redis.Values(r, nil)
+		if err == nil {
+			_, err = redis.Scan(fields, &e.ID, &e.Consumer, &idle, &e.Deliveries)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("redis: unexpected XPENDING reply %v: %v", r, err)
+		}
+		e.Idle = time.Duration(idle) * time.Millisecond
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Xclaim moves the messages idle for at least minIdle to consumer and
+// returns them
+func (c *Client) Xclaim(ctx context.Context, stream, group, consumer string, minIdle time.Duration, ids ...string) ([]XMessage, error) {
+	args := redis.Args{}.Add(stream, group, consumer, minIdle.Milliseconds()).AddFlat(ids)
+	return xmessages(c.Do(ctx, "XCLAIM", args...))
+}
+
+// Xautoclaim moves up to count messages idle for at least minIdle, from
+// id start, to consumer. It returns them and the id to start the next
+// call from, "0-0" when the whole pending list was scanned.
+func (c *Client) Xautoclaim(ctx context.Context, stream, group, consumer string, minIdle time.Duration, start string, count int) (string, []XMessage, error) {
+	reply, err := redis.Values(c.Do(ctx, "XAUTOCLAIM", stream, group, consumer, minIdle.Milliseconds(), start, "COUNT", count))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(reply) < 2 {
+		return "", nil, fmt.Errorf("redis: unexpected XAUTOCLAIM reply %v", reply)
+	}
+	next, err := redis.String(reply[0], nil)
+	if err != nil {
+		return "", nil, err
+	}
+	msgs, err := xmessages(reply[1], nil)
+	return next, msgs, err
+}
+
+// xmessages converts a list of [id, [field, value, ...]] entries, leaving
+// out the entries deleted from the stream.
+func xmessages(reply interface{}, err error) ([]XMessage, error) {
+	entries, err := redis.Values(reply, err)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]XMessage, 0, len(entries))
+	for _, e := range entries {
+		if e == nil {
+			continue
+		}
+		pair, err := redis.Values(e, nil)
+		if err != nil || len(pair) != 2 {
+			return nil, fmt.Errorf("redis: unexpected stream entry %v", e)
+		}
+		if pair[1] == nil {
+			continue
+		}
+		id, err := redis.String(pair[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		values, err := redis.StringMap(pair[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, XMessage{ID: id, Values: values})
+	}
+	return msgs, nil
+}
+
+// StreamHandler processes a message of a stream. The message is
+// acknowledged when it returns nil and delivered again otherwise.
+type StreamHandler func(ctx context.Context, msg XMessage) error
+
+var (
+	// DefaultStreamCount is how many messages a StreamConsumer reads at
+	// once when its Count is 0
+	DefaultStreamCount = 10
+	// DefaultStreamBlock is how long a StreamConsumer waits for messages
+	// when its Block is 0
+	DefaultStreamBlock = 5 * time.Second
+	// DefaultClaimInterval is how often a StreamConsumer claims idle
+	// messages when its ClaimInterval is 0
+	DefaultClaimInterval = 30 * time.Second
+)
+
+// StreamConsumer reads a stream as a consumer of a group and runs Handler
+// for each message. Messages left pending by a failed handler, or by a
+// consumer that died, are claimed again once idle for ClaimIdle, so each
+// message is processed at least once.
+type StreamConsumer struct {
+	Client   *Client
+	Stream   string
+	Group    string
+	Consumer string
+	Handler  StreamHandler
+	// Count is the number of messages read at once
+	Count int
+	// Block is how long a read waits for new messages
+	Block time.Duration
+	// ClaimIdle is how long a message stays pending before it is claimed,
+	// 0 never claims
+	ClaimIdle time.Duration
+	// ClaimInterval is the time between two scans of the pending messages
+	ClaimInterval time.Duration
+	ErrorLog      *log.Logger
+}
+
+// NewStreamConsumer create a consumer with the default settings
+func NewStreamConsumer(c *Client, stream, group, consumer string, h StreamHandler) *StreamConsumer {
+	return &StreamConsumer{
+		Client:        c,
+		Stream:        stream,
+		Group:         group,
+		Consumer:      consumer,
+		Handler:       h,
+		Count:         DefaultStreamCount,
+		Block:         DefaultStreamBlock,
+		ClaimIdle:     time.Minute,
+		ClaimInterval: DefaultClaimInterval,
+	}
+}
+
+// Run creates the group if needed and processes messages until ctx is
+// done. The message being handled then completes, the messages read but
+// not handled stay pending and are delivered again to this consumer on
+// its next Run, or to another one after ClaimIdle. A Count, Block or
+// ClaimInterval of 0 runs with its default.
+func (s *StreamConsumer) Run(ctx context.Context) error {
+	if s.Count <= 0 || s.Block <= 0 || s.ClaimInterval <= 0 {
+		c := *s
+		if c.Count <= 0 {
+			c.Count = DefaultStreamCount
+		}
+		if c.Block <= 0 {
+			c.Block = DefaultStreamBlock
+		}
+		if c.ClaimInterval <= 0 {
+			c.ClaimInterval = DefaultClaimInterval
+		}
+		s = &c
+	}
+	if err := s.Client.XgroupCreate(ctx, s.Stream, s.Group, "0"); err != nil {
+		return err
+	}
+
+	// messages this consumer read before a restart come first
+	pending, after := true, "0"
+	var lastClaim time.Time
+	for ctx.Err() == nil {
+		if s.ClaimIdle > 0 && time.Since(lastClaim) >= s.ClaimInterval {
+			lastClaim = time.Now()
+			s.claim(ctx)
+		}
+
+		id := ">"
+		if pending {
+			id = after
+		}
+		msgs, err := s.Client.Xreadgroup(ctx, s.Group, s.Consumer, s.Stream, s.Count, s.block(pending), id)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			s.logf("redis: read %s of %s: %v", s.Stream, s.Group, err)
+			if strings.HasPrefix(err.Error(), "NOGROUP") {
+				s.Client.XgroupCreate(ctx, s.Stream, s.Group, "0")
+			}
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if pending {
+			if len(msgs) == 0 {
+				pending = false
+			} else {
+				after = msgs[len(msgs)-1].ID
+			}
+		}
+		s.handle(ctx, msgs)
+	}
+	return ctx.Err()
+}
+
+func (s *StreamConsumer) block(pending bool) time.Duration {
+	if pending {
+		return 0
+	}
+	// wake up for the next scan of the pending messages
+	if s.ClaimIdle > 0 && s.ClaimInterval < s.Block {
+		return s.ClaimInterval
+	}
+	return s.Block
+}
+
+// claim takes over the messages idle for ClaimIdle and handles them
+func (s *StreamConsumer) claim(ctx context.Context) {
+	start := "0-0"
+	for ctx.Err() == nil {
+		next, msgs, err := s.Client.Xautoclaim(ctx, s.Stream, s.Group, s.Consumer, s.ClaimIdle, start, s.Count)
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logf("redis: claim %s of %s: %v", s.Stream, s.Group, err)
+			}
+			return
+		}
+		s.handle(ctx, msgs)
+		if next == "0-0" || next == "" {
+			return
+		}
+		start = next
+	}
+}
+
+func (s *StreamConsumer) handle(ctx context.Context, msgs []XMessage) {
+	for _, msg := range msgs {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := s.run(ctx, msg); err != nil {
+			s.logf("redis: handle %s %s: %v", s.Stream, msg.ID, err)
+			continue
+		}
+		// acknowledge even when ctx is done, the message was handled
+		if _, err := s.Client.Xack(context.Background(), s.Stream, s.Group, msg.ID); err != nil {
+			s.logf("redis: ack %s %s: %v", s.Stream, msg.ID, err)
+		}
+	}
+}
+
+func (s *StreamConsumer) run(ctx context.Context, msg XMessage) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("redis: panic: %v", r)
+		}
+	}()
+	return s.Handler(ctx, msg)
+}
+
+func (s *StreamConsumer) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
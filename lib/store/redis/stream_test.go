@@ -0,0 +1,351 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStream is a stream of fakePool with its consumer groups.
+type fakeStream struct {
+	ids     []string
+	entries map[string][]interface{}
+	groups  map[string]*fakeGroup
+}
+
+type fakeGroup struct {
+	last    int // number of entries delivered
+	pending map[string]*fakePending
+}
+
+type fakePending struct {
+	consumer string
+	at       time.Time
+	count    int64
+}
+
+func seq(id string) int {
+	n, _ := strconv.Atoi(strings.TrimSuffix(id, "-0"))
+	return n
+}
+
+func (g *fakeGroup) deliver(consumer string, id string) {
+	p := g.pending[id]
+	if p == nil {
+		p = &fakePending{}
+		g.pending[id] = p
+	}
+	p.consumer, p.at = consumer, time.Now()
+	p.count++
+}
+
+// sortedPending returns the pending ids from start matching keep, in order.
+func (g *fakeGroup) sortedPending(start string, keep func(*fakePending) bool) []string {
+	var ids []string
+	for id, p := range g.pending {
+		if seq(id) >= seq(start) && keep(p) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return seq(ids[i]) < seq(ids[j]) })
+	return ids
+}
+
+func (s *fakeStream) entry(id string) interface{} {
+	return []interface{}{[]byte(id), s.entries[id]}
+}
+
+// stream runs the stream commands, p.mu is held.
+func (p *fakePool) stream(cmd string, args ...interface{}) (interface{}, error) {
+	a := make([]string, len(args))
+	for i, arg := range args {
+		a[i] = fmt.Sprint(arg)
+	}
+	if cmd == "XGROUP" {
+		a = a[1:]
+	}
+	if cmd == "XREADGROUP" {
+		a = append(a[len(a)-2:len(a)-1], a...)
+	}
+	s := p.streams[a[0]]
+	if s == nil {
+		if cmd != "XADD" && cmd != "XGROUP" {
+			return nil, errors.New("NOGROUP no such stream")
+		}
+		s = &fakeStream{entries: map[string][]interface{}{}, groups: map[string]*fakeGroup{}}
+		p.streams[a[0]] = s
+	}
+
+	switch cmd {
+	case "XADD":
+		i := 1
+		for a[i] != "*" {
+			i++
+		}
+		id := fmt.Sprintf("%d-0", len(s.ids)+1)
+		var fields []interface{}
+		for _, f := range a[i+1:] {
+			fields = append(fields, []byte(f))
+		}
+		s.ids = append(s.ids, id)
+		s.entries[id] = fields
+		return []byte(id), nil
+	case "XGROUP":
+		if s.groups[a[1]] != nil {
+			return nil, errors.New("BUSYGROUP Consumer Group name already exists")
+		}
+		g := &fakeGroup{pending: map[string]*fakePending{}}
+		if a[2] == "$" {
+			g.last = len(s.ids)
+		}
+		s.groups[a[1]] = g
+		return "OK", nil
+	}
+
+	group := a[1]
+	if cmd == "XREADGROUP" {
+		group = a[2]
+	}
+	g := s.groups[group]
+	if g == nil {
+		return nil, errors.New("NOGROUP no such group")
+	}
+
+	switch cmd {
+	case "XREADGROUP":
+		consumer, id, count, block := a[3], a[len(a)-1], 0, 0
+		for i := 4; i < len(a)-3; i += 2 {
+			n, _ := strconv.Atoi(a[i+1])
+			if a[i] == "COUNT" {
+				count = n
+			} else if a[i] == "BLOCK" {
+				block = n
+			}
+		}
+		var ids []string
+		if id == ">" {
+			ids = s.ids[g.last:]
+		} else {
+			ids = g.sortedPending(fmt.Sprintf("%d-0", seq(id)+1), func(e *fakePending) bool { return e.consumer == consumer })
+		}
+		if count > 0 && len(ids) > count {
+			ids = ids[:count]
+		}
+		if len(ids) == 0 {
+			if id != ">" {
+				return []interface{}{[]interface{}{[]byte(a[0]), []interface{}{}}}, nil
+			}
+			// wait a little without holding the pool
+			p.mu.Unlock()
+			time.Sleep(time.Duration(block) * time.Millisecond)
+			p.mu.Lock()
+			return nil, nil
+		}
+		var entries []interface{}
+		for _, id := range ids {
+			g.deliver(consumer, id)
+			entries = append(entries, s.entry(id))
+		}
+		if id == ">" {
+			g.last += len(ids)
+		}
+		return []interface{}{[]interface{}{[]byte(a[0]), entries}}, nil
+	case "XACK":
+		n := int64(0)
+		for _, id := range a[2:] {
+			if g.pending[id] != nil {
+				delete(g.pending, id)
+				n++
+			}
+		}
+		return n, nil
+	case "XPENDING":
+		var reply []interface{}
+		for _, id := range g.sortedPending("0-0", func(*fakePending) bool { return true }) {
+			e := g.pending[id]
+			reply = append(reply, []interface{}{[]byte(id), []byte(e.consumer), time.Since(e.at).Milliseconds(), e.count})
+		}
+		return reply, nil
+	case "XCLAIM", "XAUTOCLAIM":
+		minIdle, _ := strconv.Atoi(a[3])
+		idle := func(e *fakePending) bool { return time.Since(e.at) >= time.Duration(minIdle)*time.Millisecond }
+		var ids []string
+		next := "0-0"
+		if cmd == "XCLAIM" {
+			for _, id := range a[4:] {
+				if e := g.pending[id]; e != nil && idle(e) {
+					ids = append(ids, id)
+				}
+			}
+		} else {
+			ids = g.sortedPending(a[4], idle)
+			if count, _ := strconv.Atoi(a[6]); len(ids) > count {
+				next, ids = ids[count], ids[:count]
+			}
+		}
+		entries := []interface{}{}
+		for _, id := range ids {
+			g.deliver(a[2], id)
+			entries = append(entries, s.entry(id))
+		}
+		if cmd == "XCLAIM" {
+			return entries, nil
+		}
+		return []interface{}{[]byte(next), entries, []interface{}{}}, nil
+	}
+	return nil, fmt.Errorf("unexpected %s", cmd)
+}
+
+func TestStreamCommands(t *testing.T) {
+	ctx := context.Background()
+	c := NewClient(newFakePool())
+
+	for _, v := range []string{"a", "b"} {
+		if _, err := c.Xadd(ctx, "s", 1000, map[string]string{"v": v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.XgroupCreate(ctx, "s", "g", "0"); err != nil {
+			t.Fatalf("XgroupCreate %d = %v", i, err)
+		}
+	}
+
+	msgs, err := c.Xreadgroup(ctx, "g", "one", "s", 10, 0, ">")
+	if err != nil || len(msgs) != 2 || msgs[0].Values["v"] != "a" || msgs[1].Values["v"] != "b" {
+		t.Fatalf("Xreadgroup = %+v, %v", msgs, err)
+	}
+	if msgs, err := c.Xreadgroup(ctx, "g", "one", "s", 10, 0, ">"); len(msgs) != 0 || err != nil {
+		t.Fatalf("second Xreadgroup = %+v, %v", msgs, err)
+	}
+	if n, err := c.Xack(ctx, "s", "g", msgs[0].ID); n != 1 || err != nil {
+		t.Fatalf("Xack = %d, %v", n, err)
+	}
+
+	claimed, err := c.Xclaim(ctx, "s", "g", "two", 0, msgs[1].ID)
+	if err != nil || len(claimed) != 1 || claimed[0].ID != msgs[1].ID {
+		t.Fatalf("Xclaim = %+v, %v", claimed, err)
+	}
+	pending, err := c.Xpending(ctx, "s", "g", 10)
+	if err != nil || len(pending) != 1 || pending[0].Consumer != "two" || pending[0].Deliveries != 2 {
+		t.Fatalf("Xpending = %+v, %v", pending, err)
+	}
+
+	next, claimed, err := c.Xautoclaim(ctx, "s", "g", "three", time.Hour, "0-0", 10)
+	if err != nil || next != "0-0" || len(claimed) != 0 {
+		t.Fatalf("Xautoclaim of busy messages = %s, %+v, %v", next, claimed, err)
+	}
+	next, claimed, err = c.Xautoclaim(ctx, "s", "g", "three", 0, "0-0", 10)
+	if err != nil || next != "0-0" || len(claimed) != 1 || claimed[0].Values["v"] != "b" {
+		t.Fatalf("Xautoclaim = %s, %+v, %v", next, claimed, err)
+	}
+}
+
+func TestStreamConsumer(t *testing.T) {
+	ctx := context.Background()
+	c := NewClient(newFakePool())
+	c.XgroupCreate(ctx, "s", "g", "0")
+	for _, v := range []string{"lost", "flaky", "ok"} {
+		c.Xadd(ctx, "s", 0, map[string]string{"v": v})
+	}
+	// a consumer reads the first message and dies
+	if msgs, err := c.Xreadgroup(ctx, "g", "dead", "s", 1, 0, ">"); len(msgs) != 1 || err != nil {
+		t.Fatalf("Xreadgroup = %+v, %v", msgs, err)
+	}
+
+	var mu sync.Mutex
+	handled, ok := map[string]int{}, map[string]bool{}
+	done := make(chan struct{})
+	s := NewStreamConsumer(c, "s", "g", "live", func(ctx context.Context, msg XMessage) error {
+		mu.Lock()
+		defer mu.Unlock()
+		v := msg.Values["v"]
+		handled[v]++
+		if v == "flaky" && handled[v] == 1 {
+			return errors.New("first try fails")
+		}
+		ok[v] = true
+		if len(ok) == 3 {
+			select {
+			case <-done:
+			default:
+				close(done)
+			}
+		}
+		return nil
+	})
+	s.Block = 5 * time.Millisecond
+	s.ClaimIdle = 20 * time.Millisecond
+	s.ClaimInterval = 5 * time.Millisecond
+	s.ErrorLog = log.New(io.Discard, "", 0)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	stopped := make(chan error)
+	go func() { stopped <- s.Run(runCtx) }()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("handled %v", handled)
+	}
+	cancel()
+	if err := <-stopped; err != context.Canceled {
+		t.Fatalf("Run = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if handled["lost"] != 1 || handled["ok"] != 1 || handled["flaky"] != 2 {
+		t.Fatalf("handled %v", handled)
+	}
+	if pending, _ := c.Xpending(ctx, "s", "g", 10); len(pending) != 0 {
+		t.Fatalf("left pending: %+v", pending)
+	}
+}
+
+func TestStreamConsumerDefaults(t *testing.T) {
+	defer func(block time.Duration) { DefaultStreamBlock = block }(DefaultStreamBlock)
+	DefaultStreamBlock = 10 * time.Millisecond
+
+	p := newFakePool()
+	s := &StreamConsumer{
+		Client:    NewClient(p),
+		Stream:    "s",
+		Group:     "g",
+		Consumer:  "c",
+		Handler:   func(context.Context, XMessage) error { return nil },
+		ClaimIdle: time.Minute,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Run = %v", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var reads, claims int
+	for _, cmd := range p.cmds {
+		switch {
+		case strings.HasPrefix(cmd, "XREADGROUP"):
+			reads++
+			// fmt.Sprint joins the args, the new messages are read with ">"
+			if !strings.Contains(cmd, "COUNT10") || strings.HasSuffix(cmd, ">") && !strings.Contains(cmd, "BLOCK10") {
+				t.Fatalf("sent %q without the default COUNT and BLOCK", cmd)
+			}
+		case strings.HasPrefix(cmd, "XAUTOCLAIM"):
+			claims++
+		}
+	}
+	// the first read of the pending messages does not block
+	if reads > 10 || claims != 1 {
+		t.Fatalf("%d reads and %d claims in 50ms, the consumer spins", reads, claims)
+	}
+}
@@ -0,0 +1,288 @@
+package redis
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// DefaultHealthInterval is the time between two pings of a Subscriber
+var DefaultHealthInterval = 30 * time.Second
+
+// Message is a message published to a channel
+type Message struct {
+	Channel string
+	// Pattern is the pattern matching Channel, for PSubscribe
+	Pattern string
+	Data    []byte
+}
+
+// MessageHandler is called for each message, on the receiving goroutine of
+// the Subscriber, so it should return quickly
+type MessageHandler func(ctx context.Context, msg Message)
+
+// Subscriber keeps a Pub/Sub connection open and delivers the messages of
+// its channels and patterns to their handlers. A lost connection is dialed
+// again with backoff and its subscriptions are restored, while pings check
+// the connection is alive.
+type Subscriber struct {
+	// Dial opens the Pub/Sub connection
+	Dial func(ctx context.Context) (redis.Conn, error)
+	// HealthInterval is the time between two pings, the connection is
+	// dropped when nothing is received for twice that long
+	HealthInterval time.Duration
+	// Backoff is the wait before a reconnect, by attempt
+	Backoff  func(attempt int) time.Duration
+	ErrorLog *log.Logger
+
+	mu       sync.Mutex
+	conn     *redis.PubSubConn
+	channels map[string]MessageHandler
+	patterns map[string]MessageHandler
+	chans    []chan Message
+}
+
+// NewSubscriber create a subscriber opening its connections with dial
+func NewSubscriber(dial func(ctx context.Context) (redis.Conn, error)) *Subscriber {
+	return &Subscriber{
+		Dial:     dial,
+		channels: make(map[string]MessageHandler),
+		patterns: make(map[string]MessageHandler),
+	}
+}
+
+// Subscriber create a subscriber using a connection of the pool
+func (c *Client) Subscriber() *Subscriber {
+	return NewSubscriber(c.pool.GetContext)
+}
+
+// Subscribe delivers the messages of channels to h. The subscription is
+// kept when sending it fails, it is sent again on the next connection.
+func (s *Subscriber) Subscribe(h MessageHandler, channels ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(s.channels, h, channels, "SUBSCRIBE")
+}
+
+// PSubscribe delivers the messages of the channels matching patterns to h
+func (s *Subscriber) PSubscribe(h MessageHandler, patterns ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(s.patterns, h, patterns, "PSUBSCRIBE")
+}
+
+// Unsubscribe stops the delivery of the messages of channels
+func (s *Subscriber) Unsubscribe(channels ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(s.channels, channels, "UNSUBSCRIBE")
+}
+
+// PUnsubscribe stops the delivery of the messages matching patterns
+func (s *Subscriber) PUnsubscribe(patterns ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remove(s.patterns, patterns, "PUNSUBSCRIBE")
+}
+
+// Chan returns a handler sending messages to the returned channel, which
+// buffers size messages. The handler waits when the channel is full, and
+// the channel is closed when Run returns.
+func (s *Subscriber) Chan(size int) (MessageHandler, <-chan Message) {
+	ch := make(chan Message, size)
+	s.mu.Lock()
+	s.chans = append(s.chans, ch)
+	s.mu.Unlock()
+	return func(ctx context.Context, msg Message) {
+		select {
+		case ch <- msg:
+		case <-ctx.Done():
+		}
+	}, ch
+}
+
+func (s *Subscriber) add(m map[string]MessageHandler, h MessageHandler, names []string, cmd string) error {
+	for _, name := range names {
+		m[name] = h
+	}
+	return s.send(cmd, names)
+}
+
+func (s *Subscriber) remove(m map[string]MessageHandler, names []string, cmd string) error {
+	for _, name := range names {
+		delete(m, name)
+	}
+	return s.send(cmd, names)
+}
+
+// send sends cmd on the current connection, s.mu is held
+func (s *Subscriber) send(cmd string, names []string) error {
+	if s.conn == nil || len(names) == 0 {
+		return nil
+	}
+	if err := s.conn.Conn.Send(cmd, redis.Args{}.AddFlat(names)...); err != nil {
+		return err
+	}
+	return s.conn.Conn.Flush()
+}
+
+// Run connects and delivers messages until ctx is done, reconnecting
+// when the connection is lost. It returns ctx.Err().
+func (s *Subscriber) Run(ctx context.Context) error {
+	defer func() {
+		s.mu.Lock()
+		for _, ch := range s.chans {
+			close(ch)
+		}
+		s.chans = nil
+		s.mu.Unlock()
+	}()
+
+	attempt := 0
+	for {
+		connected, err := s.serve(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if connected {
+			attempt = 0
+		}
+		attempt++
+		s.logf("redis: subscriber: %v, reconnecting", err)
+		select {
+		case <-time.After(s.backoff(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// serve runs one connection until it fails
+func (s *Subscriber) serve(ctx context.Context) (bool, error) {
+	conn, err := s.Dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	psc := &redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+
+	s.mu.Lock()
+	s.conn = psc
+	err = s.resubscribe()
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+	}()
+	if err != nil {
+		return false, err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.ping(stop)
+
+	interval := s.healthInterval()
+	for {
+		rctx, cancel := ctx, context.CancelFunc(func() {})
+		if s.subscribed() {
+			rctx, cancel = context.WithTimeout(ctx, 2*interval)
+		}
+		reply := psc.ReceiveContext(rctx)
+		cancel()
+		switch v := reply.(type) {
+		case redis.Message:
+			s.deliver(ctx, v)
+		case error:
+			return true, v
+		}
+	}
+}
+
+// resubscribe subscribes the new connection, s.mu is held
+func (s *Subscriber) resubscribe() error {
+	channels := make([]string, 0, len(s.channels))
+	for name := range s.channels {
+		channels = append(channels, name)
+	}
+	patterns := make([]string, 0, len(s.patterns))
+	for name := range s.patterns {
+		patterns = append(patterns, name)
+	}
+	if err := s.send("SUBSCRIBE", channels); err != nil {
+		return err
+	}
+	return s.send("PSUBSCRIBE", patterns)
+}
+
+func (s *Subscriber) subscribed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.channels)+len(s.patterns) > 0
+}
+
+// ping pings the connection while it is subscribed, redis only answers a
+// PING in Pub/Sub mode
+func (s *Subscriber) ping(stop chan struct{}) {
+	ticker := time.NewTicker(s.healthInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		s.mu.Lock()
+		if s.conn != nil && len(s.channels)+len(s.patterns) > 0 {
+			s.conn.Ping("")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Subscriber) deliver(ctx context.Context, m redis.Message) {
+	s.mu.Lock()
+	var h MessageHandler
+	if m.Pattern != "" {
+		h = s.patterns[m.Pattern]
+	} else {
+		h = s.channels[m.Channel]
+	}
+	s.mu.Unlock()
+	if h != nil {
+		h(ctx, Message{Channel: m.Channel, Pattern: m.Pattern, Data: m.Data})
+	}
+}
+
+func (s *Subscriber) healthInterval() time.Duration {
+	if s.HealthInterval > 0 {
+		return s.HealthInterval
+	}
+	return DefaultHealthInterval
+}
+
+func (s *Subscriber) backoff(attempt int) time.Duration {
+	if s.Backoff != nil {
+		return s.Backoff(attempt)
+	}
+	d := 100 * time.Millisecond
+	for i := 1; i < attempt && d < 30*time.Second; i++ {
+		d *= 2
+	}
+	if d > 30*time.Second {
+		d = 30 * time.Second
+	}
+	return d
+}
+
+func (s *Subscriber) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,220 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakeHub is a Pub/Sub server for fakePubSubConn.
+type fakeHub struct {
+	mu        sync.Mutex
+	conns     []*fakePubSubConn
+	dials     int
+	failDials int
+}
+
+func (h *fakeHub) dial(ctx context.Context) (redis.Conn, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.dials++
+	if h.dials <= h.failDials {
+		return nil, errors.New("connection refused")
+	}
+	c := &fakePubSubConn{
+		replies: make(chan interface{}, 100),
+		closed:  make(chan struct{}),
+		subs:    make(map[string]bool),
+	}
+	h.conns = append(h.conns, c)
+	return c, nil
+}
+
+func (h *fakeHub) dialCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dials
+}
+
+func (h *fakeHub) publish(channel, data string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.conns {
+		c.mu.Lock()
+		for sub := range c.subs {
+			switch {
+			case sub == "c:"+channel:
+				c.push("message", channel, data)
+			case sub[:2] == "p:":
+				if ok, _ := path.Match(sub[2:], channel); ok {
+					c.push("pmessage", sub[2:], channel, data)
+				}
+			}
+		}
+		c.mu.Unlock()
+	}
+}
+
+// drop breaks the open connections, or makes them silent.
+func (h *fakeHub) drop(silent bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.conns {
+		if silent {
+			c.mu.Lock()
+			c.silent = true
+			c.mu.Unlock()
+		} else {
+			c.Close()
+		}
+	}
+	h.conns = nil
+}
+
+type fakePubSubConn struct {
+	mu      sync.Mutex
+	replies chan interface{}
+	closed  chan struct{}
+	once    sync.Once
+	subs    map[string]bool
+	silent  bool
+}
+
+// push queues a reply, c.mu is held
+func (c *fakePubSubConn) push(args ...interface{}) {
+	if c.silent {
+		return
+	}
+	reply := make([]interface{}, len(args))
+	for i, a := range args {
+		if s, ok := a.(string); ok {
+			a = []byte(s)
+		}
+		reply[i] = a
+	}
+	c.replies <- reply
+}
+
+func (c *fakePubSubConn) Send(cmd string, args ...interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range args {
+		name := a.(string)
+		switch cmd {
+		case "SUBSCRIBE":
+			c.subs["c:"+name] = true
+		case "PSUBSCRIBE":
+			c.subs["p:"+name] = true
+		case "UNSUBSCRIBE":
+			delete(c.subs, "c:"+name)
+		case "PUNSUBSCRIBE":
+			delete(c.subs, "p:"+name)
+		case "PING":
+			c.push("pong", "")
+			continue
+		}
+		c.push(map[string]string{"SUBSCRIBE": "subscribe", "PSUBSCRIBE": "psubscribe",
+			"UNSUBSCRIBE": "unsubscribe", "PUNSUBSCRIBE": "punsubscribe"}[cmd], name, int64(len(c.subs)))
+	}
+	return nil
+}
+
+func (c *fakePubSubConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	select {
+	case r := <-c.replies:
+		return r, nil
+	case <-c.closed:
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakePubSubConn) Receive() (interface{}, error) {
+	return c.ReceiveContext(context.Background())
+}
+
+func (c *fakePubSubConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *fakePubSubConn) Err() error   { return nil }
+func (c *fakePubSubConn) Flush() error { return nil }
+
+func (c *fakePubSubConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c *fakePubSubConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestSubscriber(t *testing.T) {
+	hub := &fakeHub{failDials: 1}
+	s := NewSubscriber(hub.dial)
+	s.HealthInterval = 10 * time.Millisecond
+	s.Backoff = func(int) time.Duration { return time.Millisecond }
+	s.ErrorLog = log.New(io.Discard, "", 0)
+
+	h, news := s.Chan(10)
+	s.Subscribe(h, "news")
+	users := make(chan Message, 10)
+	s.PSubscribe(func(ctx context.Context, msg Message) { users <- msg }, "user.*")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error)
+	go func() { stopped <- s.Run(ctx) }()
+
+	// publish until a connection is subscribed
+	receive := func(ch <-chan Message, channel, data string) Message {
+		t.Helper()
+		deadline := time.After(2 * time.Second)
+		for {
+			hub.publish(channel, data)
+			select {
+			case msg := <-ch:
+				if string(msg.Data) == data {
+					return msg
+				}
+			case <-time.After(5 * time.Millisecond):
+			case <-deadline:
+				t.Fatalf("%s not received", data)
+			}
+		}
+	}
+	if msg := receive(news, "news", "a"); msg.Channel != "news" {
+		t.Fatalf("message %+v", msg)
+	}
+	if msg := receive(users, "user.1", "joined"); msg.Pattern != "user.*" || msg.Channel != "user.1" {
+		t.Fatalf("pattern message %+v", msg)
+	}
+
+	// the subscriptions are restored after a reconnect
+	hub.drop(false)
+	receive(news, "news", "b")
+	receive(users, "user.2", "left")
+
+	// a connection not answering pings is replaced
+	dials := hub.dialCount()
+	hub.drop(true)
+	receive(news, "news", "c")
+	if hub.dialCount() <= dials {
+		t.Fatal("silent connection not replaced")
+	}
+
+	s.Unsubscribe("news")
+	cancel()
+	if err := <-stopped; err != context.Canceled {
+		t.Fatalf("Run = %v", err)
+	}
+	for range news {
+	}
+}
@@ -0,0 +1,130 @@
+package task
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// AdminHandler serves the tasks of a Scheduler as JSON:
+//
+//	GET    /                  list the tasks, next to run first
+//	GET    /{name}            status of a task
+//	POST   /{name}/run        run a task now
+//	POST   /{name}/pause      stop running a task
+//	POST   /{name}/resume     run a paused task again
+//	POST   /{name}/spec       change the spec, from the form value "spec"
+//	POST   /{name}/delete     remove a task, DELETE /{name} does the same
+//
+// Mount it under a prefix with http.StripPrefix, and behind authentication:
+// it lets anyone who reaches it run any task.
+type AdminHandler struct {
+	Scheduler *Scheduler
+}
+
+// NewAdminHandler create an AdminHandler for s, DefaultScheduler when nil
+func NewAdminHandler(s *Scheduler) *AdminHandler {
+	if s == nil {
+		s = DefaultScheduler
+	}
+	return &AdminHandler{Scheduler: s}
+}
+
+// ServeHTTP implements http.Handler
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if path == "" {
+			h.list(w)
+			return
+		}
+		h.status(w, path)
+	case http.MethodDelete:
+		h.act(w, r, path, "delete")
+	case http.MethodPost:
+		i := strings.LastIndex(path, "/")
+		if i < 0 {
+			writeError(w, http.StatusNotFound, "unknown action")
+			return
+		}
+		h.act(w, r, path[:i], path[i+1:])
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *AdminHandler) list(w http.ResponseWriter) {
+	tasks := h.Scheduler.List()
+	list := make([]TaskStatus, 0, len(tasks))
+	for _, t := range tasks {
+		list = append(list, t.Status())
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *AdminHandler) status(w http.ResponseWriter, name string) {
+	t, ok := h.Scheduler.Get(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrTaskNotFound.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, t.Status())
+}
+
+func (h *AdminHandler) act(w http.ResponseWriter, r *http.Request, name, action string) {
+	s := h.Scheduler
+	if _, ok := s.Get(name); !ok {
+		writeError(w, http.StatusNotFound, ErrTaskNotFound.Error())
+		return
+	}
+	var err error
+	code := http.StatusOK
+	switch action {
+	case "run":
+		err = s.Trigger(name)
+		code = http.StatusAccepted
+	case "pause":
+		err = s.Pause(name)
+	case "resume":
+		err = s.Resume(name)
+	case "spec":
+		spec := strings.TrimSpace(r.FormValue("spec"))
+		if spec == "" {
+			writeError(w, http.StatusBadRequest, "missing spec")
+			return
+		}
+		if err = s.SetSpec(name, spec); err != nil && err != ErrTaskNotFound {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	case "delete":
+		s.Remove(name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeError(w, http.StatusNotFound, "unknown action")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	t, ok := s.Get(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrTaskNotFound.Error())
+		return
+	}
+	writeJSON(w, code, t.Status())
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,75 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminHandler(t *testing.T) {
+	ran := make(chan struct{}, 1)
+	s := NewScheduler()
+	s.Add(NewTask("report", "0 0 2 * * *", func() error {
+		ran <- struct{}{}
+		return nil
+	}))
+	defer s.Stop(context.Background())
+	srv := httptest.NewServer(http.StripPrefix("/tasks", NewAdminHandler(s)))
+	defer srv.Close()
+
+	do := func(method, path string, form url.Values) (int, TaskStatus) {
+		req, _ := http.NewRequest(method, srv.URL+"/tasks"+path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var st TaskStatus
+		json.NewDecoder(resp.Body).Decode(&st)
+		return resp.StatusCode, st
+	}
+
+	resp, err := http.Get(srv.URL + "/tasks/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []TaskStatus
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || list[0].Name != "report" {
+		t.Fatalf("list = %+v", list)
+	}
+
+	if code, st := do("POST", "/report/pause", nil); code != 200 || !st.Paused {
+		t.Fatalf("pause = %d %+v", code, st)
+	}
+	if code, _ := do("POST", "/report/run", nil); code != 202 {
+		t.Fatalf("run = %d", code)
+	}
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("task did not run")
+	}
+	if code, st := do("POST", "/report/resume", nil); code != 200 || st.Paused {
+		t.Fatalf("resume = %d %+v", code, st)
+	}
+	if code, _ := do("POST", "/report/spec", url.Values{"spec": {"bad spec"}}); code != 400 {
+		t.Fatalf("bad spec = %d", code)
+	}
+	if code, st := do("POST", "/report/spec", url.Values{"spec": {"0 30 3 * * *"}}); code != 200 || st.Spec != "0 30 3 * * *" {
+		t.Fatalf("spec = %d %+v", code, st)
+	}
+	if code, _ := do("DELETE", "/report", nil); code != 204 {
+		t.Fatalf("delete = %d", code)
+	}
+	if code, _ := do("GET", "/report", nil); code != 404 {
+		t.Fatalf("status after delete = %d", code)
+	}
+}
@@ -0,0 +1,145 @@
+package task
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// parseDays parses the day of month field, which besides ranges takes
+// L, L-n, LW and nW.
+func parseDays(field string, s *Schedule) error {
+	for _, expr := range strings.FieldsFunc(field, func(r rune) bool { return r == ',' }) {
+		up := strings.ToUpper(expr)
+		switch {
+		case up == "L":
+			s.lastDays = append(s.lastDays, 0)
+		case up == "LW":
+			s.lastWorkday = true
+		case strings.HasPrefix(up, "L-"):
+			n, err := parseInt(up[2:])
+			if err != nil {
+				return err
+			}
+			if n >= days.max {
+				return fmt.Errorf("offset from last day (%d) above maximum (%d): %s", n, days.max-1, expr)
+			}
+			s.lastDays = append(s.lastDays, n)
+		case len(up) > 1 && strings.HasSuffix(up, "W"):
+			n, err := parseInt(up[:len(up)-1])
+			if err != nil {
+				return err
+			}
+			if n < days.min || n > days.max {
+				return fmt.Errorf("day of month (%d) out of range [%d, %d]: %s", n, days.min, days.max, expr)
+			}
+			s.nearWorkday |= 1 << n
+		default:
+			bits, err := getRange(expr, days)
+			if err != nil {
+				return err
+			}
+			s.Day |= bits
+		}
+	}
+	return nil
+}
+
+// parseWeeks parses the day of week field, which besides ranges takes
+// L (Saturday), dL and d#n.
+func parseWeeks(field string, s *Schedule) error {
+	for _, expr := range strings.FieldsFunc(field, func(r rune) bool { return r == ',' }) {
+		up := strings.ToUpper(expr)
+		switch {
+		case up == "L":
+			s.Week |= 1 << weeks.max
+		case strings.Contains(up, "#"):
+			parts := strings.SplitN(expr, "#", 2)
+			d, err := parseIntOrName(parts[0], weeks.names)
+			if err != nil {
+				return err
+			}
+			n, err := parseInt(parts[1])
+			if err != nil {
+				return err
+			}
+			if d > weeks.max {
+				return fmt.Errorf("day of week (%d) above maximum (%d): %s", d, weeks.max, expr)
+			}
+			if n < 1 || n > 5 {
+				return fmt.Errorf("week of month (%d) out of range [1, 5]: %s", n, expr)
+			}
+			s.nthWeekday[d] |= 1 << (n - 1)
+		case len(up) > 1 && strings.HasSuffix(up, "L"):
+			d, err := parseIntOrName(expr[:len(expr)-1], weeks.names)
+			if err != nil {
+				return err
+			}
+			if d > weeks.max {
+				return fmt.Errorf("day of week (%d) above maximum (%d): %s", d, weeks.max, expr)
+			}
+			s.lastWeekday |= 1 << d
+		default:
+			bits, err := getRange(expr, weeks)
+			if err != nil {
+				return err
+			}
+			s.Week |= bits
+		}
+	}
+	return nil
+}
+
+// extraDayMatches reports whether t matches L, LW or W in the day field.
+func (s *Schedule) extraDayMatches(t time.Time) bool {
+	last := uint(daysIn(t))
+	day := uint(t.Day())
+	for _, n := range s.lastDays {
+		if day+n == last {
+			return true
+		}
+	}
+	if s.lastWorkday && day == nearestWorkday(t, last, last) {
+		return true
+	}
+	if s.nearWorkday != 0 {
+		for n := days.min; n <= last; n++ {
+			if s.nearWorkday&(1<<n) != 0 && day == nearestWorkday(t, n, last) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// extraWeekMatches reports whether t matches dL or d#n in the week field.
+func (s *Schedule) extraWeekMatches(t time.Time) bool {
+	wd := uint(t.Weekday())
+	if s.lastWeekday&(1<<wd) != 0 && t.Day()+7 > daysIn(t) {
+		return true
+	}
+	return s.nthWeekday[wd]&(1<<uint((t.Day()-1)/7)) != 0
+}
+
+// daysIn returns the number of days in the month of t.
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// nearestWorkday returns the Monday to Friday day nearest to day n of the
+// month of t, staying within the month.
+func nearestWorkday(t time.Time, n, last uint) uint {
+	switch time.Date(t.Year(), t.Month(), int(n), 0, 0, 0, 0, time.UTC).Weekday() {
+	case time.Saturday:
+		if n == 1 {
+			return n + 2
+		}
+		return n - 1
+	case time.Sunday:
+		if n == last {
+			return n - 2
+		}
+		return n + 1
+	}
+	return n
+}
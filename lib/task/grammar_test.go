@@ -0,0 +1,83 @@
+package task
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExtendedGrammar(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	from := at("2024-02-01 00:00:00")
+
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"0 0 18 L * ?", []string{"2024-02-29 18:00:00", "2024-03-31 18:00:00", "2024-04-30 18:00:00"}},
+		{"0 0 18 L-2 * ?", []string{"2024-02-27 18:00:00", "2024-03-29 18:00:00"}},
+		// 2024-03-31 is a Sunday.
+		{"0 0 9 LW * ?", []string{"2024-02-29 09:00:00", "2024-03-29 09:00:00"}},
+		// The 1st of June 2024 is a Saturday, the 15th of June a Saturday and
+		// the 16th of June a Sunday.
+		{"0 0 9 1W 6 ?", []string{"2024-06-03 09:00:00", "2025-06-02 09:00:00"}},
+		{"0 0 9 15W,16W 6 ?", []string{"2024-06-14 09:00:00", "2024-06-17 09:00:00", "2025-06-16 09:00:00"}},
+		{"0 0 10 ? * fri#3", []string{"2024-02-16 10:00:00", "2024-03-15 10:00:00"}},
+		{"0 0 10 ? * 1#5", []string{"2024-04-29 10:00:00", "2024-07-29 10:00:00"}},
+		{"0 0 10 ? * 5L", []string{"2024-02-23 10:00:00", "2024-03-29 10:00:00"}},
+		{"0 0 10 ? * L", []string{"2024-02-03 10:00:00", "2024-02-10 10:00:00"}},
+		{"@every 1h30m", []string{"2024-02-01 01:30:00", "2024-02-01 03:00:00", "2024-02-01 04:30:00"}},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		got := s.NextN(from, len(tt.want))
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: NextN = %v, want %v", tt.spec, got, tt.want)
+			continue
+		}
+		for i, w := range tt.want {
+			if !got[i].Equal(at(w)) {
+				t.Errorf("%q: fire %d = %v, want %s", tt.spec, i, got[i], w)
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * * *",
+		"* * * 32W * *",
+		"* * * L-31 * *",
+		"* * * ? * fri#6",
+		"* * * ? * 8L",
+		"* * * * * mon-",
+		"*/0 * * * * *",
+		"@every 10ms",
+		"@every soon",
+		"@fortnightly",
+		"CRON_TZ=Mars/Olympus 0 0 9 * * *",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+
+	tk := NewTask("t", "0 0 9 * * *", func() error { return nil })
+	if err := tk.SetCron("0 0 25 * * *"); err == nil {
+		t.Error("SetCron accepted hour 25")
+	}
+	if tk.Spec.Hour != 1<<9 {
+		t.Error("a failed SetCron changed the schedule")
+	}
+}
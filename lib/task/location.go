@@ -0,0 +1,216 @@
+package task
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Option configures NewTask and NewSyncTask
+type Option func(*taskOptions)
+
+type taskOptions struct {
+	location *time.Location
+	timeout  time.Duration
+	retry    RetryPolicy
+	history  int
+	misfire  MisfirePolicy
+}
+
+// WithLocation evaluates the spec in loc instead of the location of the
+// scheduler clock. A CRON_TZ= prefix in the spec takes precedence.
+func WithLocation(loc *time.Location) Option {
+	return func(o *taskOptions) {
+		o.location = loc
+	}
+}
+
+// WithTimeout cancels the context of each attempt after d
+func WithTimeout(d time.Duration) Option {
+	return func(o *taskOptions) {
+		o.timeout = d
+	}
+}
+
+// WithRetry runs a failed task again following p
+func WithRetry(p RetryPolicy) Option {
+	return func(o *taskOptions) {
+		o.retry = p
+	}
+}
+
+// WithHistory keeps the last n runs in the task status
+func WithHistory(n int) Option {
+	return func(o *taskOptions) {
+		o.history = n
+	}
+}
+
+// WithMisfire sets what the task does with the runs it missed while the
+// process was down
+func WithMisfire(p MisfirePolicy) Option {
+	return func(o *taskOptions) {
+		o.misfire = p
+	}
+}
+
+func applyOptions(opts []Option) taskOptions {
+	var o taskOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// splitLocation strips a "CRON_TZ=Asia/Shanghai " or "TZ=..." prefix from
+// spec and returns the location it names, nil without one.
+func splitLocation(spec string) (*time.Location, string, error) {
+	spec = strings.TrimSpace(spec)
+	var name string
+	switch {
+	case strings.HasPrefix(spec, "CRON_TZ="):
+		name = spec[len("CRON_TZ="):]
+	case strings.HasPrefix(spec, "TZ="):
+		name = spec[len("TZ="):]
+	default:
+		return nil, spec, nil
+	}
+	rest := ""
+	if i := strings.IndexAny(name, " \t"); i >= 0 {
+		name, rest = name[:i], strings.TrimSpace(name[i:])
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load location %s: %s", name, err)
+	}
+	return loc, rest, nil
+}
+
+// Next returns the first time after t the schedule fires, in the location
+// of the schedule, or of t when the schedule has none.
+//
+// Schedules follow the wall clock across daylight saving changes, the way
+// Vixie cron does:
+//   - a wall time skipped when clocks go forward fires once, at the first
+//     instant after the gap, so 02:30 runs at 03:00 on that day;
+//   - a wall time repeated when clocks go back fires once, the first time
+//     it occurs, when the spec has a fixed minute and hour, so 01:30 does
+//     not run again an hour later;
+//   - specs with a * in the minute or hour field fire by the clock, so
+//     "0 45 * * * *" runs at 01:45 both before and after the change.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := s.Location
+	if loc == nil {
+		loc = t.Location()
+	}
+	t = t.In(loc)
+	if s.Every > 0 {
+		return t.Add(s.Every - time.Duration(t.Nanosecond()))
+	}
+	repeat := s.Minute&starBit > 0 || s.Hour&starBit > 0
+	w := wallClock(t)
+	var next time.Time
+	for {
+		if w = s.nextWall(w); w.IsZero() {
+			return w
+		}
+		next = wallTime(w, loc)
+		if repeat && !next.After(t) {
+			next = lastWallTime(next)
+		}
+		if next.After(t) {
+			break
+		}
+	}
+	// Walking the wall clock from t misses the wall times the clocks go
+	// back to.
+	if repeat {
+		if r := s.nextRepeat(t); !r.IsZero() && r.Before(next) {
+			next = r
+		}
+	}
+	return next
+}
+
+// nextRepeat returns the first time the schedule fires once the clocks go
+// back after t, zero when they do not.
+func (s *Schedule) nextRepeat(t time.Time) time.Time {
+	_, end := t.ZoneBounds()
+	if end.IsZero() {
+		return time.Time{}
+	}
+	_, offset := t.Zone()
+	if _, after := end.Zone(); after >= offset {
+		return time.Time{}
+	}
+	from := wallClock(end)
+	w := s.nextWall(from.Add(-time.Second))
+	if w.IsZero() {
+		return w
+	}
+	return end.Add(w.Sub(from))
+}
+
+// NextN returns the next n times the schedule fires after t, fewer when it
+// stops firing.
+func (s *Schedule) NextN(t time.Time, n int) []time.Time {
+	if n <= 0 {
+		return nil
+	}
+	times := make([]time.Time, 0, n)
+	for len(times) < n {
+		if t = s.Next(t); t.IsZero() {
+			break
+		}
+		times = append(times, t)
+	}
+	return times
+}
+
+// wallClock returns the wall clock of t as a UTC time, which has no gaps
+// nor repeats.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// wallTime returns the first instant in loc whose wall clock reads w or,
+// when w falls in a gap, the instant the gap ends.
+func wallTime(w time.Time, loc *time.Location) time.Time {
+	t := time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, loc)
+	switch tw := wallClock(t); {
+	case tw.After(w):
+		// In a gap, moved past its end.
+		start, _ := t.ZoneBounds()
+		return start
+	case tw.Before(w):
+		// In a gap, moved before its start.
+		_, end := t.ZoneBounds()
+		return end
+	}
+	// The wall clock may also be read an offset change earlier.
+	start, _ := t.ZoneBounds()
+	if start.IsZero() {
+		return t
+	}
+	_, prevOffset := start.Add(-time.Nanosecond).Zone()
+	_, offset := t.Zone()
+	if e := t.Add(time.Duration(offset-prevOffset) * time.Second); e.Before(start) && wallClock(e) == w {
+		return e
+	}
+	return t
+}
+
+// lastWallTime returns the second instant whose wall clock reads the same
+// as t, the first one, when the clocks go back over it, or t.
+func lastWallTime(t time.Time) time.Time {
+	_, end := t.ZoneBounds()
+	if end.IsZero() {
+		return t
+	}
+	_, offset := t.Zone()
+	_, after := end.Zone()
+	if l := t.Add(time.Duration(offset-after) * time.Second); !l.Before(end) && wallClock(l) == wallClock(t) {
+		return l
+	}
+	return t
+}
@@ -0,0 +1,72 @@
+package task
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestScheduleNextLocation(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(loc *time.Location, s string) time.Time {
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	// Instants around the 2024 New York changes: 02:00 EST became 03:00 EDT
+	// on March 10, 02:00 EDT became 01:00 EST on November 3.
+	fallEDT := at(time.UTC, "2024-11-03 05:30:00") // 01:30 EDT
+	fallEST := at(time.UTC, "2024-11-03 06:30:00") // 01:30 EST
+
+	tests := []struct {
+		name string
+		spec string
+		opts []Option
+		now  time.Time
+		want time.Time
+	}{
+		{"prefix on a utc clock", "CRON_TZ=Asia/Shanghai 0 0 9 * * *", nil,
+			at(time.UTC, "2024-06-01 00:00:00"), at(sh, "2024-06-01 09:00:00")},
+		{"option", "0 0 9 * * *", []Option{WithLocation(sh)},
+			at(time.UTC, "2024-06-01 02:00:00"), at(sh, "2024-06-02 09:00:00")},
+		{"prefix wins over option", "TZ=America/New_York 0 0 9 * * *", []Option{WithLocation(sh)},
+			at(time.UTC, "2024-06-01 00:00:00"), at(ny, "2024-06-01 09:00:00")},
+		{"skipped time runs when the gap ends", "CRON_TZ=America/New_York 0 30 2 * * *", nil,
+			at(ny, "2024-03-10 00:00:00"), at(ny, "2024-03-10 03:00:00")},
+		{"after the gap back to normal", "CRON_TZ=America/New_York 0 30 2 * * *", nil,
+			at(ny, "2024-03-10 03:00:00"), at(ny, "2024-03-11 02:30:00")},
+		{"every minute across the gap", "CRON_TZ=America/New_York 0 * * * * *", nil,
+			at(ny, "2024-03-10 01:59:00"), at(ny, "2024-03-10 03:00:00")},
+		{"repeated time runs first", "CRON_TZ=America/New_York 0 30 1 * * *", nil,
+			at(ny, "2024-11-03 00:00:00"), fallEDT},
+		{"repeated time runs once", "CRON_TZ=America/New_York 0 30 1 * * *", nil,
+			fallEDT, at(ny, "2024-11-04 01:30:00")},
+		{"fixed time inside the repeat", "CRON_TZ=America/New_York 0 30 1 * * *", nil,
+			fallEST.Add(-15 * time.Minute), at(ny, "2024-11-04 01:30:00")},
+		{"every minute runs the repeat", "CRON_TZ=America/New_York 0 * * * * *", nil,
+			fallEDT.Add(29 * time.Minute), at(time.UTC, "2024-11-03 06:00:00")},
+		{"every minute inside the repeat", "CRON_TZ=America/New_York 0 * * * * *", nil,
+			fallEST, fallEST.Add(time.Minute)},
+		{"every hour runs the repeat", "CRON_TZ=America/New_York 0 45 * * * *", nil,
+			fallEDT, at(time.UTC, "2024-11-03 05:45:00")},
+		{"every hour inside the repeat", "CRON_TZ=America/New_York 0 45 * * * *", nil,
+			fallEDT.Add(20 * time.Minute), at(time.UTC, "2024-11-03 06:45:00")},
+		{"every minute of a fixed hour runs the repeat", "CRON_TZ=America/New_York 0 * 1 * * *", nil,
+			fallEDT.Add(29 * time.Minute), at(time.UTC, "2024-11-03 06:00:00")},
+	}
+	for _, tt := range tests {
+		task := NewTask(tt.name, tt.spec, func() error { return nil }, tt.opts...)
+		if got := task.Spec.Next(tt.now); !got.Equal(tt.want) {
+			t.Errorf("%s: Next(%v) = %v, want %v", tt.name, tt.now, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package task
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultLockTTL is the lease of a LockedTask without TTL
+	DefaultLockTTL = time.Minute
+
+	// ErrLockHeld is returned by Locker.Acquire when another owner holds
+	// the lease
+	ErrLockHeld = errors.New("task: lock held by another owner")
+	// ErrLockLost is returned when a lease expired or was taken over
+	ErrLockLost = errors.New("task: lock lost")
+)
+
+// Lease is a lock on a name held until Expire
+type Lease struct {
+	Name  string
+	Owner string
+	// Token grows with every lease taken on Name, pass it along with the
+	// writes done under the lease so stale holders can be fenced off
+	Token  int64
+	Expire time.Time
+}
+
+// Locker hands out leases on names, one owner at a time
+type Locker interface {
+	// Acquire takes the lease on name for ttl, or returns ErrLockHeld
+	Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error)
+	// Refresh extends a lease to ttl from now, or returns ErrLockLost
+	Refresh(ctx context.Context, lease *Lease, ttl time.Duration) error
+	// Release gives a lease back before it expires
+	Release(ctx context.Context, lease *Lease) error
+}
+
+// LockedTask runs a Tasker only when it gets its lease, so when every
+// replica schedules the same task, one of them runs it.
+//
+// The lease is refreshed while the task runs and is not released when it
+// returns, so that replicas whose clock is a little late skip the same
+// run. TTL must then be longer than the clock skew between replicas, and
+// shorter than the time between two runs.
+type LockedTask struct {
+	Tasker
+	Locker   Locker
+	TTL      time.Duration
+	ErrorLog *log.Logger
+}
+
+// NewLockedTask wrap t to run under a lease of locker
+func NewLockedTask(t Tasker, locker Locker, ttl time.Duration) *LockedTask {
+	return &LockedTask{Tasker: t, Locker: locker, TTL: ttl}
+}
+
+// Run runs the task if it gets the lease, a run skipped because another
+// owner holds it returns nil
+func (t *LockedTask) Run() error {
+	return t.RunContext(context.Background())
+}
+
+// RunContext runs the task like Run. The context given to the task carries
+// the lease, see LeaseFromContext, and is cancelled if the lease is lost.
+func (t *LockedTask) RunContext(ctx context.Context) error {
+	ttl := t.TTL
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+	lease, err := t.Locker.Acquire(ctx, t.Name(), ttl)
+	if err == ErrLockHeld {
+		return nil
+	}
+	if err != nil {
+		t.logf("task: lock %s: %v", t.Name(), err)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, leaseKey{}, lease))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t.refresh(ctx, lease, ttl, cancel)
+	}()
+	err = runTasker(ctx, t.Tasker)
+	cancel()
+	<-done
+	return err
+}
+
+// refresh keeps the lease until ctx is done, and calls lost when it fails
+func (t *LockedTask) refresh(ctx context.Context, lease *Lease, ttl time.Duration, lost context.CancelFunc) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.Locker.Refresh(ctx, lease, ttl); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				t.logf("task: refresh lock %s: %v", t.Name(), err)
+				if err == ErrLockLost {
+					lost()
+					return
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SetCron change the spec of the wrapped task, when it can
+func (t *LockedTask) SetCron(spec string) error {
+	c, ok := t.Tasker.(interface{ SetCron(string) error })
+	if !ok {
+		return fmt.Errorf("task: %s cannot change its spec", t.Name())
+	}
+	return c.SetCron(spec)
+}
+
+// GetMisfire get the misfire policy of the wrapped task
+func (t *LockedTask) GetMisfire() MisfirePolicy {
+	if m, ok := t.Tasker.(Misfirer); ok {
+		return m.GetMisfire()
+	}
+	return MisfireSkip
+}
+
+type leaseKey struct{}
+
+// LeaseFromContext returns the lease a LockedTask runs under, to pass its
+// Token along with the writes of the task
+func LeaseFromContext(ctx context.Context) (*Lease, bool) {
+	lease, ok := ctx.Value(leaseKey{}).(*Lease)
+	return lease, ok
+}
+
+func (t *LockedTask) logf(format string, args ...interface{}) {
+	if t.ErrorLog != nil {
+		t.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// MemoryLocker is a Locker for a single process, and for tests
+type MemoryLocker struct {
+	Owner string
+	// Now is the clock of the leases, defaults to time.Now
+	Now func() time.Time
+
+	mu     sync.Mutex
+	leases map[string]Lease
+	tokens map[string]int64
+}
+
+// NewMemoryLocker create an empty MemoryLocker
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{
+		Owner:  newOwner(),
+		leases: make(map[string]Lease),
+		tokens: make(map[string]int64),
+	}
+}
+
+func (l *MemoryLocker) now() time.Time {
+	if l.Now != nil {
+		return l.Now()
+	}
+	return time.Now()
+}
+
+// Acquire implements Locker
+func (l *MemoryLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if held, ok := l.leases[name]; ok && now.Before(held.Expire) {
+		return nil, ErrLockHeld
+	}
+	l.tokens[name]++
+	lease := Lease{Name: name, Owner: l.Owner, Token: l.tokens[name], Expire: now.Add(ttl)}
+	l.leases[name] = lease
+	return &lease, nil
+}
+
+// Refresh implements Locker
+func (l *MemoryLocker) Refresh(ctx context.Context, lease *Lease, ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	held, ok := l.leases[lease.Name]
+	if !ok || held.Token != lease.Token || !now.Before(held.Expire) {
+		return ErrLockLost
+	}
+	held.Expire = now.Add(ttl)
+	l.leases[lease.Name] = held
+	lease.Expire = held.Expire
+	return nil
+}
+
+// Release implements Locker
+func (l *MemoryLocker) Release(ctx context.Context, lease *Lease) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if held, ok := l.leases[lease.Name]; ok && held.Token == lease.Token {
+		delete(l.leases, lease.Name)
+	}
+	return nil
+}
+
+// newOwner returns an owner id unique to this process
+func newOwner() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
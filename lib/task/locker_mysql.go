@@ -0,0 +1,101 @@
+package task
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DefaultLockTable is the table of MySQLLocker
+var DefaultLockTable = "task_lock"
+
+// MySQLLocker is a Locker on a MySQL table, one row per name. Acquire takes
+// the row lock with SELECT ... FOR UPDATE and expiry is checked against the
+// database clock, so the replicas do not need synchronised clocks.
+type MySQLLocker struct {
+	DB    *sql.DB
+	Table string
+	Owner string
+}
+
+// NewMySQLLocker create a MySQLLocker on db, for example the DB of a
+// lib/store/mysql session
+func NewMySQLLocker(db *sql.DB) *MySQLLocker {
+	return &MySQLLocker{DB: db, Table: DefaultLockTable, Owner: newOwner()}
+}
+
+// CreateTable creates the lock table when it does not exist
+func (l *MySQLLocker) CreateTable(ctx context.Context) error {
+	_, err := l.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS `"+l.Table+"` ("+
+		"`name` VARCHAR(191) NOT NULL PRIMARY KEY,"+
+		"`owner` VARCHAR(191) NOT NULL DEFAULT '',"+
+		"`token` BIGINT NOT NULL DEFAULT 0,"+
+		"`expire_at` DATETIME(3) NOT NULL DEFAULT '1970-01-01 00:00:01'"+
+		") ENGINE=InnoDB")
+	return err
+}
+
+// Acquire implements Locker
+func (l *MySQLLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (lease *Lease, err error) {
+	start := time.Now()
+	if _, err = l.DB.ExecContext(ctx, "INSERT IGNORE INTO `"+l.Table+"` (`name`) VALUES (?)", name); err != nil {
+		return nil, err
+	}
+
+	tx, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	var (
+		token int64
+		held  bool
+	)
+	row := tx.QueryRowContext(ctx, "SELECT `token`, `expire_at` > NOW(3) FROM `"+l.Table+"` WHERE `name` = ? FOR UPDATE", name)
+	if err = row.Scan(&token, &held); err != nil {
+		return nil, err
+	}
+	if held {
+		return nil, ErrLockHeld
+	}
+	token++
+	if _, err = tx.ExecContext(ctx, "UPDATE `"+l.Table+"` SET `owner` = ?, `token` = ?, `expire_at` = NOW(3) + INTERVAL ? MICROSECOND WHERE `name` = ?",
+		l.Owner, token, ttl.Microseconds(), name); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &Lease{Name: name, Owner: l.Owner, Token: token, Expire: start.Add(ttl)}, nil
+}
+
+// Refresh implements Locker
+func (l *MySQLLocker) Refresh(ctx context.Context, lease *Lease, ttl time.Duration) error {
+	start := time.Now()
+	res, err := l.DB.ExecContext(ctx, "UPDATE `"+l.Table+"` SET `expire_at` = NOW(3) + INTERVAL ? MICROSECOND "+
+		"WHERE `name` = ? AND `owner` = ? AND `token` = ? AND `expire_at` > NOW(3)",
+		ttl.Microseconds(), lease.Name, lease.Owner, lease.Token)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrLockLost
+	}
+	lease.Expire = start.Add(ttl)
+	return nil
+}
+
+// Release implements Locker
+func (l *MySQLLocker) Release(ctx context.Context, lease *Lease) error {
+	_, err := l.DB.ExecContext(ctx, "UPDATE `"+l.Table+"` SET `owner` = '', `expire_at` = '1970-01-01 00:00:01' "+
+		"WHERE `name` = ? AND `owner` = ? AND `token` = ?",
+		lease.Name, lease.Owner, lease.Token)
+	return err
+}
@@ -0,0 +1,110 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/fromiuan/goutils/lib/store/redis"
+)
+
+// DefaultLockPrefix prefixes the redis keys of RedisLocker
+var DefaultLockPrefix = "task:lock:"
+
+// The lock key holds "owner:token", the token key the last token handed out.
+// Both share a hash tag so the scripts also run on a redis cluster.
+const (
+	acquireScript = `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+local token = redis.call('INCR', KEYS[2])
+redis.call('SET', KEYS[1], ARGV[1] .. ':' .. token, 'PX', ARGV[2])
+return token
+`
+	refreshScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`
+	releaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+)
+
+// RedisLocker is a Locker on redis. Leases are keys set with an expiry,
+// and tokens come from a counter kept next to them.
+type RedisLocker struct {
+	Redis  redis.Doer
+	Prefix string
+	Owner  string
+}
+
+// NewRedisLocker create a RedisLocker running its commands on r, a
+// *redis.Client of lib/store/redis for example
+func NewRedisLocker(r redis.Doer) *RedisLocker {
+	return &RedisLocker{Redis: r, Prefix: DefaultLockPrefix, Owner: newOwner()}
+}
+
+func (l *RedisLocker) keys(name string) (lock, token string) {
+	lock = l.Prefix + "{" + name + "}"
+	return lock, lock + ":token"
+}
+
+// Acquire implements Locker
+func (l *RedisLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	lock, token := l.keys(name)
+	start := time.Now()
+	reply, err := l.Redis.Do(ctx, "EVAL", acquireScript, 2, lock, token, l.Owner, ttl.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return nil, fmt.Errorf("task: unexpected redis reply %v", reply)
+	}
+	if n == 0 {
+		return nil, ErrLockHeld
+	}
+	return &Lease{Name: name, Owner: l.Owner, Token: n, Expire: start.Add(ttl)}, nil
+}
+
+// Refresh implements Locker
+func (l *RedisLocker) Refresh(ctx context.Context, lease *Lease, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lock, _ := l.keys(lease.Name)
+	start := time.Now()
+	reply, err := l.Redis.Do(ctx, "EVAL", refreshScript, 1, lock, leaseValue(lease), ttl.Milliseconds())
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrLockLost
+	}
+	lease.Expire = start.Add(ttl)
+	return nil
+}
+
+// Release implements Locker
+func (l *RedisLocker) Release(ctx context.Context, lease *Lease) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lock, _ := l.keys(lease.Name)
+	_, err := l.Redis.Do(ctx, "EVAL", releaseScript, 1, lock, leaseValue(lease))
+	return err
+}
+
+func leaseValue(lease *Lease) string {
+	return lease.Owner + ":" + strconv.FormatInt(lease.Token, 10)
+}
@@ -0,0 +1,166 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMemoryLocker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a, b := NewMemoryLocker(), NewMemoryLocker()
+	b.leases, b.tokens = a.leases, a.tokens // one store, two owners
+	a.Now = func() time.Time { return now }
+	b.Now = a.Now
+
+	la, err := a.Acquire(ctx, "job", time.Minute)
+	if err != nil || la.Token != 1 {
+		t.Fatalf("Acquire = %+v, %v", la, err)
+	}
+	if _, err := a.Acquire(ctx, "job", time.Minute); err != ErrLockHeld {
+		t.Fatalf("second Acquire = %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	lb, err := b.Acquire(ctx, "job", time.Minute)
+	if err != nil || lb.Token != 2 {
+		t.Fatalf("Acquire after expiry = %+v, %v", lb, err)
+	}
+	if err := a.Refresh(ctx, la, time.Minute); err != ErrLockLost {
+		t.Fatalf("Refresh of a lost lease = %v", err)
+	}
+	a.Release(ctx, la)
+	if _, err := a.Acquire(ctx, "job", time.Minute); err != ErrLockHeld {
+		t.Fatal("releasing a lost lease freed the new one")
+	}
+	b.Release(ctx, lb)
+	if _, err := a.Acquire(ctx, "job", time.Minute); err != nil {
+		t.Fatalf("Acquire after Release = %v", err)
+	}
+}
+
+func TestLockedTaskRunsOnce(t *testing.T) {
+	var runs int32
+	locker := NewMemoryLocker()
+	var replicas []*LockedTask
+	for i := 0; i < 5; i++ {
+		job := NewTask("settle", "0 0 2 * * *", func() error {
+			atomic.AddInt32(&runs, 1)
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		})
+		replicas = append(replicas, NewLockedTask(job, locker, time.Minute))
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range replicas {
+		wg.Add(1)
+		go func(r *LockedTask) {
+			defer wg.Done()
+			if err := r.Run(); err != nil {
+				t.Error(err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	if runs != 1 {
+		t.Fatalf("ran %d times", runs)
+	}
+}
+
+// fakeRedisDo runs the locker scripts on a map, with expiries on a clock
+// the test moves.
+type fakeRedisDo struct {
+	mu     sync.Mutex
+	now    time.Time
+	vals   map[string]string
+	expire map[string]time.Time
+}
+
+func (f *fakeRedisDo) get(key string) (string, bool) {
+	if exp, ok := f.expire[key]; ok && !f.now.Before(exp) {
+		delete(f.vals, key)
+		delete(f.expire, key)
+	}
+	v, ok := f.vals[key]
+	return v, ok
+}
+
+func (f *fakeRedisDo) Do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cmd != "EVAL" {
+		return nil, fmt.Errorf("unexpected %s", cmd)
+	}
+	script, key := args[0].(string), args[2].(string)
+	cur, ok := f.get(key)
+	switch script {
+	case acquireScript:
+		if ok {
+			return int64(0), nil
+		}
+		tokenKey := args[3].(string)
+		var token int64
+		fmt.Sscan(f.vals[tokenKey], &token)
+		token++
+		f.vals[tokenKey] = fmt.Sprint(token)
+		f.vals[key] = fmt.Sprintf("%s:%d", args[4], token)
+		f.expire[key] = f.now.Add(time.Duration(args[5].(int64)) * time.Millisecond)
+		return token, nil
+	case refreshScript:
+		if !ok || cur != args[3].(string) {
+			return int64(0), nil
+		}
+		f.expire[key] = f.now.Add(time.Duration(args[4].(int64)) * time.Millisecond)
+		return int64(1), nil
+	case releaseScript:
+		if !ok || cur != args[3].(string) {
+			return int64(0), nil
+		}
+		delete(f.vals, key)
+		return int64(1), nil
+	}
+	return nil, fmt.Errorf("unexpected script")
+}
+
+func TestRedisLocker(t *testing.T) {
+	ctx := context.Background()
+	f := &fakeRedisDo{now: time.Now(), vals: map[string]string{}, expire: map[string]time.Time{}}
+	a, b := NewRedisLocker(f), NewRedisLocker(f)
+
+	la, err := a.Acquire(ctx, "job", time.Minute)
+	if err != nil || la.Token != 1 {
+		t.Fatalf("Acquire = %+v, %v", la, err)
+	}
+	if !strings.HasPrefix(f.vals["task:lock:{job}"], a.Owner+":") {
+		t.Fatalf("lock value = %q", f.vals["task:lock:{job}"])
+	}
+	if _, err := b.Acquire(ctx, "job", time.Minute); err != ErrLockHeld {
+		t.Fatalf("Acquire by b = %v", err)
+	}
+	if err := a.Refresh(ctx, la, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	f.now = f.now.Add(2 * time.Minute)
+	f.mu.Unlock()
+	lb, err := b.Acquire(ctx, "job", time.Minute)
+	if err != nil || lb.Token != 2 {
+		t.Fatalf("Acquire after expiry = %+v, %v", lb, err)
+	}
+	if err := a.Refresh(ctx, la, time.Minute); err != ErrLockLost {
+		t.Fatalf("Refresh of a lost lease = %v", err)
+	}
+	if err := a.Release(ctx, la); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Acquire(ctx, "job", time.Minute); err != ErrLockHeld {
+		t.Fatal("releasing a lost lease freed the new one")
+	}
+}
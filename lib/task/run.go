@@ -0,0 +1,240 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultHistory is the number of runs a task remembers
+var DefaultHistory = 20
+
+// ContextTaskFunc task func type taking a context, which is done when the
+// timeout of the task expires or the scheduler gives up waiting for it
+type ContextTaskFunc func(ctx context.Context) error
+
+// ContextRunner is implemented by tasks that can run under a context, the
+// Scheduler prefers RunContext over Run
+type ContextRunner interface {
+	RunContext(ctx context.Context) error
+}
+
+// runTasker runs t under ctx when it can
+func runTasker(ctx context.Context, t Tasker) error {
+	if cr, ok := t.(ContextRunner); ok {
+		return cr.RunContext(ctx)
+	}
+	return t.Run()
+}
+
+// contextFunc returns cf, or f when cf is nil
+func contextFunc(f TaskFunc, cf ContextTaskFunc) ContextTaskFunc {
+	if cf != nil {
+		return cf
+	}
+	return func(context.Context) error { return f() }
+}
+
+// RetryPolicy tells how often and when a failed run is tried again
+type RetryPolicy struct {
+	// MaxAttempts counts the first run, 0 and 1 mean no retry
+	MaxAttempts int
+	// Delay is the wait before the first retry
+	Delay time.Duration
+	// Multiplier grows the wait after each retry, below 1 means fixed
+	Multiplier float64
+	// MaxDelay caps the wait, 0 means no cap
+	MaxDelay time.Duration
+	// Jitter randomises the wait by up to this fraction of it, 0 to 1
+	Jitter float64
+}
+
+// FixedRetry retries up to attempts runs in all, waiting delay between them
+func FixedRetry(attempts int, delay time.Duration) RetryPolicy {
+	return RetryPolicy{MaxAttempts: attempts, Delay: delay}
+}
+
+// ExponentialRetry retries up to attempts runs in all, doubling the wait
+// from delay up to max, with 20% jitter
+func ExponentialRetry(attempts int, delay, max time.Duration) RetryPolicy {
+	return RetryPolicy{MaxAttempts: attempts, Delay: delay, Multiplier: 2, MaxDelay: max, Jitter: 0.2}
+}
+
+// backoff returns the wait after the given failed attempt, from 1
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.Delay)
+	if p.Multiplier > 1 {
+		d *= math.Pow(p.Multiplier, float64(attempt-1))
+	}
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// RunRecord is one attempt of a task run
+type RunRecord struct {
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Duration time.Duration `json:"duration"`
+	Err      string        `json:"err,omitempty"`
+	Attempt  int           `json:"attempt"`
+}
+
+// TaskStatus is a snapshot of a task, ready to be encoded as JSON
+type TaskStatus struct {
+	Name      string      `json:"name"`
+	Spec      string      `json:"spec"`
+	Prev      time.Time   `json:"prev"`
+	Next      time.Time   `json:"next"`
+	Paused    bool        `json:"paused"`
+	Running   int         `json:"running"`
+	Runs      int64       `json:"runs"`
+	Failures  int64       `json:"failures"`
+	LastError string      `json:"last_error,omitempty"`
+	History   []RunRecord `json:"history"`
+}
+
+// runHistory keeps the counters and the last records of a task
+type runHistory struct {
+	mu       sync.Mutex
+	records  []RunRecord // ring, next is the oldest once full
+	next     int
+	running  int
+	runs     int64
+	failures int64
+	lastErr  string
+}
+
+func (h *runHistory) add(r RunRecord, size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if size <= 0 {
+		size = DefaultHistory
+	}
+	if len(h.records) < size {
+		h.records = append(h.records, r)
+		h.next = len(h.records) % size
+		return
+	}
+	h.records[h.next] = r
+	h.next = (h.next + 1) % len(h.records)
+}
+
+// status fills the run part of s, records oldest first
+func (h *runHistory) status(s *TaskStatus) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s.Running = h.running
+	s.Runs = h.runs
+	s.Failures = h.failures
+	s.LastError = h.lastErr
+	s.History = make([]RunRecord, 0, len(h.records))
+	if len(h.records) > 0 {
+		s.History = append(s.History, h.records[h.next:]...)
+		s.History = append(s.History, h.records[:h.next]...)
+	}
+}
+
+// runOptions is how a task runs its func
+type runOptions struct {
+	timeout time.Duration
+	retry   RetryPolicy
+	history int
+}
+
+// run calls f until it succeeds or the retry policy gives up, recording
+// every attempt
+func (h *runHistory) run(ctx context.Context, f ContextTaskFunc, o runOptions) error {
+	h.mu.Lock()
+	h.running++
+	h.mu.Unlock()
+
+	attempts := o.retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		var left <-chan error
+		left, err = attemptRun(ctx, f, o.timeout)
+		end := time.Now()
+		r := RunRecord{Start: start, End: end, Duration: end.Sub(start), Attempt: attempt}
+		if err != nil {
+			r.Err = err.Error()
+		}
+		h.add(r, o.history)
+
+		if err == nil || attempt >= attempts || ctx.Err() != nil {
+			break
+		}
+		// never retry alongside an attempt that outlived its timeout
+		if left != nil {
+			select {
+			case <-left:
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		timer := time.NewTimer(o.retry.backoff(attempt))
+		select {
+		case <-timer.C:
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		break
+	}
+
+	h.mu.Lock()
+	h.running--
+	h.runs++
+	if err != nil {
+		h.failures++
+		h.lastErr = err.Error()
+	}
+	h.mu.Unlock()
+	return err
+}
+
+// attemptRun calls f once under timeout. A func that ignores its context
+// is left running in the background when the timeout expires, left then
+// receives its result once it returns.
+func attemptRun(ctx context.Context, f ContextTaskFunc, timeout time.Duration) (left <-chan error, err error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("task: panic: %v", r)
+			}
+		}()
+		done <- f(ctx)
+	}()
+	select {
+	case err := <-done:
+		return nil, err
+	case <-ctx.Done():
+		return done, ctx.Err()
+	}
+}
+
+// statusJSON is the GetStatus of the tasks of this package
+func statusJSON(s TaskStatus) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
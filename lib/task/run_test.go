@@ -0,0 +1,109 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunRetries(t *testing.T) {
+	var calls int
+	job := NewTask("flaky", "0 0 2 * * *", func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("attempt %d failed", calls)
+		}
+		return nil
+	}, WithRetry(FixedRetry(5, time.Millisecond)))
+
+	if err := job.Run(); err != nil {
+		t.Fatal(err)
+	}
+	s := job.Status()
+	if calls != 3 || s.Runs != 1 || s.Failures != 0 || len(s.History) != 3 {
+		t.Fatalf("calls %d, status %+v", calls, s)
+	}
+	if s.History[0].Err != "attempt 1 failed" || s.History[2].Err != "" || s.History[2].Attempt != 3 {
+		t.Fatalf("history %+v", s.History)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	job := NewContextTask("slow", "0 0 2 * * *", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, WithTimeout(10*time.Millisecond))
+
+	if err := job.Run(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run = %v", err)
+	}
+	if s := job.Status(); s.Failures != 1 || s.LastError != context.DeadlineExceeded.Error() {
+		t.Fatalf("status %+v", s)
+	}
+}
+
+func TestRunTimeoutRetry(t *testing.T) {
+	var running, overlaps, calls int32
+	job := NewTask("stubborn", "0 0 2 * * *", func() error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(30 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}, WithTimeout(5*time.Millisecond), WithRetry(FixedRetry(3, time.Millisecond)))
+
+	if err := job.Run(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Run = %v", err)
+	}
+	// the retries start once the attempt before them returned
+	if calls, overlaps := atomic.LoadInt32(&calls), atomic.LoadInt32(&overlaps); calls != 3 || overlaps != 0 {
+		t.Fatalf("%d calls, %d overlapping", calls, overlaps)
+	}
+}
+
+func TestRunPanic(t *testing.T) {
+	job := NewTask("panics", "0 0 2 * * *", func() error { panic("boom") })
+	if err := job.Run(); err == nil || err.Error() != "task: panic: boom" {
+		t.Fatalf("Run = %v", err)
+	}
+}
+
+func TestRunHistoryRing(t *testing.T) {
+	var calls int
+	job := NewTask("ring", "0 0 2 * * *", func() error {
+		calls++
+		return fmt.Errorf("run %d", calls)
+	}, WithHistory(3))
+	for i := 0; i < 5; i++ {
+		job.Run()
+	}
+
+	var s TaskStatus
+	if err := json.Unmarshal([]byte(job.GetStatus()), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "ring" || s.Runs != 5 || s.Failures != 5 || len(s.History) != 3 {
+		t.Fatalf("status %+v", s)
+	}
+	for i, r := range s.History {
+		if want := fmt.Sprintf("run %d", i+3); r.Err != want {
+			t.Fatalf("history[%d] = %q, want %q", i, r.Err, want)
+		}
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	p := ExponentialRetry(10, 100*time.Millisecond, time.Second)
+	p.Jitter = 0
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if got := p.backoff(attempt + 1); got != want*time.Millisecond {
+			t.Errorf("backoff(%d) = %v, want %v", attempt+1, got, want*time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrTaskNotFound is returned for a task name the scheduler does not have
+var ErrTaskNotFound = errors.New("task: task not found")
+
+// Clock is the time source of a Scheduler.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns a channel receiving the time once d has passed, and
+	// a function stopping the timer like time.Timer.Stop.
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+// Scheduler runs a set of Taskers, each at the times of its spec. The zero
+// value is not usable, create one with NewScheduler.
+type Scheduler struct {
+	// Store keeps the state of the tasks across restarts, set it before
+	// Start. Without one, the runs missed while the process was down are
+	// lost. A run counts as done once it starts.
+	Store StateStore
+	// ErrorLog logs the errors of Store, defaults to the log package
+	ErrorLog *log.Logger
+	// Clock tells the time to the scheduler, defaults to the system clock.
+	// Set it before adding tasks.
+	Clock Clock
+
+	mu    sync.Mutex
+	tasks map[string]Tasker
+	stop  chan struct{}
+	done  chan struct{}
+	wake  chan struct{}
+	// jobs counts the running jobs, Stop swaps in a new one so that a Wait
+	// it gave up on never shares it with a later Start. Add to it under mu.
+	jobs *sync.WaitGroup
+	// jobCtx is the context of the running jobs, nil when not started
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
+	// mirror is kept a copy of tasks, it is AdminTaskList for
+	// DefaultScheduler
+	mirror map[string]Tasker
+}
+
+// NewScheduler create a scheduler without tasks
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		tasks: make(map[string]Tasker),
+		wake:  make(chan struct{}, 1),
+		jobs:  new(sync.WaitGroup),
+	}
+}
+
+// Start starts running the tasks in a goroutine. It does nothing when the
+// scheduler is already started. Cancelling ctx stops the scheduler like
+// Stop with a done context: it does not wait for the running jobs and
+// cancels their context. Tasks implementing ContextRunner get a context
+// that Stop cancels when it gives up waiting for them.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	s.jobCtx, s.cancelJobs = context.WithCancel(context.Background())
+	go s.run(ctx, s.jobCtx, s.stop, s.done)
+}
+
+// Stop stops starting tasks and waits for the running ones to return, or
+// for ctx to be done, in which case it cancels the context of the running
+// jobs and returns ctx.Err().
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	stop, done, cancel := s.stop, s.done, s.cancelJobs
+	s.stop, s.done, s.jobCtx, s.cancelJobs = nil, nil, nil, nil
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+	// taken once the run loop returned, the jobs of a later Start are
+	// counted apart
+	s.mu.Lock()
+	jobs := s.jobs
+	s.jobs = new(sync.WaitGroup)
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(finished)
+	}()
+	if cancel != nil {
+		defer cancel()
+	}
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Add adds t, replacing the task of the same name. When the scheduler is
+// started, t catches up on its missed runs like at Start.
+func (s *Scheduler) Add(t Tasker) {
+	s.mu.Lock()
+	jobCtx := s.jobCtx
+	s.mu.Unlock()
+	s.restore(jobCtx, t, s.now())
+
+	s.mu.Lock()
+	s.tasks[t.Name()] = t
+	if s.mirror != nil {
+		s.mirror[t.Name()] = t
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// Remove removes the task named name. A run in progress is not stopped.
+func (s *Scheduler) Remove(name string) {
+	s.mu.Lock()
+	delete(s.tasks, name)
+	if s.mirror != nil {
+		delete(s.mirror, name)
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// Reload replaces all the tasks with list.
+func (s *Scheduler) Reload(list map[string]Tasker) {
+	s.mu.Lock()
+	jobCtx := s.jobCtx
+	s.mu.Unlock()
+	tasks := make(map[string]Tasker, len(list))
+	now := s.now()
+	for name, t := range list {
+		s.restore(jobCtx, t, now)
+		tasks[name] = t
+	}
+	s.mu.Lock()
+	s.tasks = tasks
+	if s.mirror != nil {
+		for name := range s.mirror {
+			delete(s.mirror, name)
+		}
+		for name, t := range tasks {
+			s.mirror[name] = t
+		}
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+// Get returns the task named name.
+func (s *Scheduler) Get(name string) (Tasker, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tasks[name]
+	return t, ok
+}
+
+// List returns the tasks, the next one to run first.
+func (s *Scheduler) List() []Tasker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sortList := NewMapSorter(s.tasks)
+	sortList.Sort()
+	return sortList.Vals
+}
+
+// Trigger runs the task named name now, paused or not, without waiting for
+// it to return.
+func (s *Scheduler) Trigger(name string) error {
+	s.mu.Lock()
+	t, ok := s.tasks[name]
+	jobCtx, jobs := s.jobCtx, s.jobs
+	if ok {
+		jobs.Add(1)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return ErrTaskNotFound
+	}
+	if jobCtx == nil {
+		jobCtx = context.Background()
+	}
+	go func() {
+		defer jobs.Done()
+		runTasker(jobCtx, t)
+	}()
+	return nil
+}
+
+// Pause stops running the task named name until Resume.
+func (s *Scheduler) Pause(name string) error {
+	t, ok := s.Get(name)
+	if !ok {
+		return ErrTaskNotFound
+	}
+	t.Pause()
+	return nil
+}
+
+// Resume runs the task named name again, from its next time.
+func (s *Scheduler) Resume(name string) error {
+	t, ok := s.Get(name)
+	if !ok {
+		return ErrTaskNotFound
+	}
+	t.Resume()
+	return nil
+}
+
+// SetSpec changes the spec of the task named name, which must have a
+// SetCron method like Task.
+func (s *Scheduler) SetSpec(name, spec string) error {
+	t, ok := s.Get(name)
+	if !ok {
+		return ErrTaskNotFound
+	}
+	c, ok := t.(interface{ SetCron(string) error })
+	if !ok {
+		return fmt.Errorf("task: %s cannot change its spec", name)
+	}
+	if err := c.SetCron(spec); err != nil {
+		return err
+	}
+	t.SetNext(s.now())
+	s.notify()
+	return nil
+}
+
+func (s *Scheduler) clock() Clock {
+	if s.Clock != nil {
+		return s.Clock
+	}
+	return systemClock{}
+}
+
+func (s *Scheduler) now() time.Time {
+	return s.clock().Now().Local()
+}
+
+// notify makes the run loop look at the tasks again.
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run(ctx, jobCtx context.Context, stop, done chan struct{}) {
+	defer close(done)
+
+	now := s.now()
+	s.mu.Lock()
+	tasks := make([]Tasker, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		tasks = append(tasks, t)
+	}
+	s.mu.Unlock()
+	for _, t := range tasks {
+		s.restore(jobCtx, t, now)
+	}
+
+	for {
+		s.mu.Lock()
+		effective := s.nextLocked(now)
+		s.mu.Unlock()
+
+		timer, stopTimer := s.clock().NewTimer(effective.Sub(now))
+		select {
+		case now = <-timer:
+			now = now.Local()
+			var fired []Tasker
+			s.mu.Lock()
+			jobs := s.jobs
+			for _, t := range s.tasks {
+				next := t.GetNext()
+				if next.IsZero() || next.After(effective) {
+					continue
+				}
+				if t.Paused() {
+					t.SetNext(effective)
+					continue
+				}
+				t.SetPrev(next)
+				t.SetNext(effective)
+				fired = append(fired, t)
+				jobs.Add(1)
+				go func(t Tasker) {
+					defer jobs.Done()
+					runTasker(jobCtx, t)
+				}(t)
+			}
+			s.mu.Unlock()
+			for _, t := range fired {
+				s.save(jobCtx, t)
+			}
+		case <-s.wake:
+			stopTimer()
+			now = s.now()
+		case <-stop:
+			stopTimer()
+			return
+		case <-ctx.Done():
+			stopTimer()
+			s.mu.Lock()
+			var cancel context.CancelFunc
+			if s.stop == stop {
+				cancel = s.cancelJobs
+				s.stop, s.done, s.jobCtx, s.cancelJobs = nil, nil, nil, nil
+			}
+			s.mu.Unlock()
+			if cancel != nil {
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// nextLocked returns the earliest next time of the tasks. With no task to
+// run it returns a time far enough away to just wait for changes.
+func (s *Scheduler) nextLocked(now time.Time) time.Time {
+	var effective time.Time
+	for _, t := range s.tasks {
+		next := t.GetNext()
+		if !next.IsZero() && (effective.IsZero() || next.Before(effective)) {
+			effective = next
+		}
+	}
+	if effective.IsZero() {
+		return now.AddDate(10, 0, 0)
+	}
+	return effective
+}
+
+// restore moves t to its first time after now. When the scheduler is
+// started and has a Store, t then catches up on the runs it missed since
+// its saved state, following its misfire policy.
+func (s *Scheduler) restore(jobCtx context.Context, t Tasker, now time.Time) {
+	if jobCtx == nil || s.Store == nil {
+		t.SetNext(now)
+		return
+	}
+	st, err := s.Store.Load(jobCtx, t.Name())
+	if err != nil {
+		s.logf("task: load state %s: %v", t.Name(), err)
+	}
+	var runs []time.Time
+	if st != nil {
+		t.SetPrev(st.Prev)
+		policy := MisfireSkip
+		if m, ok := t.(Misfirer); ok {
+			policy = m.GetMisfire()
+		}
+		runs = missedRuns(t, st, policy, now)
+	}
+	t.SetNext(now)
+	if len(runs) == 0 {
+		s.save(jobCtx, t)
+		return
+	}
+
+	s.mu.Lock()
+	jobs := s.jobs
+	jobs.Add(1)
+	s.mu.Unlock()
+	go func() {
+		defer jobs.Done()
+		for _, prev := range runs {
+			if jobCtx.Err() != nil || t.Paused() {
+				return
+			}
+			t.SetPrev(prev)
+			s.save(jobCtx, t)
+			runTasker(jobCtx, t)
+		}
+	}()
+}
+
+// save writes the state of t to the Store.
+func (s *Scheduler) save(ctx context.Context, t Tasker) {
+	if s.Store == nil {
+		return
+	}
+	st := TaskState{Name: t.Name(), Prev: t.GetPrev(), Next: t.GetNext()}
+	if err := s.Store.Save(ctx, st); err != nil {
+		s.logf("task: save state %s: %v", t.Name(), err)
+	}
+}
+
+func (s *Scheduler) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,288 @@
+package task
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock whose time only moves with set.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]bool
+	armed  chan struct{}
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, timers: make(map[*fakeTimer]bool), armed: make(chan struct{}, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers[t] = true
+	c.armed <- struct{}{}
+	return t.c, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		active := c.timers[t]
+		delete(c.timers, t)
+		return active
+	}
+}
+
+// next waits for the scheduler to wait on a timer and returns its time.
+func (c *fakeClock) next(t *testing.T) time.Time {
+	t.Helper()
+	select {
+	case <-c.armed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("scheduler did not wait on a timer")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.timers) != 1 {
+		t.Fatalf("%d timers", len(c.timers))
+	}
+	for tm := range c.timers {
+		return tm.at
+	}
+	return time.Time{}
+}
+
+// set moves the clock to now, firing the timers due.
+func (c *fakeClock) set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+	for tm := range c.timers {
+		if !tm.at.After(now) {
+			delete(c.timers, tm)
+			tm.c <- now
+		}
+	}
+}
+
+func TestSchedulerRegistry(t *testing.T) {
+	s1, s2 := NewScheduler(), NewScheduler()
+	s1.Add(NewTask("a", "0 0 * * * *", func() error { return nil }))
+	s1.Add(NewTask("b", "* * * * * *", func() error { return nil }))
+
+	if _, ok := s2.Get("a"); ok {
+		t.Fatal("task added to s1 is in s2")
+	}
+	list := s1.List()
+	if len(list) != 2 || list[0].Name() != "b" {
+		t.Fatalf("List = %v", list)
+	}
+	s1.Remove("b")
+	if _, ok := s1.Get("b"); ok {
+		t.Fatal("b still there after Remove")
+	}
+	if tk, ok := s1.Get("a"); !ok || tk.GetNext().IsZero() {
+		t.Fatalf("Get(a) = %v, %v", tk, ok)
+	}
+}
+
+func TestSchedulerStopWaitsForJobs(t *testing.T) {
+	var finished int32
+	started := make(chan struct{}, 1)
+	s := NewScheduler()
+	s.Add(NewTask("slow", "* * * * * *", func() error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		time.Sleep(200 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+		return nil
+	}))
+	s.Start(context.Background())
+
+	select {
+	case <-started:
+	case <-time.After(3 * time.Second):
+		t.Fatal("task never ran")
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Fatal("Stop returned before the running job finished")
+	}
+
+	// A done context cuts the wait short.
+	s.Start(context.Background())
+	<-started
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Stop(ctx); err != context.Canceled {
+		t.Fatalf("Stop with a done context = %v", err)
+	}
+}
+
+// deafTask is a Tasker whose runs ignore their context.
+type deafTask struct {
+	*Task
+	run func() error
+}
+
+func (t *deafTask) Run() error                           { return t.run() }
+func (t *deafTask) RunContext(ctx context.Context) error { return t.run() }
+
+func TestSchedulerRestartAfterStopTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	var runs int32
+	s := NewScheduler()
+	s.Add(&deafTask{Task: NewTask("slow", "0 0 0 1 1 *", nil), run: func() error {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			<-release
+		}
+		return nil
+	}})
+	s.Start(context.Background())
+	s.Trigger("slow")
+	for atomic.LoadInt32(&runs) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Stop = %v", err)
+	}
+
+	// the job left by the first run is not waited for by the second
+	s.Start(context.Background())
+	for i := 0; i < 10; i++ {
+		s.Trigger("slow")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("second Stop = %v", err)
+	}
+	if n := atomic.LoadInt32(&runs); n != 11 {
+		t.Fatalf("%d runs, want 11", n)
+	}
+}
+
+func TestSchedulerContextDone(t *testing.T) {
+	s := NewScheduler()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	s.mu.Lock()
+	jobCtx := s.jobCtx
+	s.mu.Unlock()
+	cancel()
+
+	select {
+	case <-jobCtx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("job context not cancelled")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil || s.jobCtx != nil || s.cancelJobs != nil {
+		t.Fatal("scheduler still looks started")
+	}
+}
+
+func TestAdminTaskList(t *testing.T) {
+	AddTask("admin-list", NewTask("admin-list", "0 0 * * * *", func() error { return nil }))
+	if _, ok := AdminTaskList["admin-list"]; !ok {
+		t.Fatalf("AdminTaskList = %v", AdminTaskList)
+	}
+	list := TaskList()
+	if _, ok := list["admin-list"]; !ok {
+		t.Fatalf("TaskList = %v", list)
+	}
+	delete(list, "admin-list")
+	if _, ok := DefaultScheduler.Get("admin-list"); !ok {
+		t.Fatal("changing the copy removed the task")
+	}
+	DeleteTask("admin-list")
+	if _, ok := AdminTaskList["admin-list"]; ok {
+		t.Fatal("AdminTaskList keeps a deleted task")
+	}
+}
+
+func TestSchedulerDaylightSaving(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// From 00:00 EDT to 03:00 EST on November 3 2024, the clocks go back
+	// from 02:00 EDT to 01:00 EST.
+	start := time.Date(2024, 11, 3, 4, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 11, 3, 8, 0, 0, 0, time.UTC)
+
+	var mu sync.Mutex
+	runs := map[string][]time.Time{}
+	ran := make(chan struct{}, 10)
+	clock := newFakeClock(start)
+	s := NewScheduler()
+	s.Clock = clock
+	for _, spec := range []string{"0 30 1 * * *", "0 45 * * * *"} {
+		spec := spec
+		s.Add(NewTask(spec, spec, func() error {
+			mu.Lock()
+			runs[spec] = append(runs[spec], clock.Now())
+			mu.Unlock()
+			ran <- struct{}{}
+			return nil
+		}, WithLocation(ny)))
+	}
+	// drop the wake of Add, the run loop then waits on one timer at a time
+	<-s.wake
+	s.Start(context.Background())
+	for {
+		at := clock.next(t)
+		if at.After(end) {
+			break
+		}
+		clock.set(at)
+		select {
+		case <-ran:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("nothing ran at %v", at)
+		}
+	}
+	s.Stop(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	utc := func(h, m int) time.Time { return time.Date(2024, 11, 3, h, m, 0, 0, time.UTC) }
+	want := map[string][]time.Time{
+		// once, at 01:30 EDT
+		"0 30 1 * * *": {utc(5, 30)},
+		// 00:45 EDT, 01:45 EDT, 01:45 EST, 02:45 EST
+		"0 45 * * * *": {utc(4, 45), utc(5, 45), utc(6, 45), utc(7, 45)},
+	}
+	for spec, times := range want {
+		got := runs[spec]
+		if len(got) != len(times) {
+			t.Fatalf("%s ran at %v, want %v", spec, got, times)
+		}
+		for i := range times {
+			if !got[i].Equal(times[i]) {
+				t.Fatalf("%s ran at %v, want %v", spec, got, times)
+			}
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxMisfires caps the runs MisfireFireAll catches up on, the
+// latest ones are kept
+var DefaultMaxMisfires = 100
+
+// MisfirePolicy tells what a scheduler does with the runs a task missed
+// while the process was down
+type MisfirePolicy int
+
+const (
+	// MisfireSkip drops missed runs, the task runs at its next time
+	MisfireSkip MisfirePolicy = iota
+	// MisfireFireOnce runs the task once at startup for all missed runs
+	MisfireFireOnce
+	// MisfireFireAll runs the task once for every missed run, in order
+	MisfireFireAll
+)
+
+// String returns the name of the policy
+func (p MisfirePolicy) String() string {
+	switch p {
+	case MisfireSkip:
+		return "skip"
+	case MisfireFireOnce:
+		return "fire_once"
+	case MisfireFireAll:
+		return "fire_all"
+	}
+	return "unknown"
+}
+
+// Misfirer is implemented by tasks with a misfire policy, other tasks skip
+// their missed runs
+type Misfirer interface {
+	GetMisfire() MisfirePolicy
+}
+
+// TaskState is what a StateStore keeps of a task. Next is the first run
+// that has not started, so a Next in the past at startup was missed.
+type TaskState struct {
+	Name string    `json:"name"`
+	Prev time.Time `json:"prev"`
+	Next time.Time `json:"next"`
+}
+
+// StateStore keeps the state of tasks across restarts
+type StateStore interface {
+	// Load returns the state saved for name, nil when there is none
+	Load(ctx context.Context, name string) (*TaskState, error)
+	// Save replaces the state of st.Name
+	Save(ctx context.Context, st TaskState) error
+}
+
+// missedRuns returns the times t should have run from st.Next up to now,
+// following policy. It moves the next time of t along the way. The runs
+// are found back from now, so a task down for a long time costs no more
+// than one down for a while.
+func missedRuns(t Tasker, st *TaskState, policy MisfirePolicy, now time.Time) []time.Time {
+	if policy == MisfireSkip || st.Next.IsZero() || st.Next.After(now) {
+		return nil
+	}
+	max := DefaultMaxMisfires
+	if policy == MisfireFireOnce || max < 1 {
+		max = 1
+	}
+	if every := everyOf(t); every > 0 {
+		// the runs are st.Next plus a multiple of every
+		last := int64(now.Sub(st.Next) / every)
+		first := last - int64(max) + 1
+		if first < 0 {
+			first = 0
+		}
+		runs := make([]time.Time, 0, last-first+1)
+		for i := first; i <= last; i++ {
+			runs = append(runs, st.Next.Add(time.Duration(i)*every))
+		}
+		return runs
+	}
+	var runs []time.Time
+	for r := prevRun(t, now, st.Next); !r.IsZero() && len(runs) < max; r = prevRun(t, r.Add(-time.Nanosecond), st.Next) {
+		runs = append(runs, r)
+	}
+	for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+		runs[i], runs[j] = runs[j], runs[i]
+	}
+	return runs
+}
+
+// prevRun returns the last time t runs at from floor up to before, zero
+// when there is none. Cron times fall on whole seconds, so it searches
+// back from before for the last second after which t runs by before.
+func prevRun(t Tasker, before, floor time.Time) time.Time {
+	next := func(at time.Time) time.Time {
+		t.SetNext(at)
+		return t.GetNext()
+	}
+	runsBy := func(at time.Time) bool {
+		r := next(at)
+		return !r.IsZero() && !r.After(before)
+	}
+	// lo and hi bound the search: t runs by before after lo, not after hi
+	hi, lo := before, before
+	for d := time.Second; ; d *= 2 {
+		lo = before.Add(-d)
+		if min := floor.Add(-time.Second); !lo.After(min) {
+			lo = min
+			if !runsBy(lo) {
+				return time.Time{}
+			}
+			break
+		}
+		if runsBy(lo) {
+			break
+		}
+		hi = lo
+	}
+	for hi.Sub(lo) > time.Second {
+		mid := lo.Add(hi.Sub(lo) / 2)
+		if runsBy(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return next(lo)
+}
+
+// everyOf returns the interval of an @every task, zero for other tasks
+func everyOf(t Tasker) time.Duration {
+	spec := t.GetSpec()
+	if !strings.HasPrefix(spec, "@every ") {
+		return 0
+	}
+	s, err := parseDescriptor(spec)
+	if err != nil {
+		return 0
+	}
+	return s.Every
+}
+
+// FileStateStore is a StateStore on a JSON file, for a single process
+type FileStateStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// NewFileStateStore create a FileStateStore writing to path
+func NewFileStateStore(path string) *FileStateStore {
+	return &FileStateStore{Path: path}
+}
+
+func (s *FileStateStore) read() (map[string]TaskState, error) {
+	states := make(map[string]TaskState)
+	b, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return states, nil
+	}
+	if err := json.Unmarshal(b, &states); err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+// Load implements StateStore
+func (s *FileStateStore) Load(ctx context.Context, name string) (*TaskState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	st, ok := states[name]
+	if !ok {
+		return nil, nil
+	}
+	return &st, nil
+}
+
+// Save implements StateStore, the file is replaced atomically
+func (s *FileStateStore) Save(ctx context.Context, st TaskState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	states, err := s.read()
+	if err != nil {
+		return err
+	}
+	states[st.Name] = st
+	b, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
@@ -0,0 +1,67 @@
+package task
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DefaultStateTable is the table of MySQLStateStore
+var DefaultStateTable = "task_state"
+
+// MySQLStateStore is a StateStore on a MySQL table, one row per task. Times
+// are kept as unix nanoseconds, so the DSN needs no parseTime.
+type MySQLStateStore struct {
+	DB    *sql.DB
+	Table string
+}
+
+// NewMySQLStateStore create a MySQLStateStore on db
+func NewMySQLStateStore(db *sql.DB) *MySQLStateStore {
+	return &MySQLStateStore{DB: db, Table: DefaultStateTable}
+}
+
+// CreateTable creates the state table when it does not exist
+func (s *MySQLStateStore) CreateTable(ctx context.Context) error {
+	_, err := s.DB.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS `"+s.Table+"` ("+
+		"`name` VARCHAR(191) NOT NULL PRIMARY KEY,"+
+		"`prev_at` BIGINT NOT NULL DEFAULT 0,"+
+		"`next_at` BIGINT NOT NULL DEFAULT 0"+
+		") ENGINE=InnoDB")
+	return err
+}
+
+// Load implements StateStore
+func (s *MySQLStateStore) Load(ctx context.Context, name string) (*TaskState, error) {
+	var prev, next int64
+	row := s.DB.QueryRowContext(ctx, "SELECT `prev_at`, `next_at` FROM `"+s.Table+"` WHERE `name` = ?", name)
+	if err := row.Scan(&prev, &next); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &TaskState{Name: name, Prev: fromUnixNano(prev), Next: fromUnixNano(next)}, nil
+}
+
+// Save implements StateStore
+func (s *MySQLStateStore) Save(ctx context.Context, st TaskState) error {
+	_, err := s.DB.ExecContext(ctx, "INSERT INTO `"+s.Table+"` (`name`, `prev_at`, `next_at`) VALUES (?, ?, ?) "+
+		"ON DUPLICATE KEY UPDATE `prev_at` = VALUES(`prev_at`), `next_at` = VALUES(`next_at`)",
+		st.Name, toUnixNano(st.Prev), toUnixNano(st.Next))
+	return err
+}
+
+// toUnixNano keeps the zero time as 0
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
@@ -0,0 +1,63 @@
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/fromiuan/goutils/lib/store/redis"
+)
+
+// DefaultStateKey is the redis hash of RedisStateStore
+var DefaultStateKey = "task:state"
+
+// RedisStateStore is a StateStore on a redis hash, one field per task
+type RedisStateStore struct {
+	Redis redis.Doer
+	Key   string
+}
+
+// NewRedisStateStore create a RedisStateStore running its commands on r
+func NewRedisStateStore(r redis.Doer) *RedisStateStore {
+	return &RedisStateStore{Redis: r, Key: DefaultStateKey}
+}
+
+// Load implements StateStore
+func (s *RedisStateStore) Load(ctx context.Context, name string) (*TaskState, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	reply, err := s.Redis.Do(ctx, "HGET", s.Key, name)
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	switch v := reply.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return nil, fmt.Errorf("task: unexpected redis reply %v", reply)
+	}
+	st := new(TaskState)
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Save implements StateStore
+func (s *RedisStateStore) Save(ctx context.Context, st TaskState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	_, err = s.Redis.Do(ctx, "HSET", s.Key, st.Name, b)
+	return err
+}
@@ -0,0 +1,129 @@
+package task
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStateStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+	if st, err := store.Load(ctx, "job"); st != nil || err != nil {
+		t.Fatalf("Load of an empty store = %+v, %v", st, err)
+	}
+	want := TaskState{Name: "job", Prev: time.Unix(100, 0).UTC(), Next: time.Unix(200, 0).UTC()}
+	if err := store.Save(ctx, want); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, TaskState{Name: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewFileStateStore(store.Path).Load(ctx, "job")
+	if err != nil || st == nil || !st.Prev.Equal(want.Prev) || !st.Next.Equal(want.Next) {
+		t.Fatalf("Load = %+v, %v", st, err)
+	}
+}
+
+func TestSchedulerMisfire(t *testing.T) {
+	now := time.Now().Local()
+	due := now.Truncate(time.Minute).Add(-3 * time.Minute)
+
+	for _, tc := range []struct {
+		policy MisfirePolicy
+		runs   int
+	}{
+		{MisfireSkip, 0},
+		{MisfireFireOnce, 1},
+		{MisfireFireAll, 4},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			store := NewFileStateStore(filepath.Join(t.TempDir(), "state.json"))
+			store.Save(context.Background(), TaskState{Name: "job", Prev: due.Add(-time.Minute), Next: due})
+
+			var (
+				mu    sync.Mutex
+				prevs []time.Time
+			)
+			job := NewTask("job", "0 * * * * *", nil, WithMisfire(tc.policy))
+			job.DoFunc = func() error {
+				mu.Lock()
+				prevs = append(prevs, job.GetPrev())
+				mu.Unlock()
+				return nil
+			}
+
+			s := NewScheduler()
+			s.Store = store
+			s.Add(job)
+			s.Start(context.Background())
+			if err := s.Stop(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			max := tc.runs
+			if tc.policy == MisfireFireAll {
+				max++ // a minute may have turned since now
+			}
+			if len(prevs) < tc.runs || len(prevs) > max {
+				t.Fatalf("ran at %v", prevs)
+			}
+			for i, prev := range prevs {
+				if tc.policy == MisfireFireAll && !prev.Equal(due.Add(time.Duration(i)*time.Minute)) {
+					t.Fatalf("run %d at %v, want %v", i, prev, due.Add(time.Duration(i)*time.Minute))
+				}
+			}
+
+			st, _ := store.Load(context.Background(), "job")
+			if st == nil || !st.Next.After(now) {
+				t.Fatalf("saved state %+v", st)
+			}
+		})
+	}
+}
+
+// countingTask counts the times its next time is moved.
+type countingTask struct {
+	*Task
+	moves int
+}
+
+func (t *countingTask) SetNext(now time.Time) {
+	t.moves++
+	t.Task.SetNext(now)
+}
+
+func TestMissedRunsLongDowntime(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 30, 500, time.UTC)
+	st := &TaskState{Name: "job", Next: now.AddDate(-1, 0, 0).Truncate(time.Second)}
+
+	for _, tc := range []struct {
+		spec   string
+		policy MisfirePolicy
+		runs   int
+		last   time.Time
+		step   time.Duration
+	}{
+		{"* * * * * *", MisfireFireOnce, 1, now.Truncate(time.Second), time.Second},
+		{"* * * * * *", MisfireFireAll, DefaultMaxMisfires, now.Truncate(time.Second), time.Second},
+		{"0 0 3 * * *", MisfireFireAll, DefaultMaxMisfires, time.Date(2024, 6, 1, 3, 0, 0, 0, time.UTC), 24 * time.Hour},
+		{"0 0 3 1 1 *", MisfireFireAll, 1, time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC), 0},
+		{"@every 7s", MisfireFireAll, DefaultMaxMisfires, st.Next.Add(now.Sub(st.Next) / (7 * time.Second) * 7 * time.Second), 7 * time.Second},
+	} {
+		job := &countingTask{Task: NewTask("job", tc.spec, nil, WithLocation(time.UTC))}
+		runs := missedRuns(job, st, tc.policy, now)
+		if len(runs) != tc.runs || !runs[len(runs)-1].Equal(tc.last) {
+			t.Fatalf("%s %s: runs %d, last %v", tc.spec, tc.policy, len(runs), runs[len(runs)-1])
+		}
+		for i := 1; i < len(runs); i++ {
+			if runs[i].Sub(runs[i-1]) != tc.step {
+				t.Fatalf("%s %s: run %d at %v after %v", tc.spec, tc.policy, i, runs[i], runs[i-1])
+			}
+		}
+		if job.moves > 100*len(runs) {
+			t.Fatalf("%s %s: %d moves for %d runs", tc.spec, tc.policy, job.moves, len(runs))
+		}
+	}
+}
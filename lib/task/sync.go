@@ -1,8 +1,8 @@
 package task
 
 import (
+	"context"
 	"log"
-	"strings"
 	"sync"
 	"time"
 )
@@ -17,40 +17,83 @@ type SyncTask struct {
 	Next     time.Time
 	Errlist  []*taskerr // like errtime:errinfo
 	ErrLimit int        // max length for the errlist, 0 stand for no limit
-	running  bool
-	lock     sync.Mutex
+	Location *time.Location
+	// ContextFunc is run instead of DoFunc when set
+	ContextFunc ContextTaskFunc
+	// Timeout bounds each attempt, 0 means no timeout
+	Timeout time.Duration
+	// Retry tells how a failed run is tried again
+	Retry RetryPolicy
+	// HistoryLimit is the number of runs kept, 0 means DefaultHistory
+	HistoryLimit int
+	// Misfire tells what to do with the runs missed while the process
+	// was down, see Scheduler.Store
+	Misfire MisfirePolicy
+
+	running bool
+	paused  bool
+	lock    sync.Mutex
+	history runHistory
 }
 
-// NewSyncTask add new task with name, time and func
-func NewSyncTask(tname string, spec string, f TaskFunc) *SyncTask {
-
+// NewSyncTask add new task with name, time and func, it panics when spec is
+// invalid
+func NewSyncTask(tname string, spec string, f TaskFunc, opts ...Option) *SyncTask {
+	o := applyOptions(opts)
 	task := &SyncTask{
-		Taskname: tname,
-		DoFunc:   f,
-		ErrLimit: 100,
-		SpecStr:  spec,
-		running:  false,
+		Taskname:     tname,
+		DoFunc:       f,
+		ErrLimit:     100,
+		SpecStr:      spec,
+		Location:     o.location,
+		Timeout:      o.timeout,
+		Retry:        o.retry,
+		HistoryLimit: o.history,
+		Misfire:      o.misfire,
+		running:      false,
+	}
+	if err := task.SetCron(spec); err != nil {
+		log.Panic(err)
 	}
-	task.SetCron(spec)
+	return task
+}
+
+// NewContextSyncTask add new task with name, time and a func taking a context
+func NewContextSyncTask(tname string, spec string, f ContextTaskFunc, opts ...Option) *SyncTask {
+	task := NewSyncTask(tname, spec, nil, opts...)
+	task.ContextFunc = f
 	return task
 }
 
 // GetSpec get spec string
 func (t *SyncTask) GetSpec() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	return t.SpecStr
 }
 
-// GetStatus get current task status
+// GetStatus get current task status as JSON, see Status
 func (t *SyncTask) GetStatus() string {
-	var str string
-	for _, v := range t.Errlist {
-		str += v.t.String() + ":" + v.errinfo + "<br>"
-	}
-	return str
+	return statusJSON(t.Status())
+}
+
+// Status get current task status with the last runs, oldest first
+func (t *SyncTask) Status() TaskStatus {
+	t.lock.Lock()
+	s := TaskStatus{Name: t.Taskname, Spec: t.SpecStr, Prev: t.Prev, Next: t.Next, Paused: t.paused}
+	t.lock.Unlock()
+	t.history.status(&s)
+	return s
 }
 
 // Run run all tasks
 func (t *SyncTask) Run() error {
+	return t.RunContext(context.Background())
+}
+
+// RunContext run the task under ctx, with its timeout and retries, unless
+// the previous run is still going
+func (t *SyncTask) RunContext(ctx context.Context) error {
 	t.lock.Lock()
 	if t.running {
 		t.lock.Unlock()
@@ -58,35 +101,70 @@ func (t *SyncTask) Run() error {
 	}
 	t.running = true
 	t.lock.Unlock()
-	err := t.DoFunc()
+	o := runOptions{timeout: t.Timeout, retry: t.Retry, history: t.HistoryLimit}
+	err := t.history.run(ctx, contextFunc(t.DoFunc, t.ContextFunc), o)
+	t.lock.Lock()
 	if err != nil {
 		if t.ErrLimit > 0 && t.ErrLimit > len(t.Errlist) {
-			t.Errlist = append(t.Errlist, &taskerr{t: t.Next, errinfo: err.Error()})
+			t.Errlist = append(t.Errlist, &taskerr{t: t.Prev, errinfo: err.Error()})
 		}
 	}
-	t.lock.Lock()
 	t.running = false
 	t.lock.Unlock()
 	return err
 }
 
+// Pause stops the scheduler from running this task until Resume
+func (t *SyncTask) Pause() {
+	t.lock.Lock()
+	t.paused = true
+	t.lock.Unlock()
+}
+
+// Resume lets the scheduler run this task again
+func (t *SyncTask) Resume() {
+	t.lock.Lock()
+	t.paused = false
+	t.lock.Unlock()
+}
+
+// Paused tells whether this task is paused
+func (t *SyncTask) Paused() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.paused
+}
+
+// GetMisfire get the misfire policy of this task
+func (t *SyncTask) GetMisfire() MisfirePolicy {
+	return t.Misfire
+}
+
 // SetNext set next time for this task
 func (t *SyncTask) SetNext(now time.Time) {
+	t.lock.Lock()
 	t.Next = t.Spec.Next(now)
+	t.lock.Unlock()
 }
 
 // GetNext get the next call time of this task
 func (t *SyncTask) GetNext() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	return t.Next
 }
 
 // SetPrev set prev time of this task
 func (t *SyncTask) SetPrev(now time.Time) {
+	t.lock.Lock()
 	t.Prev = now
+	t.lock.Unlock()
 }
 
 // GetPrev get prev time of this task
 func (t *SyncTask) GetPrev() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	return t.Prev
 }
 
@@ -103,6 +181,7 @@ func (t *SyncTask) GetPrev() time.Time {
 //       ,：　 separate signal
 //　　    －：duration
 //       /n : do as n times of time duration
+//       ?, L, W, #, @every : see Task.SetCron
 /////////////////////////////////////////////////////////
 //	0/30 * * * * *                        every 30s
 //	0 43 21 * * *                         21:43
@@ -122,91 +201,19 @@ func (t *SyncTask) GetPrev() time.Time {
 //	0 0 * * * *　　　　　　　　               0 min of hour in 1 hour duration
 //	0 2 8-20/3 * * *　　　　　　             8:02, 11:02, 14:02, 17:02, 20:02
 //	0 30 5 1,15 * *　　　　　　              5:30 on the 1st day and 15th day of month
-func (t *SyncTask) SetCron(spec string) {
-	t.Spec = t.parse(spec)
-}
-
-func (t *SyncTask) parse(spec string) *Schedule {
-	if len(spec) > 0 && spec[0] == '@' {
-		return t.parseSpec(spec)
-	}
-	// Split on whitespace.  We require 5 or 6 fields.
-	// (second) (minute) (hour) (day of month) (month) (day of week, optional)
-	fields := strings.Fields(spec)
-	if len(fields) != 5 && len(fields) != 6 {
-		log.Panicf("Expected 5 or 6 fields, found %d: %s", len(fields), spec)
-	}
-
-	// If a sixth field is not provided (DayOfWeek), then it is equivalent to star.
-	if len(fields) == 5 {
-		fields = append(fields, "*")
-	}
-
-	schedule := &Schedule{
-		Second: getField(fields[0], seconds),
-		Minute: getField(fields[1], minutes),
-		Hour:   getField(fields[2], hours),
-		Day:    getField(fields[3], days),
-		Month:  getField(fields[4], months),
-		Week:   getField(fields[5], weeks),
+//	CRON_TZ=Asia/Shanghai 0 0 9 * * *      9:00 in Shanghai, whatever the local zone
+func (t *SyncTask) SetCron(spec string) error {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return err
 	}
-
-	return schedule
-}
-
-func (t *SyncTask) parseSpec(spec string) *Schedule {
-	switch spec {
-	case "@yearly", "@annually":
-		return &Schedule{
-			Second: 1 << seconds.min,
-			Minute: 1 << minutes.min,
-			Hour:   1 << hours.min,
-			Day:    1 << days.min,
-			Month:  1 << months.min,
-			Week:   all(weeks),
-		}
-
-	case "@monthly":
-		return &Schedule{
-			Second: 1 << seconds.min,
-			Minute: 1 << minutes.min,
-			Hour:   1 << hours.min,
-			Day:    1 << days.min,
-			Month:  all(months),
-			Week:   all(weeks),
-		}
-
-	case "@weekly":
-		return &Schedule{
-			Second: 1 << seconds.min,
-			Minute: 1 << minutes.min,
-			Hour:   1 << hours.min,
-			Day:    all(days),
-			Month:  all(months),
-			Week:   1 << weeks.min,
-		}
-
-	case "@daily", "@midnight":
-		return &Schedule{
-			Second: 1 << seconds.min,
-			Minute: 1 << minutes.min,
-			Hour:   1 << hours.min,
-			Day:    all(days),
-			Month:  all(months),
-			Week:   all(weeks),
-		}
-
-	case "@hourly":
-		return &Schedule{
-			Second: 1 << seconds.min,
-			Minute: 1 << minutes.min,
-			Hour:   all(hours),
-			Day:    all(days),
-			Month:  all(months),
-			Week:   all(weeks),
-		}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if schedule.Location == nil {
+		schedule.Location = t.Location
 	}
-	log.Panicf("Unrecognized descriptor: %s", spec)
+	t.Spec = schedule
+	t.SpecStr = spec
 	return nil
 }
 
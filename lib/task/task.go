@@ -1,11 +1,14 @@
 package task
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -17,13 +20,6 @@ type bounds struct {
 
 // The bounds for each field.
 var (
-	AdminTaskList map[string]Tasker
-	stop          chan bool
-	remove        chan string
-	add           chan Tasker
-	reload        chan map[string]Tasker
-
-	isstart bool
 	seconds = bounds{0, 59, nil}
 	minutes = bounds{0, 59, nil}
 	hours   = bounds{0, 23, nil}
@@ -66,6 +62,18 @@ type Schedule struct {
 	Day    uint64
 	Month  uint64
 	Week   uint64
+	// Location the fields are read in, nil means the location of the time
+	// given to Next
+	Location *time.Location
+	// Every fires at a fixed interval from the previous time, the fields
+	// are ignored when it is set
+	Every time.Duration
+
+	lastDays    []uint   // L, L-n: days before the last day of month
+	lastWorkday bool     // LW: last weekday of month
+	nearWorkday uint64   // nW: weekday nearest to day n
+	lastWeekday uint64   // dL: last weekday d of month
+	nthWeekday  [7]uint8 // d#n: bit n-1 set for weekday d
 }
 
 // TaskFunc task func type
@@ -75,12 +83,16 @@ type TaskFunc func() error
 type Tasker interface {
 	GetSpec() string
 	GetStatus() string
+	Status() TaskStatus
 	Run() error
 	SetNext(time.Time)
 	GetNext() time.Time
 	SetPrev(time.Time)
 	GetPrev() time.Time
 	Name() string
+	Pause()
+	Resume()
+	Paused() bool
 }
 
 // task error
@@ -99,63 +111,143 @@ type Task struct {
 	Next     time.Time
 	Errlist  []*taskerr // like errtime:errinfo
 	ErrLimit int        // max length for the errlist, 0 stand for no limit
-}
-
-// NewTask add new task with name, time and func
-func NewTask(tname string, spec string, f TaskFunc) *Task {
-
+	Location *time.Location
+	// ContextFunc is run instead of DoFunc when set
+	ContextFunc ContextTaskFunc
+	// Timeout bounds each attempt, 0 means no timeout
+	Timeout time.Duration
+	// Retry tells how a failed run is tried again
+	Retry RetryPolicy
+	// HistoryLimit is the number of runs kept, 0 means DefaultHistory
+	HistoryLimit int
+	// Misfire tells what to do with the runs missed while the process
+	// was down, see Scheduler.Store
+	Misfire MisfirePolicy
+
+	lock    sync.Mutex
+	paused  bool
+	history runHistory
+}
+
+// NewTask add new task with name, time and func, it panics when spec is
+// invalid, check specs with Parse first when they come from users
+func NewTask(tname string, spec string, f TaskFunc, opts ...Option) *Task {
+	o := applyOptions(opts)
 	task := &Task{
-		Taskname: tname,
-		DoFunc:   f,
-		ErrLimit: 100,
-		SpecStr:  spec,
+		Taskname:     tname,
+		DoFunc:       f,
+		ErrLimit:     100,
+		SpecStr:      spec,
+		Location:     o.location,
+		Timeout:      o.timeout,
+		Retry:        o.retry,
+		HistoryLimit: o.history,
+		Misfire:      o.misfire,
+	}
+	if err := task.SetCron(spec); err != nil {
+		log.Panic(err)
 	}
-	task.SetCron(spec)
+	return task
+}
+
+// NewContextTask add new task with name, time and a func taking a context
+func NewContextTask(tname string, spec string, f ContextTaskFunc, opts ...Option) *Task {
+	task := NewTask(tname, spec, nil, opts...)
+	task.ContextFunc = f
 	return task
 }
 
 // GetSpec get spec string
 func (t *Task) GetSpec() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	return t.SpecStr
 }
 
-// GetStatus get current task status
+// GetStatus get current task status as JSON, see Status
 func (t *Task) GetStatus() string {
-	var str string
-	for _, v := range t.Errlist {
-		str += v.t.String() + ":" + v.errinfo + "<br>"
-	}
-	return str
+	return statusJSON(t.Status())
+}
+
+// Status get current task status with the last runs, oldest first
+func (t *Task) Status() TaskStatus {
+	t.lock.Lock()
+	s := TaskStatus{Name: t.Taskname, Spec: t.SpecStr, Prev: t.Prev, Next: t.Next, Paused: t.paused}
+	t.lock.Unlock()
+	t.history.status(&s)
+	return s
 }
 
 // Run run all tasks
 func (t *Task) Run() error {
-	err := t.DoFunc()
+	return t.RunContext(context.Background())
+}
+
+// RunContext run the task under ctx, with its timeout and retries
+func (t *Task) RunContext(ctx context.Context) error {
+	o := runOptions{timeout: t.Timeout, retry: t.Retry, history: t.HistoryLimit}
+	err := t.history.run(ctx, contextFunc(t.DoFunc, t.ContextFunc), o)
 	if err != nil {
+		t.lock.Lock()
 		if t.ErrLimit > 0 && t.ErrLimit > len(t.Errlist) {
-			t.Errlist = append(t.Errlist, &taskerr{t: t.Next, errinfo: err.Error()})
+			t.Errlist = append(t.Errlist, &taskerr{t: t.Prev, errinfo: err.Error()})
 		}
+		t.lock.Unlock()
 	}
 	return err
 }
 
+// Pause stops the scheduler from running this task until Resume
+func (t *Task) Pause() {
+	t.lock.Lock()
+	t.paused = true
+	t.lock.Unlock()
+}
+
+// Resume lets the scheduler run this task again
+func (t *Task) Resume() {
+	t.lock.Lock()
+	t.paused = false
+	t.lock.Unlock()
+}
+
+// Paused tells whether this task is paused
+func (t *Task) Paused() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.paused
+}
+
+// GetMisfire get the misfire policy of this task
+func (t *Task) GetMisfire() MisfirePolicy {
+	return t.Misfire
+}
+
 // SetNext set next time for this task
 func (t *Task) SetNext(now time.Time) {
+	t.lock.Lock()
 	t.Next = t.Spec.Next(now)
+	t.lock.Unlock()
 }
 
 // GetNext get the next call time of this task
 func (t *Task) GetNext() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	return t.Next
 }
 
 // SetPrev set prev time of this task
 func (t *Task) SetPrev(now time.Time) {
+	t.lock.Lock()
 	t.Prev = now
+	t.lock.Unlock()
 }
 
 // GetPrev get prev time of this task
 func (t *Task) GetPrev() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	return t.Prev
 }
 
@@ -177,6 +269,11 @@ func (t *Task) Name() string {
 //       ,：　 separate signal
 //　　    －：duration
 //       /n : do as n times of time duration
+//       ?： any time, for day or week
+//       L： last day of month (L, L-2 two days before), last weekday of month (LW),
+//           last given day of week in month (5L or friL)
+//       W： weekday nearest to the day of month (15W)
+//       #： nth given day of week in month (fri#3)
 /////////////////////////////////////////////////////////
 //	0/30 * * * * *                        every 30s
 //	0 43 21 * * *                         21:43
@@ -196,19 +293,52 @@ func (t *Task) Name() string {
 //	0 0 * * * *　　　　　　　　               0 min of hour in 1 hour duration
 //	0 2 8-20/3 * * *　　　　　　             8:02, 11:02, 14:02, 17:02, 20:02
 //	0 30 5 1,15 * *　　　　　　              5:30 on the 1st day and 15th day of month
-func (t *Task) SetCron(spec string) {
-	t.Spec = t.parse(spec)
+//	0 0 18 L * ?                          18:00 on the last day of month
+//	0 0 9 15W * ?                         9:00 on the weekday nearest to the 15th
+//	0 0 10 ? * fri#3                      10:00 on the third Friday of month
+//	0 0 10 ? * 5L                         10:00 on the last Friday of month
+//	@every 1h30m                          every hour and a half
+//	CRON_TZ=Asia/Shanghai 0 0 9 * * *      9:00 in Shanghai, whatever the local zone
+func (t *Task) SetCron(spec string) error {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if schedule.Location == nil {
+		schedule.Location = t.Location
+	}
+	t.Spec = schedule
+	t.SpecStr = spec
+	return nil
 }
 
-func (t *Task) parse(spec string) *Schedule {
+// Parse parses a spec as described on SetCron
+func Parse(spec string) (*Schedule, error) {
+	loc, spec, err := splitLocation(spec)
+	if err != nil {
+		return nil, err
+	}
+	var schedule *Schedule
 	if len(spec) > 0 && spec[0] == '@' {
-		return t.parseSpec(spec)
+		schedule, err = parseDescriptor(spec)
+	} else {
+		schedule, err = parseFields(spec)
+	}
+	if err != nil {
+		return nil, err
 	}
+	schedule.Location = loc
+	return schedule, nil
+}
+
+func parseFields(spec string) (*Schedule, error) {
 	// Split on whitespace.  We require 5 or 6 fields.
 	// (second) (minute) (hour) (day of month) (month) (day of week, optional)
 	fields := strings.Fields(spec)
 	if len(fields) != 5 && len(fields) != 6 {
-		log.Panicf("Expected 5 or 6 fields, found %d: %s", len(fields), spec)
+		return nil, fmt.Errorf("expected 5 or 6 fields, found %d: %s", len(fields), spec)
 	}
 
 	// If a sixth field is not provided (DayOfWeek), then it is equivalent to star.
@@ -216,19 +346,43 @@ func (t *Task) parse(spec string) *Schedule {
 		fields = append(fields, "*")
 	}
 
-	schedule := &Schedule{
-		Second: getField(fields[0], seconds),
-		Minute: getField(fields[1], minutes),
-		Hour:   getField(fields[2], hours),
-		Day:    getField(fields[3], days),
-		Month:  getField(fields[4], months),
-		Week:   getField(fields[5], weeks),
+	var (
+		schedule = &Schedule{}
+		err      error
+	)
+	if schedule.Second, err = getField(fields[0], seconds); err != nil {
+		return nil, err
 	}
-
-	return schedule
+	if schedule.Minute, err = getField(fields[1], minutes); err != nil {
+		return nil, err
+	}
+	if schedule.Hour, err = getField(fields[2], hours); err != nil {
+		return nil, err
+	}
+	if err = parseDays(fields[3], schedule); err != nil {
+		return nil, err
+	}
+	if schedule.Month, err = getField(fields[4], months); err != nil {
+		return nil, err
+	}
+	if err = parseWeeks(fields[5], schedule); err != nil {
+		return nil, err
+	}
+	return schedule, nil
 }
 
-func (t *Task) parseSpec(spec string) *Schedule {
+func parseDescriptor(spec string) (*Schedule, error) {
+	if strings.HasPrefix(spec, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration %s: %s", spec, err)
+		}
+		if every < time.Second {
+			return nil, fmt.Errorf("interval below one second: %s", spec)
+		}
+		return &Schedule{Every: every}, nil
+	}
+
 	switch spec {
 	case "@yearly", "@annually":
 		return &Schedule{
@@ -238,7 +392,7 @@ func (t *Task) parseSpec(spec string) *Schedule {
 			Day:    1 << days.min,
 			Month:  1 << months.min,
 			Week:   all(weeks),
-		}
+		}, nil
 
 	case "@monthly":
 		return &Schedule{
@@ -248,7 +402,7 @@ func (t *Task) parseSpec(spec string) *Schedule {
 			Day:    1 << days.min,
 			Month:  all(months),
 			Week:   all(weeks),
-		}
+		}, nil
 
 	case "@weekly":
 		return &Schedule{
@@ -258,7 +412,7 @@ func (t *Task) parseSpec(spec string) *Schedule {
 			Day:    all(days),
 			Month:  all(months),
 			Week:   1 << weeks.min,
-		}
+		}, nil
 
 	case "@daily", "@midnight":
 		return &Schedule{
@@ -268,7 +422,7 @@ func (t *Task) parseSpec(spec string) *Schedule {
 			Day:    all(days),
 			Month:  all(months),
 			Week:   all(weeks),
-		}
+		}, nil
 
 	case "@hourly":
 		return &Schedule{
@@ -278,14 +432,14 @@ func (t *Task) parseSpec(spec string) *Schedule {
 			Day:    all(days),
 			Month:  all(months),
 			Week:   all(weeks),
-		}
+		}, nil
 	}
-	log.Panicf("Unrecognized descriptor: %s", spec)
-	return nil
+	return nil, fmt.Errorf("unrecognized descriptor: %s", spec)
 }
 
-// Next set schedule to next time
-func (s *Schedule) Next(t time.Time) time.Time {
+// nextWall returns the first time after t matching the schedule, t must be
+// in a location without daylight saving changes
+func (s *Schedule) nextWall(t time.Time) time.Time {
 
 	// Start at the earliest possible time (the upcoming second).
 	t = t.Add(1*time.Second - time.Duration(t.Nanosecond())*time.Nanosecond)
@@ -372,8 +526,8 @@ WRAP:
 
 func dayMatches(s *Schedule, t time.Time) bool {
 	var (
-		domMatch = 1<<uint(t.Day())&s.Day > 0
-		dowMatch = 1<<uint(t.Weekday())&s.Week > 0
+		domMatch = 1<<uint(t.Day())&s.Day > 0 || s.extraDayMatches(t)
+		dowMatch = 1<<uint(t.Weekday())&s.Week > 0 || s.extraWeekMatches(t)
 	)
 
 	if s.Day&starBit > 0 || s.Week&starBit > 0 {
@@ -382,108 +536,57 @@ func dayMatches(s *Schedule, t time.Time) bool {
 	return domMatch || dowMatch
 }
 
+var (
+	// AdminTaskList is the task map of DefaultScheduler, which keeps it in
+	// sync. Reading it races with AddTask, DeleteTask and Reload, use
+	// TaskList or DefaultScheduler.List while the tasks may change.
+	AdminTaskList = make(map[string]Tasker)
+
+	// DefaultScheduler is the scheduler of the package level functions
+	DefaultScheduler = newDefaultScheduler()
+)
+
+func newDefaultScheduler() *Scheduler {
+	s := NewScheduler()
+	s.mirror = AdminTaskList
+	return s
+}
+
 // StartTask start all tasks
 func StartTask() {
-	if isstart {
-		//If already started， no need to start another goroutine.
-		return
-	}
-	isstart = true
-	go run()
-}
-
-func run() {
-	now := time.Now().Local()
-	for _, t := range AdminTaskList {
-		t.SetNext(now)
-	}
-
-	for {
-		sortList := NewMapSorter(AdminTaskList)
-		sortList.Sort()
-		var effective time.Time
-		if len(AdminTaskList) == 0 || sortList.Vals[0].GetNext().IsZero() {
-			// If there are no entries yet, just sleep - it still handles new entries
-			// and stop requests.
-			effective = now.AddDate(10, 0, 0)
-		} else {
-			effective = sortList.Vals[0].GetNext()
-		}
-		select {
-		case now = <-time.After(effective.Sub(now)):
-			// Run every entry whose next time was this effective time.
-			for _, e := range sortList.Vals {
-				if e.GetNext() != effective {
-					break
-				}
-				go e.Run()
-				e.SetPrev(e.GetNext())
-				e.SetNext(effective)
-			}
-			continue
-		case name := <-remove:
-			delete(AdminTaskList, name)
-			now = time.Now().Local()
-			continue
-		case list, ok := <-reload:
-			now = time.Now().Local()
-			if ok && list != nil {
-				AdminTaskList = list
-				for _, t := range AdminTaskList {
-					t.SetNext(now)
-				}
-			} else {
-				AdminTaskList = make(map[string]Tasker)
-			}
-			continue
-		case t, ok := <-add:
-			now = time.Now().Local()
-			if ok && t != nil {
-				t.SetNext(now)
-				AdminTaskList[t.Name()] = t
-			}
-			continue
-		case <-stop:
-			return
-		}
-	}
+	DefaultScheduler.Start(context.Background())
 }
 
-// StopTask stop all tasks
+// StopTask stop all tasks, waiting for the running ones
 func StopTask() {
-	if isstart {
-		isstart = false
-		stop <- true
-	}
-
+	DefaultScheduler.Stop(context.Background())
 }
 
 // AddTask add task with name
 func AddTask(name string, t Tasker) {
-	if isstart {
-		add <- t
-	} else {
-		AdminTaskList[t.Name()] = t
-		t.SetNext(time.Now().Local())
-	}
+	DefaultScheduler.Add(t)
 }
 
 // DeleteTask delete task with name
 func DeleteTask(taskname string) {
-	if isstart {
-		remove <- taskname
-	} else {
-		delete(AdminTaskList, taskname)
-	}
+	DefaultScheduler.Remove(taskname)
 }
 
 // Reload relaod the  tasker list
 func Reload(taskList map[string]Tasker) {
-	if isstart {
-		reload <- taskList
-	} else {
-		AdminTaskList = taskList
+	DefaultScheduler.Reload(taskList)
+}
+
+// TaskList returns a copy of the tasks of DefaultScheduler by name
+func TaskList() map[string]Tasker {
+	s := DefaultScheduler
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make(map[string]Tasker, len(s.tasks))
+	for name, t := range s.tasks {
+		list[name] = t
 	}
+	return list
 }
 
 // MapSorter sort map for tasker
@@ -525,19 +628,23 @@ func (ms *MapSorter) Swap(i, j int) {
 	ms.Keys[i], ms.Keys[j] = ms.Keys[j], ms.Keys[i]
 }
 
-func getField(field string, r bounds) uint64 {
+func getField(field string, r bounds) (uint64, error) {
 	// list = range {"," range}
 	var bits uint64
 	ranges := strings.FieldsFunc(field, func(r rune) bool { return r == ',' })
 	for _, expr := range ranges {
-		bits |= getRange(expr, r)
+		b, err := getRange(expr, r)
+		if err != nil {
+			return 0, err
+		}
+		bits |= b
 	}
-	return bits
+	return bits, nil
 }
 
 // getRange returns the bits indicated by the given expression:
 //   number | number "-" number [ "/" number ]
-func getRange(expr string, r bounds) uint64 {
+func getRange(expr string, r bounds) (uint64, error) {
 
 	var (
 		start, end, step uint
@@ -546,20 +653,27 @@ func getRange(expr string, r bounds) uint64 {
 		singleDigit      = len(lowAndHigh) == 1
 	)
 
-	var extrastar uint64
+	var (
+		extrastar uint64
+		err       error
+	)
 	if lowAndHigh[0] == "*" || lowAndHigh[0] == "?" {
 		start = r.min
 		end = r.max
 		extrastar = starBit
 	} else {
-		start = parseIntOrName(lowAndHigh[0], r.names)
+		if start, err = parseIntOrName(lowAndHigh[0], r.names); err != nil {
+			return 0, err
+		}
 		switch len(lowAndHigh) {
 		case 1:
 			end = start
 		case 2:
-			end = parseIntOrName(lowAndHigh[1], r.names)
+			if end, err = parseIntOrName(lowAndHigh[1], r.names); err != nil {
+				return 0, err
+			}
 		default:
-			log.Panicf("Too many hyphens: %s", expr)
+			return 0, fmt.Errorf("too many hyphens: %s", expr)
 		}
 	}
 
@@ -567,50 +681,55 @@ func getRange(expr string, r bounds) uint64 {
 	case 1:
 		step = 1
 	case 2:
-		step = mustParseInt(rangeAndStep[1])
+		if step, err = parseInt(rangeAndStep[1]); err != nil {
+			return 0, err
+		}
+		if step == 0 {
+			return 0, fmt.Errorf("step of range should be a positive number: %s", expr)
+		}
 
 		// Special handling: "N/step" means "N-max/step".
 		if singleDigit {
 			end = r.max
 		}
 	default:
-		log.Panicf("Too many slashes: %s", expr)
+		return 0, fmt.Errorf("too many slashes: %s", expr)
 	}
 
 	if start < r.min {
-		log.Panicf("Beginning of range (%d) below minimum (%d): %s", start, r.min, expr)
+		return 0, fmt.Errorf("beginning of range (%d) below minimum (%d): %s", start, r.min, expr)
 	}
 	if end > r.max {
-		log.Panicf("End of range (%d) above maximum (%d): %s", end, r.max, expr)
+		return 0, fmt.Errorf("end of range (%d) above maximum (%d): %s", end, r.max, expr)
 	}
 	if start > end {
-		log.Panicf("Beginning of range (%d) beyond end of range (%d): %s", start, end, expr)
+		return 0, fmt.Errorf("beginning of range (%d) beyond end of range (%d): %s", start, end, expr)
 	}
 
-	return getBits(start, end, step) | extrastar
+	return getBits(start, end, step) | extrastar, nil
 }
 
 // parseIntOrName returns the (possibly-named) integer contained in expr.
-func parseIntOrName(expr string, names map[string]uint) uint {
+func parseIntOrName(expr string, names map[string]uint) (uint, error) {
 	if names != nil {
 		if namedInt, ok := names[strings.ToLower(expr)]; ok {
-			return namedInt
+			return namedInt, nil
 		}
 	}
-	return mustParseInt(expr)
+	return parseInt(expr)
 }
 
-// mustParseInt parses the given expression as an int or panics.
-func mustParseInt(expr string) uint {
+// parseInt parses the given expression as a non negative int.
+func parseInt(expr string) (uint, error) {
 	num, err := strconv.Atoi(expr)
 	if err != nil {
-		log.Panicf("Failed to parse int from %s: %s", expr, err)
+		return 0, fmt.Errorf("failed to parse int from %s: %s", expr, err)
 	}
 	if num < 0 {
-		log.Panicf("Negative number (%d) not allowed: %s", num, expr)
+		return 0, fmt.Errorf("negative number (%d) not allowed: %s", num, expr)
 	}
 
-	return uint(num)
+	return uint(num), nil
 }
 
 // getBits sets all bits in the range [min, max], modulo the given step size.
@@ -633,11 +752,3 @@ func getBits(min, max, step uint) uint64 {
 func all(r bounds) uint64 {
 	return getBits(r.min, r.max, 1) | starBit
 }
-
-func init() {
-	AdminTaskList = make(map[string]Tasker)
-	stop = make(chan bool)
-	remove = make(chan string, 1024)
-	reload = make(chan map[string]Tasker)
-	add = make(chan Tasker, 1024)
-}